@@ -40,49 +40,109 @@ and fix or commit as needed.
 veb commands:
   init   - initializes a new veb repository at the current directory
   status - quick check of what's new or changed, no recomputing of checksums
-  verify - slow check of all files, recomputing all checksums
+           (with --remote, also where the committed files differ from a remote's)
+  verify - slow check of all files, recomputing all checksums (with --remote,
+           of a remote's copies)
+  scrub  - verify's nightly cousin: checks the files verified longest ago,
+           until its time or size budget runs out (with --repair, checks
+           a remote's copies too, and replaces bad copies with good ones)
   commit - blesses all new/changed files as good & adds them to the repository
-  remote - sets the backup location for this repository
+  remote - lists, adds, removes or renames the backup locations (remotes) for
+           this repository
   push   - sends committed files in current (local) repository to remote repo
            only sends files the remote doesn't have the latest of
   pull   - gets committed files from remote repo
-           only gets files the local repo doesn't have the latest of
+           only gets files the local repo doesn't have
   sync   - veb pull & veb push
   fix    - pulls the specified file from the remote, overwriting the local copy
+           (only its damaged blocks, if it has block checksums)
+  trash  - lists, restores or empties files 'veb push --trash' deleted from the
+           remote
+  versions - lists the previous copies of a file the remote kept when pushing
+  restore  - gets a previous copy of a file back from the remote
+  serve  - serves the veb repositories in a folder over the network, for
+           veb://host:port/path remotes (or over ssh, for ssh:// remotes)
+  bundle - writes the whole repository into one file for cold storage, or
+           checks such a bundle
+  clone  - restores a repository from a bundle
+  parity - makes recovery data for committed files, for repairing them without
+           a remote
+  repair - rebuilds damaged parts of files from their parity
   help   - prints help
 */
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"container/heap"
+	"context"
 	"crypto"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"os"
+	"os/signal"
 	"path"
+	"path/filepath"
 	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 	"spydez/veb/veb"
 )
 
 const (
 	// commands
-	FIX    = "fix"
-	HELP   = "help"
-	PUSH   = "push"
-	PULL   = "pull"
-	SYNC   = "sync"
-	INIT   = "init"
-	STATUS = "status"
-	VERIFY = "verify"
-	REMOTE = "remote"
-	COMMIT = "commit"
+	FIX      = "fix"
+	HELP     = "help"
+	PUSH     = "push"
+	PULL     = "pull"
+	SYNC     = "sync"
+	INIT     = "init"
+	SERVE    = "serve"
+	STATUS   = "status"
+	VERIFY   = "verify"
+	REMOTE   = "remote"
+	COMMIT   = "commit"
+	TRASH    = "trash"
+	VERSIONS = "versions"
+	RESTORE  = "restore"
+	BUNDLE   = "bundle"
+	CLONE    = "clone"
+	SCRUB    = "scrub"
+	PARITY   = "parity"
+	REPAIR   = "repair"
+
+	// bundle subcommands
+	BUNDLE_CREATE = "create"
+	BUNDLE_VERIFY = "verify"
+
+	// parity subcommands
+	PARITY_CREATE = "create"
+
+	// trash subcommands
+	TRASH_LIST    = "list"
+	TRASH_RESTORE = "restore"
+	TRASH_EMPTY   = "empty"
+
+	// remote subcommands
+	REMOTE_LIST   = "list"
+	REMOTE_ADD    = "add"
+	REMOTE_REMOVE = "remove"
+	REMOTE_RENAME = "rename"
 
 	// misc
-	QUIT_RUNE = 'q'
 	CHAN_SIZE = 1000
+	STATUS_TICK = 100 * time.Millisecond // how often status lines are redrawn
+	VERIFY_SAVE = 5 * time.Minute         // how often verify saves what it's verified
+	SCRUB_PERIOD = "30d"                  // default ScrubPeriod
+	PARITY_PERCENT = 10                   // default ParityPercent
 	INDENT_F = " " // use with Println == 2 spaces
 	INDENT_I = "      -"
 	VERSION  = 0.1
@@ -90,6 +150,7 @@ const (
 
 var (
 	MAX_HANDLERS int
+	WORK_DIR     string // where veb was run from, before cd'ing to the repo root
 )
 
 // pretty print filesizes
@@ -174,7 +235,53 @@ func main() {
 		return // done
 	}
 
+	// serve doesn't need to be in a repository either
+	if flag.Args()[0] == SERVE {
+		flags := flag.NewFlagSet(SERVE, flag.ExitOnError)
+		listen := flags.String("listen", "localhost:"+veb.SERVE_PORT, "address to listen on (e.g. :"+veb.SERVE_PORT+" for every interface)")
+		cert := flags.String("cert", "", "TLS certificate file (default: a self-signed one)")
+		key := flags.String("key", "", "TLS certificate's private key file")
+		clients := flags.String("clients", "", "file of the fingerprints of the clients to let in (default: "+veb.SERVE_CLIENTS+" in veb's config folder)")
+		fingerprint := flags.Bool("fingerprint", false, "print this machine's certificate fingerprint, for adding to a server's clients, and exit")
+		stdio := flags.Bool("stdio", false, "serve one client on stdin & stdout (for ssh:// remotes)")
+		args := parseCmd(flags, flag.Args()[1:])
+		if *fingerprint {
+			cert, err := veb.LoadServeCert("", "")
+			if err != nil {
+				out.Fatal(err)
+			}
+			fmt.Println(veb.CertFingerprint(cert))
+			return // done
+		}
+		err := Serve(firstArg(args), *listen, *cert, *key, *clients, *stdio)
+		if err != nil {
+			out.Fatal(err)
+		}
+		return // done
+	}
+
+	// checking a bundle, or cloning a repository from one, doesn't either
+	if flag.Args()[0] == BUNDLE && len(flag.Args()) > 1 && flag.Args()[1] == BUNDLE_VERIFY {
+		err := BundleVerify(firstArg(flag.Args()[2:]))
+		if err != nil {
+			out.Fatal(err)
+		}
+		return // done
+	}
+	if flag.Args()[0] == CLONE {
+		flags := flag.NewFlagSet(CLONE, flag.ExitOnError)
+		bundle := flags.String("from-bundle", "", "bundle to restore the repository from")
+		restore := flags.Bool("restore", false, "keep the bundled repository's UUID, to replace it (default: the clone is a new repository)")
+		args := parseCmd(flags, flag.Args()[1:])
+		err := Clone(*bundle, firstArg(args), *restore)
+		if err != nil {
+			out.Fatal(err)
+		}
+		return // done
+	}
+
 	// find veb repo
+	WORK_DIR, _ = os.Getwd()
 	root, err := cdBaseDir()
 	if err != nil {
 		fmt.Println(err, "\n")
@@ -196,48 +303,215 @@ func main() {
 	// print intro
 	fmt.Println("veb repository at", root, "\n")
 
+	// long commands wind down on ctrl-c
+	ctx := interruptible()
+
 	// act on command
 	switch flag.Args()[0] {
 	case STATUS:
-		err = Status(index, log)
+		flags := flag.NewFlagSet(STATUS, flag.ExitOnError)
+		var remote optionalString
+		flags.Var(&remote, "remote",
+			"also compare the committed files with the named (or default) remote's\n"+
+				"(only a veb:// or ssh:// remote avoids loading its whole index to do it)")
+		parseCmd(flags, flag.Args()[1:])
+		err = Status(ctx, index, remote.set, remote.value, log)
 		if err != nil {
 			out.Fatal(err)
 		}
 
 	case VERIFY:
-		err = Verify(index, log)
+		flags := flag.NewFlagSet(VERIFY, flag.ExitOnError)
+		var remote optionalString
+		flags.Var(&remote, "remote",
+			"verify the named (or default) remote's copies instead, on the remote if it can")
+		bwLimit, ioLimit := limitFlags(flags)
+		resume := flags.Bool("resume", false,
+			"only check files the last verify didn't get to")
+		olderThan := flags.String("older-than", "",
+			"only check files not verified in this long, e.g. 30d")
+		parseCmd(flags, flag.Args()[1:])
+		age, err := veb.ParseAge(*olderThan)
 		if err != nil {
-			out.Fatal(err)
+			out.Fatal("veb verify --older-than: ", err)
+		}
+		if remote.set {
+			err = VerifyRemote(ctx, index, remote.value, *resume, age, *bwLimit, *ioLimit, log)
+		} else {
+			err = Verify(ctx, index, *ioLimit, *resume, age, log)
+		}
+		if err != nil {
+			fatal(out, err)
 		}
 
 	case COMMIT:
-		err = Commit(index, log)
+		err = Commit(ctx, index, log)
 		if err != nil {
 			out.Fatal(err)
 		}
 
 	case REMOTE:
-		if len(flag.Args()) < 2 {
-			out.Fatal(REMOTE, " needs a path to the backup repository",
-				"\n  e.g. 'veb remote ~/backups/music'")
+		flags := flag.NewFlagSet(REMOTE, flag.ExitOnError)
+		verbose := flags.Bool("v", false, "list remotes with their paths")
+		encrypt := flags.Bool("encrypt", false,
+			"encrypt everything veb stores on the new remote (it must be empty)")
+		encryptNames := flags.Bool("encrypt-names", false,
+			"encrypt file names on the new remote too (implies --encrypt)")
+		keyFile := flags.String("key-file", "",
+			"key file for an encrypted remote, instead of $VEB_PASSPHRASE")
+		objects := flags.Bool("objects", false,
+			"store the new remote's files by checksum, so identical files are stored once (it must be empty)")
+		args := parseCmd(flags, flag.Args()[1:])
+		if len(args) == 0 {
+			args = []string{REMOTE_LIST}
 		}
-		err = Remote(index, flag.Args()[1], log)
+		opts := remoteOptions{*encrypt || *encryptNames, *encryptNames, *keyFile, *objects}
+		err = Remote(index, args[0], args[1:], *verbose, opts, log)
 		if err != nil {
 			out.Fatal(err)
 		}
 
 	case PUSH:
-		err = Push(index, log)
+		flags := flag.NewFlagSet(PUSH, flag.ExitOnError)
+		trash := flags.Bool("trash", false,
+			"move remote files that are no longer in this repository into the remote's trash")
+		partial := flags.Bool("partial", false,
+			"if everything won't fit on the remote, send the smallest files that do")
+		bwLimit, ioLimit := limitFlags(flags)
+		args := parseCmd(flags, flag.Args()[1:])
+		err = Push(ctx, index, firstArg(args), *trash, *partial, *bwLimit, *ioLimit, log)
 		if err != nil {
 			out.Fatal(err)
 		}
 
-	case FIX:
-		// TODO: implement
-		out.Fatal("this command is not yet implemented")
 	case PULL:
-		// TODO: implement
-		out.Fatal("this command is not yet implemented")
+		flags := flag.NewFlagSet(PULL, flag.ExitOnError)
+		bwLimit, ioLimit := limitFlags(flags)
+		args := parseCmd(flags, flag.Args()[1:])
+		err = Pull(ctx, index, firstArg(args), *bwLimit, *ioLimit, log)
+		if err != nil {
+			out.Fatal(err)
+		}
+
+	case FIX:
+		flags := flag.NewFlagSet(FIX, flag.ExitOnError)
+		remote := flags.String("remote", "", "remote to get the good copies from")
+		args := parseCmd(flags, flag.Args()[1:])
+		if len(args) == 0 {
+			out.Fatal(FIX, " needs the files to fix",
+				"\n  e.g. 'veb fix pictures/cat.jpg'")
+		}
+		err = Fix(ctx, index, *remote, args, log)
+		if err != nil {
+			out.Fatal(err)
+		}
+
+	case TRASH:
+		flags := flag.NewFlagSet(TRASH, flag.ExitOnError)
+		remote := flags.String("remote", "", "remote whose trash to use")
+		args := parseCmd(flags, flag.Args()[1:])
+		if len(args) == 0 {
+			args = []string{TRASH_LIST}
+		}
+		err = Trash(index, *remote, args[0], args[1:], log)
+		if err != nil {
+			out.Fatal(err)
+		}
+
+	case VERSIONS:
+		flags := flag.NewFlagSet(VERSIONS, flag.ExitOnError)
+		remote := flags.String("remote", "", "remote whose versions to list")
+		args := parseCmd(flags, flag.Args()[1:])
+		if len(args) < 1 {
+			out.Fatal(VERSIONS, " needs a file to list the versions of",
+				"\n  e.g. 'veb versions pictures/cat.jpg'")
+		}
+		err = Versions(index, *remote, args[0], log)
+		if err != nil {
+			out.Fatal(err)
+		}
+
+	case RESTORE:
+		flags := flag.NewFlagSet(RESTORE, flag.ExitOnError)
+		version := flags.String("version", "", "checksum or date of the version to restore")
+		remote := flags.String("remote", "", "remote to restore from")
+		args := parseCmd(flags, flag.Args()[1:])
+		if len(args) < 1 || *version == "" {
+			out.Fatal(RESTORE, " needs a file and a version",
+				"\n  e.g. 'veb restore pictures/cat.jpg --version=2012-06-01'",
+				"\n  (use 'veb versions <file>' to see the versions)")
+		}
+		err = Restore(index, *remote, args[0], *version, log)
+		if err != nil {
+			out.Fatal(err)
+		}
+
+	case SCRUB:
+		flags := flag.NewFlagSet(SCRUB, flag.ExitOnError)
+		budget := flags.String("budget", "",
+			"stop starting on files after this long, e.g. 2h")
+		size := flags.String("bytes", "",
+			"stop after checking this much, e.g. 200GB")
+		var repair optionalString
+		flags.Var(&repair, "repair",
+			"check the named (or default) remote's copies too, and replace bad copies with good ones")
+		bwLimit, ioLimit := limitFlags(flags)
+		parseCmd(flags, flag.Args()[1:])
+		age, err := veb.ParseAge(*budget)
+		if err != nil {
+			out.Fatal("veb scrub --budget: ", err)
+		}
+		n, err := veb.ParseSize(*size)
+		if err != nil {
+			out.Fatal("veb scrub --bytes: ", err)
+		}
+		err = Scrub(ctx, index, age, n, repair.set, repair.value, *bwLimit, *ioLimit, log)
+		if err != nil {
+			fatal(out, err)
+		}
+
+	case PARITY:
+		flags := flag.NewFlagSet(PARITY, flag.ExitOnError)
+		percent := flags.Int("percent", 0,
+			"parity to make, as a percent of each file's size (default: ParityPercent in config, or 10)")
+		ioLimit := flags.String("io-limit", "",
+			"most bytes per second to read from disk, e.g. 20MB (default: IOLimit in config)")
+		args := parseCmd(flags, flag.Args()[1:])
+		if len(args) == 0 || args[0] != PARITY_CREATE {
+			out.Fatal("veb parity needs 'create [files or folders]'")
+		}
+		if *percent < 0 {
+			out.Fatal("veb parity --percent can't be negative")
+		}
+		err = ParityCreate(ctx, index, args[1:], *percent, *ioLimit, log)
+		if err != nil {
+			out.Fatal(err)
+		}
+
+	case REPAIR:
+		flags := flag.NewFlagSet(REPAIR, flag.ExitOnError)
+		ioLimit := flags.String("io-limit", "",
+			"most bytes per second to read from disk, e.g. 20MB (default: IOLimit in config)")
+		args := parseCmd(flags, flag.Args()[1:])
+		if len(args) == 0 {
+			out.Fatal(REPAIR, " needs the files (or folders) to repair",
+				"\n  e.g. 'veb repair pictures/cat.jpg'")
+		}
+		err = Repair(ctx, index, args, *ioLimit, log)
+		if err != nil {
+			out.Fatal(err)
+		}
+
+	case BUNDLE:
+		args := flag.Args()[1:]
+		if len(args) == 0 || args[0] != BUNDLE_CREATE {
+			out.Fatal("veb bundle needs 'create <file>' or 'verify <file>'")
+		}
+		err = BundleCreate(index, firstArg(args[1:]), log)
+		if err != nil {
+			out.Fatal(err)
+		}
+
 	case SYNC:
 		// TODO: implement
 		out.Fatal("this command is not yet implemented")
@@ -252,7 +526,7 @@ func main() {
 }
 
 // creates veb's META_FOLDER in current directory and empty veb metadata 
-// files inside META_FOLDER.
+// files inside META_FOLDER, plus a config file with the default settings.
 // Does not create LOG_FILE.
 func Init() error {
 	// create veb dir
@@ -261,6 +535,16 @@ func Init() error {
 		return fmt.Errorf("veb could not create metadata directory: %v", err)
 	}
 
+	// make the logger
+	logf, err := os.OpenFile(path.Join(veb.META_FOLDER, veb.LOG_FILE),
+		os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer logf.Close()
+	log := veb.NewLog(log.New(logf, "", log.LstdFlags|log.Lshortfile))
+	defer log.Un(log.Trace(INIT))
+
 	// create index file
 	indexf, err := os.Create(path.Join(veb.META_FOLDER, veb.INDEX_FILE))
 	if err != nil {
@@ -276,26 +560,37 @@ func Init() error {
 	xsums.Close()
 
 	// create & save empty index
-	index := veb.New(crypto.SHA1, ".")
+	index, err := veb.New(crypto.SHA1, ".")
+	if err != nil {
+		return fmt.Errorf("veb could not create index: %v", err)
+	}
 	err = index.Save()
 	if err != nil {
 		return err
 	}
 
+	// create default config
+	err = veb.NewConfig(".", log).Save()
+	if err != nil {
+		return fmt.Errorf("veb could not create metadata config file: %v", err)
+	}
+
 	return nil
 }
 
 // Check for updated/new files in repo, then nicely print out results.
 // Doesn't check file content (that's saved for verify). This is just 
 // to /quickly/ find new or modified files via file.Lstat().
-func Status(index *veb.Index, log *veb.Log) error {
+// Prints the root hash of the committed files (see veb.Tree), and with
+// compare, where they differ from the named (or default) remote's.
+func Status(ctx context.Context, index *veb.Index, compare bool, name string, log *veb.Log) error {
 	defer log.Un(log.Trace(STATUS))
 	var timer veb.Timer
 	timer.Start()
 
 	// check for changes
 	files := make(chan veb.IndexEntry, CHAN_SIZE)
-	go index.Check(files)
+	go index.Check(ctx, files)
 
 	// parse into new vs changed
 	newFiles := make([]string, 0)
@@ -311,6 +606,10 @@ func Status(index *veb.Index, log *veb.Log) error {
 			changedFiles = append(changedFiles, f.Path)
 		}
 	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("veb status interrupted")
+	}
+	deletedFiles := index.Deleted()
 
 	// print new files
 	if len(newFiles) > 0 {
@@ -397,20 +696,130 @@ func Status(index *veb.Index, log *veb.Log) error {
 		fmt.Printf("\n")
 	}
 
+	// print deleted files
+	if len(deletedFiles) > 0 {
+		fmt.Println("--------------")
+		fmt.Println("Deleted files:")
+		fmt.Println("--------------")
+		for _, f := range deletedFiles {
+			fmt.Println(INDENT_F, f.Path)
+			fmt.Printf("%s %s, last committed as modified on (%v)\n",
+				INDENT_I, ByteSize(f.Size), f.ModTime)
+			fmt.Printf("\n")
+		}
+		fmt.Printf("\n")
+	}
+
 	// print outro
-	if len(changedFiles) == 0 && len(newFiles) == 0 {
+	if len(changedFiles) == 0 && len(newFiles) == 0 && len(deletedFiles) == 0 {
 		fmt.Println("No changes or new files.")
 	} else {
 		fmt.Println("MAKE SURE CHANGED FILES ARE THINGS YOU'VE ACTUALLY CHANGED")
 		fmt.Println("  (use 'veb fix <file>' if a file has been corrupted in this repository)")
 		fmt.Println("  (use 'veb push', 'veb pull', or 'veb sync' to commit changed/new files)")
 	}
+	tree := veb.NewTree(index.Files)
+	fmt.Printf("\nroot hash of the committed files: %x\n", tree.Root())
+	timer.Stop()
+	fmt.Printf("\nsummary: %d new, %d changed, %d deleted (%v)\n", 
+		len(newFiles), len(changedFiles), len(deletedFiles), timer.Duration())
+
+	log.Info().Printf("%s (%d new, %d changed, %d deleted) took %v\n",
+		STATUS, len(newFiles), len(changedFiles), len(deletedFiles), timer.Duration())
+
+	if compare {
+		return statusRemote(index, tree, name, log)
+	}
+	return nil
+}
+
+// Finds where index's committed files (whose tree is tree) and the named
+// remote's differ, by comparing their trees a level at a time from the root.
+// Remotes that can hash their own tree (veb serve) only send the hashes of
+// folders that differ; the rest are hashed here, from their index.
+func statusRemote(index *veb.Index, tree *veb.Tree, name string, log *veb.Log) error {
+	defer log.Un(log.Trace(STATUS + " --remote"))
+	var timer veb.Timer
+	timer.Start()
+
+	r, err := index.GetRemote(name)
+	if err != nil {
+		return err
+	}
+	config, err := veb.LoadConfig(index.Root, log)
+	if err != nil {
+		return err
+	}
+
+	// their tree
+	var theirs veb.SubtreeFunc
+	tr, th, err := index.OpenTreeHasher(r, config.Remote(r.Name), log)
+	if err != nil {
+		return err
+	}
+	if th != nil {
+		theirs = func(dirs []string) ([]veb.Subtree, error) {
+			_, subtrees, err := th.Subtrees(dirs)
+			return subtrees, err
+		}
+	} else {
+		var remote *veb.Index
+		r, tr, remote, err = openRemote(index, name, log)
+		if err != nil {
+			return err
+		}
+		remoteTree := veb.NewTree(remote.Files)
+		theirs = func(dirs []string) ([]veb.Subtree, error) {
+			return remoteTree.Subtrees(dirs), nil
+		}
+	}
+	defer tr.Close()
+
+	// compare
+	levels := 0
+	ours := func(dirs []string) ([]veb.Subtree, error) {
+		levels++
+		return tree.Subtrees(dirs), nil
+	}
+	diffs, err := veb.CompareTrees(ours, theirs)
+	if err != nil {
+		return fmt.Errorf("veb could not compare with %s: %v", r.Name, err)
+	}
+
+	// print where they differ
+	// e.g.
+	//   photos/2019/
+	//       - only here
+	title := fmt.Sprintf("Committed differently here and on %s:", r.Name)
+	line := strings.Repeat("-", len(title))
+	fmt.Printf("\n%s\n%s\n%s\n", line, title, line)
+	if len(diffs) == 0 {
+		fmt.Println(INDENT_F, "nothing; the root hashes match")
+	}
+	kinds := map[int]string{
+		veb.TREE_DIFFERENT: "different",
+		veb.TREE_ONLY_A:    "only here",
+		veb.TREE_ONLY_B:    "only on " + r.Name,
+	}
+	for _, d := range diffs {
+		p := d.Path
+		if d.Dir {
+			p += "/"
+		}
+		fmt.Println(INDENT_F, p)
+		fmt.Println(INDENT_I, kinds[d.Kind])
+	}
+	if len(diffs) > 0 {
+		fmt.Println("\n  (use 'veb push', 'veb pull', or 'veb sync' to bring them together)")
+	}
+
+	// print outro
 	timer.Stop()
-	fmt.Printf("\nsummary: %d new, %d changed (%v)\n", 
-		len(newFiles), len(changedFiles), timer.Duration())
+	fmt.Printf("\nsummary: %d differences from %s, %d levels of the tree compared (%v)\n",
+		len(diffs), r.Name, levels, timer.Duration())
 
-	log.Info().Printf("%s (%d new, %d changed) took %v\n",
-		STATUS, len(newFiles), len(changedFiles), timer.Duration())
+	log.Info().Printf("%s --remote=%s (%d differences, %d levels) took %v\n",
+		STATUS, r.Name, len(diffs), levels, timer.Duration())
 	return nil
 }
 
@@ -419,23 +828,32 @@ func Status(index *veb.Index, log *veb.Log) error {
 // Does not verify new files.
 // Could take a while. It chews through files in parallel, but it'll still take
 // time to go through gigs of data.
-// Allows early quitting by listening for QUIT_RUNE on stdin.
-func Verify(index *veb.Index, log *veb.Log) error {
+// Stops early when ctx is cancelled (ctrl-c), counting the files it didn't get
+// to as not checked.
+// Files that match get their LastVerified set, and the index is saved every
+// VERIFY_SAVE and at the end, so a long verify that gets stopped can be picked
+// up with resume: that skips files verified since the last verify without
+// resume started. olderThan (if not 0) skips files verified more recently
+// than that. Files verified longest ago go first.
+// ioLimit (or IOLimit in the config) throttles reading the files.
+func Verify(ctx context.Context, index *veb.Index, ioLimit string, resume bool, olderThan time.Duration,
+	log *veb.Log) error {
 	defer log.Un(log.Trace(VERIFY))
 	var timer veb.Timer
 	timer.Start()
 
-	// start listener for user's quit signal
-	quit := make(chan int)
-	go func() {
-		for {
-			var input string
-			fmt.Scan(&input)
-			if input[0] == QUIT_RUNE {
-				quit <- 1
-			}
-		}
-	}()
+	config, err := veb.LoadConfig(index.Root, log)
+	if err != nil {
+		return err
+	}
+	disk, err := parseLimit(ioLimit, config.IOLimit, "io-limit")
+	if err != nil {
+		return err
+	}
+	blockSize, err := parseBlockSize(config)
+	if err != nil {
+		return err
+	}
 
 	// print intro
 	fmt.Println("Verifying file checksums against those stored in veb index...")
@@ -447,173 +865,612 @@ func Verify(index *veb.Index, log *veb.Log) error {
 		return nil
 	}
 
-	// toss everything in index into input channel
-	files := make(chan veb.IndexEntry, CHAN_SIZE)
-	go func() {
-		for _, f := range index.Files {
-			files <- f
-		}
-		close(files)
-	}()
-
-	// start handler pool working on checking files
-	changed := make(chan veb.IndexEntry, CHAN_SIZE)
-	done := make(chan int, MAX_HANDLERS)
-	for i := 0; i < MAX_HANDLERS; i++ {
-		go verifyHandler(index.Root, files, changed, done, log)
+	// check them
+	queue, numSkipped := pickFiles(index, resume, olderThan)
+	totalFiles := queue.Len()
+	result := checkFiles(ctx, index, index.Save, queue, verifyBudget{}, localChecker(index.Root, blockSize, disk, log))
+	notChecked := totalFiles - result.checked
+	okFiles := result.checked - result.changed
+	
+	// print outro
+	timer.Stop()
+	fmt.Println("\n\nMAKE SURE CHANGED FILES ARE THINGS YOU'VE ACTUALLY CHANGED")
+	fmt.Println("  (use 'veb fix <file>' if a file has been corrupted in this repository)")
+	fmt.Println("  (use 'veb repair <file>' instead if it has parity; see 'veb parity create')")
+	fmt.Println("  (use 'veb push', 'veb pull', or 'veb sync' to commit changed/new files)")
+	fmt.Printf("\nsummary: %d ok, %d changed, %d not checked, %d skipped in %v\n",
+		okFiles, result.changed, notChecked, numSkipped, timer.Duration())
+	
+	// info log
+	log.Info().Printf("%s (%d ok, %d changed, %d not checked, %d skipped) took %v\n",
+		VERIFY, okFiles, result.changed, notChecked, numSkipped, timer.Duration())
+	var stopped error
+	if ctx.Err() != nil {
+		stopped = fmt.Errorf("veb verify interrupted; %d files not checked (use 'veb verify --resume' to go on)",
+			notChecked)
 	}
+	return result.err(VERIFY, stopped)
+}
 
-	// done listener signals quit when all handlers are done
-	go func() {
-		for i := 0; i < MAX_HANDLERS; i++ {
-			<-done
-		}
-		quit <- 1
-	}()
-
-	// receive & print info
-	first := true
-	totalFiles := len(index.Files)
-	changedFiles := 0
-	scannedFiles := 0
-verify_receive_loop:
-	for {
-		// TODO: Rework to not need select. Race condition between quit signal and printing all changes.
-		select {
-		case <-quit:
-			// We're done! Either by finishing or user interrupt.
-			break verify_receive_loop
-
-		case f := <-changed:
-			// clear status line w/ carriage return & 80 spaces
-			fmt.Println("\r                                                                                \r")
-
-			// print header once first file is encountered
-			if first {
-				fmt.Println("----------------------")
-				fmt.Println("Files with new hashes:")
-				fmt.Println("----------------------")
-				first = false
-			}
+// Verifies the named (or default) remote's copies of its files against the
+// remote's checksums: on the remote if it's served by 'veb serve', or by
+// reading them here otherwise (and always for encrypted or compressed
+// remotes). For each bad copy, says whether this repository's copy is good.
+// Also lists files committed differently here and there.
+// resume & olderThan work like Verify's, with the remote's record of when its
+// files were verified. bwLimit (or the remote's BwLimit) throttles reading
+// them, and ioLimit (or IOLimit) re-checking this repository's copies.
+func VerifyRemote(ctx context.Context, local *veb.Index, name string, resume bool, olderThan time.Duration,
+	bwLimit, ioLimit string, log *veb.Log) error {
+	defer log.Un(log.Trace(VERIFY))
+	var timer veb.Timer
+	timer.Start()
 
-			// TODO
-			//  - move all this to a 'print changed' function?
-			//    - has some in common with Status's printing
+	config, err := veb.LoadConfig(local.Root, log)
+	if err != nil {
+		return err
+	}
+	disk, err := parseLimit(ioLimit, config.IOLimit, "io-limit")
+	if err != nil {
+		return err
+	}
 
-			// print file name
-			fmt.Println(INDENT_F, f.Path)
+	// open remote's index
+	dest, tr, remote, err := openRemote(local, name, log)
+	if err != nil {
+		return err
+	}
+	defer tr.Close()
+	bw, err := parseLimit(bwLimit, config.Remote(dest.Name).BwLimit, "bwlimit")
+	if err != nil {
+		return err
+	}
+	tr = veb.WrapLimit(tr, bw)
 
-			// figure out filesize
-			curSize := ByteSize(f.Size)
-			prevSize := ByteSize(index.Files[f.Path].Size)
-			sizeChange := curSize - prevSize
-			direction := "increased"
-			if sizeChange < 0 {
-				direction = "decreased"
-				sizeChange = -sizeChange // absolute value
-			}
-			
-			sanity := false
-			
-			// print size change
-			// e.g.
-			//     - filesize decreased 4.00MB (6.02GB -> 6.01GB)
-			if sizeChange != 0 {
-				fmt.Printf("%s filesize %s %s (%s -> %s)\n",
-					INDENT_I, direction, sizeChange, prevSize, curSize)
-				sanity = true
-			}
-			
-			// print mtime
-			if index.Files[f.Path].ModTime != f.ModTime {
-				fmt.Printf("%s modified on (%v)\n", INDENT_I, f.ModTime)
-				sanity = true
-			}
-			
-			// print mode
-			if index.Files[f.Path].Mode != f.Mode {
-				fmt.Printf("%s file mode changed (%v -> %v)\n",
-					INDENT_I, index.Files[f.Path].Mode, f.Mode)
-				sanity = true
-			}
-			
-			// sanity check & snark
-			if !sanity {
-				fmt.Printf("%s ...well /something/ changed. Dunno what. *shrugs*\n", INDENT_I)
-			}
-			
-			// print xsums
-			// TODO: dynamic hash name instead of hard 'SHA1'
-			fmt.Printf("%s previous SHA1: %x\n", INDENT_I, index.Files[f.Path].Xsum)
-			fmt.Printf("%s current  SHA1: %x\n", INDENT_I, f.Xsum)
+	// print intro
+	fmt.Println("Verifying", dest.Name, "at", dest.URL, "against the checksums stored in its index...\n")
 
-			fmt.Printf("\n")
+	// bail early for empty index
+	if len(remote.Files) == 0 {
+		fmt.Println("No files in", dest.Name, "index. Nothing to verify.")
+		return nil
+	}
 
-			// status line
-			changedFiles++
-			scannedFiles = totalFiles - len(files)
-			fmt.Printf("\rscanned: %6d of %6d files (%d changed) (type 'q' to quit): ",
-				scannedFiles, totalFiles, changedFiles)
+	// check them
+	generation := remote.Generation
+	save := func() error {
+		err := tr.SaveIndex(remote)
+		if err != nil {
+			log.Err().Println("could not save remote index:", err)
+		}
+		return err
+	}
+	var streamed int64
+	queue, numSkipped := pickFiles(remote, resume, olderThan)
+	totalFiles := queue.Len()
+	result := checkFiles(ctx, remote, save, queue, verifyBudget{},
+		remoteChecker(tr, local, disk, &streamed, log))
+	notChecked := totalFiles - result.checked
+	okFiles := result.checked - result.changed
+
+	// the remote index was only saved to record what was verified; don't let
+	// push take that for someone else changing the remote
+	if dest.LastGeneration == generation {
+		dest.LastGeneration = remote.Generation
+		local.Save()
+	}
 
-		default:
-			// status line
-			scannedFiles = totalFiles - len(files)
-			fmt.Printf("\rscanned: %6d of %6d files (%d changed) (type 'q' to quit): ",
-				scannedFiles, totalFiles, changedFiles)
+	// print files that were committed differently here & there
+	differ := make([]string, 0)
+	for _, f := range sortedEntries(remote.Files) {
+		have, ok := local.Files[f.Path]
+		if ok && !bytes.Equal(have.Xsum, f.Xsum) {
+			differ = append(differ, f.Path)
+		}
+	}
+	if len(differ) > 0 {
+		fmt.Println("-------------------------------------------------------")
+		fmt.Println("Committed differently here and on the remote (not bad):")
+		fmt.Println("-------------------------------------------------------")
+		for _, p := range differ {
+			fmt.Println(INDENT_F, p)
 		}
+		fmt.Println("\n  (use 'veb push' or 'veb fix <file>' to settle which copy wins)")
 	}
 
-	notChecked := totalFiles - scannedFiles
-	okFiles := totalFiles - changedFiles - notChecked
-	
 	// print outro
 	timer.Stop()
-	fmt.Println("\n\nMAKE SURE CHANGED FILES ARE THINGS YOU'VE ACTUALLY CHANGED")
-	fmt.Println("  (use 'veb fix <file>' if a file has been corrupted in this repository)")
-	fmt.Println("  (use 'veb push', 'veb pull', or 'veb sync' to commit changed/new files)")
-	fmt.Printf("\nsummary: %d ok, %d changed, %d not checked in %v\n",
-		okFiles, changedFiles, notChecked, timer.Duration())
-	
+	if result.changed > 0 {
+		fmt.Println("\n  (use 'veb fix <file>' where only the remote's copy is good)")
+	}
+	numStreamed := int(atomic.LoadInt64(&streamed))
+	fmt.Printf("\nsummary: %d ok, %d bad, %d not checked, %d skipped (%d checked on %s, %d read here) in %v\n",
+		okFiles, result.changed, notChecked, numSkipped,
+		result.checked-numStreamed, dest.Name, numStreamed, timer.Duration())
+
 	// info log
-	log.Info().Printf("%s (%d ok, %d changed, %d not checked) took %v\n",
-		VERIFY, okFiles, changedFiles, notChecked, timer.Duration())
-	return nil
+	log.Info().Printf("%s --remote=%s (%d ok, %d bad, %d not checked, %d skipped, %d streamed) took %v\n",
+		VERIFY, dest.Name, okFiles, result.changed, notChecked, numSkipped, numStreamed, timer.Duration())
+	var stopped error
+	if ctx.Err() != nil {
+		stopped = fmt.Errorf("veb verify interrupted; %d files not checked (use 'veb verify --remote --resume' to go on)",
+			notChecked)
+	}
+	return result.err(VERIFY, stopped)
 }
 
-// Saves all updated/new files to index, so they are available for push/pull.
-// Saves new file stats & current checksum of the file shown as new/changed.
-func Commit(index *veb.Index, log *veb.Log) error {
-	defer log.Un(log.Trace(COMMIT))
+// Verifies the files that have gone longest without being verified, until
+// budget runs out or bytes worth of files have been checked. With neither,
+// it checks a day's share of the repository: enough that running it nightly
+// gets through everything once every ScrubPeriod (see the config).
+// ioLimit (or IOLimit in the config) throttles reading the files.
+// With repair, each file's copy on the named (or default) remote is checked
+// too, and where only one copy is good, the other is replaced with it; the bad
+// one is kept in quarantine (see veb.Repair). bwLimit (or the remote's
+// BwLimit) throttles reading & writing the remote's copies.
+func Scrub(ctx context.Context, index *veb.Index, budget time.Duration, bytes int64, repair bool, name string,
+	bwLimit, ioLimit string, log *veb.Log) error {
+	defer log.Un(log.Trace(SCRUB))
 	var timer veb.Timer
 	timer.Start()
 
-	// check for changes
-	files := make(chan veb.IndexEntry, CHAN_SIZE)
-	go index.Check(files)
-	
-	// start handler pool working on files
-	updates := make(chan veb.IndexEntry, CHAN_SIZE)
-	done := make(chan int, MAX_HANDLERS)
-	for i := 0; i < MAX_HANDLERS; i++ {
-		go func() {
-			for f := range files {
-				// calculate checksum hash
-				err := veb.Xsum(&f, log)
-				if err != nil {
-					log.Err().Println("checksum for verify failed:", err)
-				}
-				
-				updates <- f
-			}
-			done <- 1
-		}()
+	config, err := veb.LoadConfig(index.Root, log)
+	if err != nil {
+		return err
 	}
-
-	// done listener
-	go func() {
-		for i := 0; i < MAX_HANDLERS; i++ {
-			<-done
-		}
+	disk, err := parseLimit(ioLimit, config.IOLimit, "io-limit")
+	if err != nil {
+		return err
+	}
+	if budget == 0 && bytes == 0 {
+		period, err := veb.ParseAge(config.ScrubPeriod)
+		if err != nil {
+			return fmt.Errorf("veb could not read ScrubPeriod: %v", err)
+		}
+		if period == 0 {
+			period, _ = veb.ParseAge(SCRUB_PERIOD)
+		}
+		days := math.Max(period.Hours()/24, 1)
+		bytes = int64(math.Ceil(float64(index.Size()) / days))
+	}
+
+	// print intro
+	limit := verifyBudget{bytes: bytes}
+	limits := make([]string, 0, 2)
+	if budget > 0 {
+		limit.until = time.Now().Add(budget)
+		limits = append(limits, budget.String())
+	}
+	if bytes > 0 {
+		limits = append(limits, ByteSize(bytes).String())
+	}
+	fmt.Printf("Scrubbing: verifying the files verified longest ago, for up to %s...\n",
+		strings.Join(limits, " or "))
+
+	// bail early for empty index
+	if len(index.Files) == 0 {
+		fmt.Println("\nNo files in veb index. Nothing to verify.")
+		return nil
+	}
+
+	// check the remote's copies too?
+	blockSize, err := parseBlockSize(config)
+	if err != nil {
+		return err
+	}
+	check := localChecker(index.Root, blockSize, disk, log)
+	save := index.Save
+	var fixer *scrubRepair
+	if repair {
+		dest, tr, remote, err := openRemote(index, name, log)
+		if err != nil {
+			return err
+		}
+		defer tr.Close()
+		bw, err := parseLimit(bwLimit, config.Remote(dest.Name).BwLimit, "bwlimit")
+		if err != nil {
+			return err
+		}
+		fmt.Println("...and their copies on", dest.Name, "at", dest.URL+", repairing either from the other.")
+
+		// leave alone what's been changed on the remote without being committed
+		edited := make(map[string]bool)
+		changed := make(chan veb.IndexEntry, CHAN_SIZE)
+		go tr.Check(remote, changed)
+		for f := range changed {
+			edited[f.Path] = true
+		}
+
+		fixer = &scrubRepair{
+			local:    index,
+			repo:     veb.NewLocalTransport(index.Root, log),
+			tr:       veb.WrapLimit(tr, bw),
+			remote:   remote,
+			name:     dest.Name,
+			bin:      veb.QuarantineBin(time.Now()),
+			edited:   edited,
+			disk:     disk,
+			progress: &verifyProgress{good: make(map[string]verifiedFile)},
+			log:      log,
+		}
+		check = fixer.checker(check)
+		generation := remote.Generation
+		save = func() error {
+			fixer.save()
+			if dest.LastGeneration == generation {
+				// not someone else changing the remote; see Push
+				dest.LastGeneration = remote.Generation
+				generation = remote.Generation
+			}
+			return index.Save()
+		}
+	}
+	fmt.Println()
+
+	// check the oldest
+	queue := make(verifyQueue, 0, len(index.Files))
+	for _, f := range index.Files {
+		queue = append(queue, f)
+	}
+	heap.Init(&queue)
+	result := checkFiles(ctx, index, save, &queue, limit, check)
+	okFiles := result.checked - result.changed - result.repaired
+
+	// how far behind is it?
+	oldest := "never verified"
+	if queue.Len() > 0 && !queue[0].LastVerified.IsZero() {
+		oldest = "verified " + queue[0].LastVerified.Format(time.RFC1123)
+	}
+
+	// print outro
+	timer.Stop()
+	if result.changed > 0 {
+		fmt.Println("\n\nMAKE SURE CHANGED FILES ARE THINGS YOU'VE ACTUALLY CHANGED")
+		fmt.Println("  (use 'veb fix <file>' if a file has been corrupted in this repository)")
+		fmt.Println("  (use 'veb repair <file>' instead if it has parity; see 'veb parity create')")
+		fmt.Println("  (use 'veb push', 'veb pull', or 'veb sync' to commit changed/new files)")
+	}
+	if result.repaired > 0 {
+		fmt.Printf("\n  (the bad copies are in %s, here or on %s; look them over, then delete them)\n",
+			veb.QuarantinePath(fixer.bin, ""), fixer.name)
+	}
+	repaired := ""
+	if repair {
+		repaired = fmt.Sprintf(", %d repaired", result.repaired)
+	}
+	fmt.Printf("\nsummary: %d ok%s, %d changed (%s) in %v\n",
+		okFiles, repaired, result.changed, ByteSize(result.bytes), timer.Duration())
+	if queue.Len() > 0 {
+		fmt.Printf("%d files left for next time (the least recently verified: %s)\n",
+			queue.Len(), oldest)
+	}
+
+	// info log
+	log.Info().Printf("%s (%d ok, %d repaired, %d changed, %d bytes, %d left) took %v\n",
+		SCRUB, okFiles, result.repaired, result.changed, result.bytes, queue.Len(), timer.Duration())
+	var stopped error
+	if ctx.Err() != nil {
+		stopped = fmt.Errorf("veb scrub interrupted")
+	}
+	return result.err(SCRUB, stopped)
+}
+
+// Most a verify may do. Zero values mean no limit.
+type verifyBudget struct {
+	bytes int64     // total size of the files to start on
+	until time.Time // when to stop starting on files
+}
+
+// What checkFiles got through
+type verifyResult struct {
+	checked  int   // files checked
+	changed  int   // ...that didn't match their checksums
+	repaired int   // ...and that had bad copies, now replaced
+	bytes    int64 // total size of the files checked
+	classes  int   // MISMATCH_* bits of the kinds of changes found
+}
+
+// The error for a verify (cmd) that found files that didn't match, and/or was
+// stopped early (stopped isn't nil); nil if neither.
+func (r verifyResult) err(cmd string, stopped error) error {
+	if r.classes == 0 {
+		return stopped
+	}
+	found := fmt.Sprintf("%d files don't match their checksums", r.changed)
+	if r.changed == 0 {
+		found = fmt.Sprintf("repaired %d files", r.repaired)
+	}
+	e := &mismatchError{r.classes, fmt.Sprintf("veb %s: %s", cmd, found)}
+	if stopped != nil {
+		e.classes |= 1
+		e.msg = fmt.Sprintf("%v; %s", stopped, found)
+	}
+	return e
+}
+
+// Picks the files in index x to verify, verified longest ago first: all of
+// them, or (with resume) those the last verify without resume didn't get to,
+// and/or (with olderThan) those not verified in that long. Also returns how
+// many files were skipped.
+func pickFiles(x *veb.Index, resume bool, olderThan time.Duration) (*verifyQueue, int) {
+	now := time.Now()
+	var since time.Time // skip files verified after this
+	if resume && !x.VerifyRun.IsZero() {
+		since = x.VerifyRun
+	} else if !resume {
+		x.VerifyRun = now
+	}
+	if olderThan > 0 {
+		cutoff := now.Add(-olderThan)
+		if since.IsZero() || cutoff.Before(since) {
+			since = cutoff
+		}
+	}
+
+	queue := &verifyQueue{}
+	for _, f := range x.Files {
+		if since.IsZero() || !f.LastVerified.After(since) {
+			*queue = append(*queue, f)
+		}
+	}
+	heap.Init(queue)
+	numSkipped := len(x.Files) - queue.Len()
+	if numSkipped > 0 {
+		fmt.Printf("Skipping %d files verified since %v.\n\n", numSkipped, since.Format(time.RFC1123))
+	}
+	return queue, numSkipped
+}
+
+// Checks the files in queue (from index x) in parallel with check, printing
+// the ones that changed, until queue is empty, budget runs out (files already
+// started still get finished) or ctx is cancelled. What's left is left in
+// queue. Files that were good are recorded as verified in x, which is saved
+// with save every VERIFY_SAVE and at the end.
+func checkFiles(ctx context.Context, x *veb.Index, save func() error, queue *verifyQueue, budget verifyBudget,
+	check fileChecker) verifyResult {
+	// hand out files, oldest first, as the handlers are ready for them, so the
+	// budget is checked just before each one is started
+	totalFiles := queue.Len()
+	files := make(chan veb.IndexEntry)
+	fed := make(chan int)
+	go func() {
+		defer close(fed)
+		defer close(files)
+		var deadline <-chan time.Time
+		if !budget.until.IsZero() {
+			deadline = time.After(time.Until(budget.until))
+		}
+		var sent int64
+		for queue.Len() > 0 {
+			f := (*queue)[0]
+			if budget.bytes > 0 && sent > 0 && sent+f.Size > budget.bytes {
+				return // wouldn't fit
+			}
+			select {
+			case files <- f:
+				heap.Pop(queue)
+				sent += f.Size
+			case <-deadline:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// start handler pool working on checking files
+	changed := make(chan verifyMismatch, CHAN_SIZE)
+	done := make(chan int, MAX_HANDLERS)
+	progress := &verifyProgress{good: make(map[string]verifiedFile)}
+	for i := 0; i < MAX_HANDLERS; i++ {
+		go verifyHandler(ctx, files, changed, done, progress, check)
+	}
+
+	// done listener closes changed when all handlers are done
+	go func() {
+		for i := 0; i < MAX_HANDLERS; i++ {
+			<-done
+		}
+		close(changed)
+	}()
+
+	// status line; budgeted checks don't know how many files they'll get to
+	changedFiles, repairedFiles := 0, 0
+	status := func() {
+		n, size := progress.checked()
+		if budget == (verifyBudget{}) {
+			fmt.Printf("\rscanned: %6d of %6d files (%d changed) (ctrl-c to stop): ",
+				n, totalFiles, changedFiles)
+		} else {
+			fmt.Printf("\rscanned: %6d files, %s (%d changed) (ctrl-c to stop): ",
+				n, ByteSize(size), changedFiles)
+		}
+	}
+
+	// receive & count what didn't match; they're printed by severity at the end
+	mismatches := make([]verifyMismatch, 0)
+	tick := time.NewTicker(STATUS_TICK)
+	defer tick.Stop()
+	lastSave := time.Now()
+verify_receive_loop:
+	for {
+		select {
+		case m, ok := <-changed:
+			if !ok {
+				// We're done! Either by finishing or user interrupt.
+				break verify_receive_loop
+			}
+			mismatches = append(mismatches, m)
+			if m.class == MISMATCH_REPAIRED {
+				repairedFiles++
+			}
+
+			// status line
+			changedFiles++
+			status()
+
+		case <-tick.C:
+			// save what's been verified now & then, in case of a crash
+			if time.Since(lastSave) > VERIFY_SAVE {
+				progress.record(x)
+				save()
+				lastSave = time.Now()
+			}
+
+			// status line
+			status()
+		}
+	}
+	<-fed
+
+	// save what's been verified
+	progress.record(x)
+	save()
+
+	// clear status line w/ carriage return & 80 spaces
+	fmt.Print("\r                                                                                \r")
+	classes := printMismatches(mismatches)
+
+	n, size := progress.checked()
+	return verifyResult{n, changedFiles - repairedFiles, repairedFiles, size, classes}
+}
+
+// Prints files that didn't match their checksums, most worrying first.
+// Returns the MISMATCH_* bits of the kinds there were.
+func printMismatches(mismatches []verifyMismatch) int {
+	sort.Sort(mismatchesBySeverity(mismatches))
+	classes := 0
+	for i, m := range mismatches {
+		// print header for each kind
+		if i == 0 || m.class != mismatches[i-1].class {
+			title := mismatchTitles[m.class]
+			line := strings.Repeat("-", len(title))
+			fmt.Printf("%s\n%s\n%s\n", line, title, line)
+			classes |= m.class
+		}
+
+		// print file name
+		fmt.Println(INDENT_F, m.now.Path)
+		if m.err != nil {
+			fmt.Println(INDENT_I, m.err)
+		}
+
+		// and which parts of it, if block checksums say
+		// e.g.
+		//     - damaged bytes (4.00MB): 8388608-12582911
+		if len(m.damaged) > 0 {
+			what := "damaged"
+			if m.class == MISMATCH_MODIFIED {
+				what = "changed"
+			}
+			ranges, size := rangeList(m.damaged)
+			fmt.Printf("%s %s bytes (%s): %s\n", INDENT_I, what, size, ranges)
+		}
+		if m.note != "" {
+			fmt.Printf("%s %s\n\n", INDENT_I, m.note)
+			continue
+		}
+		if m.err != nil {
+			fmt.Printf("\n")
+			continue
+		}
+
+		// figure out filesize
+		curSize := ByteSize(m.now.Size)
+		prevSize := ByteSize(m.was.Size)
+		sizeChange := curSize - prevSize
+		direction := "increased"
+		if sizeChange < 0 {
+			direction = "decreased"
+			sizeChange = -sizeChange // absolute value
+		}
+
+		// print size change
+		// e.g.
+		//     - filesize decreased 4.00MB (6.02GB -> 6.01GB)
+		if sizeChange != 0 {
+			fmt.Printf("%s filesize %s %s (%s -> %s)\n",
+				INDENT_I, direction, sizeChange, prevSize, curSize)
+		}
+
+		// print mtime
+		if !m.was.ModTime.Equal(m.now.ModTime) {
+			fmt.Printf("%s modified on (%v)\n", INDENT_I, m.now.ModTime)
+		} else {
+			fmt.Printf("%s not modified since (%v)\n", INDENT_I, m.now.ModTime)
+		}
+
+		// print mode
+		if m.was.Mode != m.now.Mode {
+			fmt.Printf("%s file mode changed (%v -> %v)\n",
+				INDENT_I, m.was.Mode, m.now.Mode)
+		}
+
+		// print xsums
+		// TODO: dynamic hash name instead of hard 'SHA1'
+		fmt.Printf("%s previous SHA1: %x\n", INDENT_I, m.was.Xsum)
+		fmt.Printf("%s current  SHA1: %x\n", INDENT_I, m.now.Xsum)
+
+		fmt.Printf("\n")
+	}
+	return classes
+}
+
+// Saves all updated/new files to index, so they are available for push/pull.
+// Saves new file stats & current checksum of the file shown as new/changed.
+// Removes deleted files from the index.
+// If ctx is cancelled (ctrl-c), the files checksummed by then are still
+// committed; 'veb commit' again picks up the rest.
+func Commit(ctx context.Context, index *veb.Index, log *veb.Log) error {
+	defer log.Un(log.Trace(COMMIT))
+	var timer veb.Timer
+	timer.Start()
+
+	config, err := veb.LoadConfig(index.Root, log)
+	if err != nil {
+		return err
+	}
+	blockSize, err := parseBlockSize(config)
+	if err != nil {
+		return err
+	}
+
+	// check for changes
+	files := make(chan veb.IndexEntry, CHAN_SIZE)
+	go index.Check(ctx, files)
+	
+	// start handler pool working on files
+	updates := make(chan veb.IndexEntry, CHAN_SIZE)
+	done := make(chan int, MAX_HANDLERS)
+	for i := 0; i < MAX_HANDLERS; i++ {
+		go func() {
+			for f := range files {
+				// calculate checksum hash (and block checksums, for big files)
+				oldXsum := f.Xsum
+				veb.SetStats(index.Root, &f) // for its size; Update says if this fails
+				f.BlockSize = blocksFor(f.Size, blockSize)
+				err := veb.LimitedXsum(ctx, &f, nil, log)
+				if ctx.Err() != nil {
+					continue // interrupted; leave it for next time
+				}
+				if err != nil {
+					log.Err().Println("checksum for verify failed:", err)
+				}
+				if !bytes.Equal(f.Xsum, oldXsum) {
+					f.ResetVerified() // new contents
+				}
+				
+				updates <- f
+			}
+			done <- 1
+		}()
+	}
+
+	// done listener
+	go func() {
+		for i := 0; i < MAX_HANDLERS; i++ {
+			<-done
+		}
 		close(updates)
 	}()
 
@@ -641,258 +1498,1836 @@ func Commit(index *veb.Index, log *veb.Log) error {
 		}
 	}
 
+	// remove deleted files
+	deleted := index.Deleted()
+	if len(deleted) > 0 {
+		fmt.Println("\n--------------")
+		fmt.Println("Removed files:")
+		fmt.Println("--------------")
+		for _, f := range deleted {
+			index.Remove(f.Path)
+			fmt.Println(INDENT_F, f.Path)
+		}
+	}
+
 	// save index once everything's done
 	index.Save()
 
 	// info 
 	timer.Stop()
-	fmt.Println("\nsummary:", numCommits, "commits,", numErrors, 
-		"errors in", timer.Duration())
-	log.Info().Printf("%s (%d commits, %d errors) took %v\n",
-		COMMIT, numCommits, numErrors, timer.Duration())
+	fmt.Println("\nsummary:", numCommits, "commits,", len(deleted), "removals,",
+		numErrors, "errors in", timer.Duration())
+	log.Info().Printf("%s (%d commits, %d removals, %d errors) took %v\n",
+		COMMIT, numCommits, len(deleted), numErrors, timer.Duration())
+	if ctx.Err() != nil && retVal == nil {
+		retVal = fmt.Errorf("veb commit interrupted; run it again to commit the rest")
+	}
 	return retVal
 }
 
-// Sets the remote repository for this veb repo.
-// Remote repository must already exist for it to be set.
-func Remote(index *veb.Index, remote string, log *veb.Log) error {
-	defer log.Un(log.Trace(REMOTE))
+// Writes every committed file, with the index, xsums & config, into one file
+// for cold storage. If any committed file is missing or has changed since it
+// was committed, there's no bundle; fix or commit those first.
+func BundleCreate(index *veb.Index, file string, log *veb.Log) error {
+	defer log.Un(log.Trace(BUNDLE))
 	var timer veb.Timer
 	timer.Start()
 
-	// make remote an absolute path
-	if !path.IsAbs(remote) {
-		remote = path.Join(index.Root, remote)
-	}	
+	if file == "" {
+		return fmt.Errorf("veb bundle create needs a file to write\n  e.g. 'veb bundle create /media/dvd/pictures.tar'")
+	}
+	if !path.IsAbs(file) {
+		file = path.Join(WORK_DIR, file)
+	}
 
-	// check to see if remote exists
-	fi, err := os.Stat(remote)
+	tmp := file + veb.TEMP_SUFFIX
+	bundle, err := os.Create(tmp)
 	if err != nil {
-		if os.IsNotExist(err) {
-			log.Err().Println(err)
-			return fmt.Errorf("veb remote dir does not exist: %v", err)
-		} else {
-			log.Err().Println(err)
-			return err
-		}
-	} else if !fi.IsDir() {
-		// ain't a directory
-		log.Err().Println(remote, "isn't a directory")
-		return fmt.Errorf("veb remote must be a folder: %s is not a folder", remote)
+		return err
+	}
+	report, err := veb.WriteBundle(index, bundle, log)
+	if err == nil {
+		err = bundle.Sync()
+	}
+	if cerr := bundle.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && !report.OK() {
+		printBundleReport(report)
+		err = fmt.Errorf("veb did not create the bundle; use 'veb verify' to check those files")
+	}
+	if err == nil {
+		err = os.Rename(tmp, file)
 	}
-
-	// check to see if it's a veb repo
-	remoteRepo := path.Join(remote, veb.META_FOLDER)
-	fi, err = os.Stat(remoteRepo)
 	if err != nil {
-		if os.IsNotExist(err) {
-			log.Err().Println(err)
-			fmt.Println("veb remote needs to be initialized as a veb repository",
-				"\n  (use 'veb init' in remote dir)")
-			return err
-		} else {
-			log.Err().Println(err)
-			return err
-		}
-	} else if !fi.IsDir() {
-		// ain't a directory
-		log.Err().Println(remoteRepo, "isn't a directory")
-		fmt.Println("veb remote needs", remoteRepo, "to be a folder",
-			"\nDelete or rename that file and run 'veb init' from", remote, "\n")
-		return fmt.Errorf("%s isn't a directory", remoteRepo)
+		os.Remove(tmp)
+		return err
 	}
-
-	// set remote
-	index.Remote = remote
-	index.Save()
-	fmt.Println("veb added", remote, "as the remote")
+	fmt.Printf("bundled %d files (%v) into %s\n", report.Files, ByteSize(report.Bytes), file)
 
 	// info log
 	timer.Stop()
-	log.Info().Printf("%s took %v\n",
-		REMOTE, timer.Duration())
+	log.Info().Printf("%s %s (%d files) took %v\n", BUNDLE, BUNDLE_CREATE, report.Files, timer.Duration())
 	return nil
 }
 
-// Compares local index against remote index, then copies the differing files
-// to the remote location if remote doesn't have same checksum.
-// Updates remote's index with the new file information after each file success,
-// but doesn't /save/ remote's index to disk until finished.
-func Push(local *veb.Index, log *veb.Log) error {
-	defer log.Un(log.Trace(PUSH))
-	var timer veb.Timer
-	timer.Start()
-
-	// open remote's index
-	if local.Remote == "" {
-		return fmt.Errorf("No remote veb repository. Use 'veb remote' to set one.")
+// Checks every file in a bundle against its checksum, without extracting it.
+func BundleVerify(file string) error {
+	if file == "" {
+		return fmt.Errorf("veb bundle verify needs the bundle to check")
 	}
-	remote, err := veb.Load(local.Remote, log) // TODO: have log indicate local vs remote
+	bundle, err := os.Open(file)
 	if err != nil {
-		return fmt.Errorf("veb could not load remote index: %v", err)
+		return err
 	}
+	defer bundle.Close()
 
-	// get new/changed files for local & remote
-	// we'll ignore these, as they haven't been committed
-	locIgnore := make(chan veb.IndexEntry, CHAN_SIZE)
-	remIgnore := make(chan veb.IndexEntry, CHAN_SIZE)
-	go local.Check(locIgnore)
-	go remote.Check(remIgnore)
+	index, report, err := veb.VerifyBundle(bufio.NewReader(bundle))
+	if err != nil {
+		return fmt.Errorf("veb could not read bundle %s: %v", file, err)
+	}
+	printBundleReport(report)
+	fmt.Printf("\nsummary: %d good (%v), %d bad, %d missing, %d extra (repository %s)\n",
+		report.Files, ByteSize(report.Bytes), len(report.Bad), len(report.Missing), len(report.Extra), index.UUID)
+	if !report.OK() {
+		return fmt.Errorf("bundle %s is damaged", file)
+	}
+	return nil
+}
 
-	// notify user of ignored files
-	cmt := true
-	cmtMsg := func() {
-		if cmt {
-			fmt.Println("use 'veb status' to check new/changed files")
-			fmt.Println("use 'veb commit' to add new/changed files to repository")
-			cmt = false
-		}		
+// Restores the repository in a bundle into folder dir (default: the current
+// one). Files that are bad or missing in the bundle stay committed, so
+// 'veb status' shows them as deleted and 'veb fix' can get them from a remote.
+// The clone gets a UUID of its own, unless restore says it replaces the
+// bundled repository.
+func Clone(bundle, dir string, restore bool) error {
+	if bundle == "" {
+		return fmt.Errorf("veb can only clone from a bundle\n  e.g. 'veb clone --from-bundle=/media/dvd/pictures.tar pictures'")
 	}
-	first := true
-	locFilter := make(map[string]bool)
-	remFilter := make(map[string]bool)
-	for f := range locIgnore {
-		if first {
-			cmtMsg()
-			fmt.Println("\n--------------------")
-			fmt.Println("LOCAL ignored files:")
-			fmt.Println("--------------------")
-			first = false
-		}
+	if dir == "" {
+		dir = "."
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path.Join(dir, veb.META_FOLDER)); err == nil {
+		return fmt.Errorf("%s is a veb repository already", dir)
+	}
+
+	in, err := os.Open(bundle)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// make the logger
+	err = os.MkdirAll(path.Join(dir, veb.META_FOLDER), 0755)
+	if err != nil {
+		return fmt.Errorf("veb could not create metadata directory: %v", err)
+	}
+	logf, err := os.OpenFile(path.Join(dir, veb.META_FOLDER, veb.LOG_FILE),
+		os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer logf.Close()
+	log := veb.NewLog(log.New(logf, "", log.LstdFlags|log.Lshortfile))
+	defer log.Un(log.Trace(CLONE))
+
+	index, report, err := veb.ExtractBundle(bufio.NewReader(in), dir, log)
+	if err != nil {
+		return fmt.Errorf("veb could not restore from %s: %v", bundle, err)
+	}
+	if !restore {
+		index.UUID, err = veb.NewUUID()
+		if err != nil {
+			return err
+		}
+	}
+	err = index.Save()
+	if err != nil {
+		return err
+	}
+
+	printBundleReport(report)
+	fmt.Printf("Restored veb repository at %s: %d files (%v)\n", dir, report.Files, ByteSize(report.Bytes))
+	if len(report.Bad) > 0 || len(report.Missing) > 0 {
+		return fmt.Errorf("some files didn't come out of the bundle; use 'veb fix' to get them from a remote")
+	}
+	return nil
+}
+
+// Lists what a BundleReport found wrong
+func printBundleReport(report *veb.BundleReport) {
+	sections := []struct {
+		title string
+		paths []string
+	}{
+		{"Files that don't match their checksums:", report.Bad},
+		{"Missing files:", report.Missing},
+		{"Files that aren't committed:", report.Extra},
+	}
+	for _, s := range sections {
+		if len(s.paths) == 0 {
+			continue
+		}
+		line := strings.Repeat("-", len(s.title))
+		fmt.Printf("\n%s\n%s\n%s\n", line, s.title, line)
+		for _, p := range s.paths {
+			fmt.Println(INDENT_F, p)
+		}
+	}
+}
+
+// Adds, removes, renames or lists the remote repositories of this veb repo.
+//   list                - lists remotes (with paths & last push, if verbose)
+//   add <name> <path>   - adds a remote; its repository must already exist
+//   remove <name>       - forgets about a remote (doesn't touch its files)
+//   rename <old> <new>  - renames a remote
+//   <path>              - sets the DEFAULT_REMOTE's path, like veb v0.1 did
+// opts says how to set up a new (empty) remote.
+func Remote(index *veb.Index, cmd string, args []string, verbose bool, opts remoteOptions, log *veb.Log) error {
+	defer log.Un(log.Trace(REMOTE))
+	var timer veb.Timer
+	timer.Start()
+
+	if opts.keyFile != "" && !path.IsAbs(opts.keyFile) {
+		opts.keyFile = path.Join(WORK_DIR, opts.keyFile)
+	}
+
+	var err error
+	switch cmd {
+	case REMOTE_LIST:
+		for _, r := range index.RemoteList() {
+			if !verbose {
+				fmt.Println(r.Name)
+				continue
+			}
+			fmt.Printf("%s\t%s\t%s\n", r.Name, r.URL, r.UUID)
+			if !r.LastPush.IsZero() {
+				fmt.Printf("%s last pushed on (%v)\n", INDENT_I, r.LastPush)
+			}
+		}
+
+	case REMOTE_ADD:
+		if len(args) != 2 {
+			return fmt.Errorf("veb remote add needs a name and a path\n  e.g. 'veb remote add nas /mnt/nas/music'")
+		}
+		if _, ok := index.Remotes[args[0]]; ok {
+			return fmt.Errorf("veb remote %s already exists", args[0])
+		}
+		url, uuid, encrypted, err := checkRemote(index, args[1], opts, log)
+		if err != nil {
+			return err
+		}
+		r, err := index.AddRemote(args[0], url)
+		if err != nil {
+			return err
+		}
+		r.UUID = uuid
+		err = setRemoteKey(index, args[0], encrypted, opts.keyFile, log)
+		if err != nil {
+			return err
+		}
+		fmt.Println("veb added", url, "as the remote", args[0])
+
+	case REMOTE_REMOVE:
+		if len(args) != 1 {
+			return fmt.Errorf("veb remote remove needs the name of the remote to remove")
+		}
+		err = index.RemoveRemote(args[0])
+		if err != nil {
+			return err
+		}
+		err = updateConfig(index, func(c *veb.Config) { c.RemoveRemote(args[0]) }, log)
+		if err != nil {
+			return err
+		}
+		fmt.Println("veb removed the remote", args[0])
+
+	case REMOTE_RENAME:
+		if len(args) != 2 {
+			return fmt.Errorf("veb remote rename needs the old and new names of the remote")
+		}
+		err = index.RenameRemote(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		err = updateConfig(index, func(c *veb.Config) { c.RenameRemote(args[0], args[1]) }, log)
+		if err != nil {
+			return err
+		}
+		fmt.Println("veb renamed the remote", args[0], "to", args[1])
+
+	default:
+		// 'veb remote <path>'
+		url, uuid, encrypted, err := checkRemote(index, cmd, opts, log)
+		if err != nil {
+			return err
+		}
+		r, ok := index.Remotes[veb.DEFAULT_REMOTE]
+		if !ok {
+			r, _ = index.AddRemote(veb.DEFAULT_REMOTE, url)
+		}
+		r.URL = url
+		r.UUID = uuid
+		r.Paths = nil
+		err = setRemoteKey(index, veb.DEFAULT_REMOTE, encrypted, opts.keyFile, log)
+		if err != nil {
+			return err
+		}
+		fmt.Println("veb added", url, "as the remote", veb.DEFAULT_REMOTE)
+	}
+
+	// save changes
+	if cmd != REMOTE_LIST {
+		err = index.Save()
+		if err != nil {
+			return err
+		}
+	}
+
+	// info log
+	timer.Stop()
+	log.Info().Printf("%s %s took %v\n",
+		REMOTE, cmd, timer.Duration())
+	return nil
+}
+
+// Loads the config, changes it, and saves it again.
+func updateConfig(index *veb.Index, change func(*veb.Config), log *veb.Log) error {
+	config, err := veb.LoadConfig(index.Root, log)
+	if err != nil {
+		return err
+	}
+	change(config)
+	return config.Save()
+}
+
+// Remembers in the config whether the named remote is encrypted, and where
+// its key file is.
+func setRemoteKey(index *veb.Index, name string, encrypted bool, keyFile string, log *veb.Log) error {
+	return updateConfig(index, func(c *veb.Config) {
+		if _, ok := c.Remotes[name]; !ok && !encrypted {
+			return
+		}
+		rc := c.Remote(name)
+		rc.Encrypt = encrypted
+		rc.KeyFile = ""
+		if encrypted {
+			rc.KeyFile = keyFile
+		}
+		c.Remotes[name] = rc
+	}, log)
+}
+
+// A flag that can be given with or without a value: --remote or --remote=name
+type optionalString struct {
+	set   bool
+	value string
+}
+
+func (s *optionalString) String() string   { return s.value }
+func (s *optionalString) IsBoolFlag() bool { return true }
+
+func (s *optionalString) Set(value string) error {
+	s.set = true
+	if value != "true" { // given without a value
+		s.value = value
+	}
+	return nil
+}
+
+// How 'veb remote add' sets up a new remote
+type remoteOptions struct {
+	encrypt      bool   // encrypt everything stored there
+	encryptNames bool   // file names too
+	keyFile      string // encryption key; "" = $VEB_PASSPHRASE
+	objects      bool   // store files by checksum (veb.LAYOUT_OBJECTS)
+}
+
+// Checks that remote is a veb repository, and not this one, setting it up as
+// opts says first.
+// Returns remote as an absolute path (or URL), its repository's UUID, and
+// whether it's encrypted.
+func checkRemote(index *veb.Index, remote string, opts remoteOptions, log *veb.Log) (string, string, bool, error) {
+	if veb.IsLocalURL(remote) {
+		var err error
+		remote, err = checkLocalRemote(remote, log)
+		if err != nil {
+			return "", "", false, err
+		}
+	}
+
+	// check to see whose repo it is
+	t, err := veb.NewTransport(remote, log)
+	if err != nil {
+		return "", "", false, err
+	}
+	defer func() { t.Close() }()
+	if opts.encrypt {
+		secret, err := veb.CryptSecret(opts.keyFile)
+		if err != nil {
+			return "", "", false, err
+		}
+		ct, err := veb.EncryptRemote(t, secret, opts.encryptNames, log)
+		if err != nil {
+			return "", "", false, fmt.Errorf("veb could not encrypt remote: %v", err)
+		}
+		t = ct
+	} else {
+		wt, err := veb.WrapCrypt(t, &veb.RemoteConfig{KeyFile: opts.keyFile}, log)
+		if err != nil {
+			return "", "", false, err
+		}
+		t = wt
+	}
+	_, encrypted := t.(*veb.CryptTransport)
+	repo, err := t.LoadIndex()
+	if os.IsNotExist(err) && !veb.IsLocalURL(remote) {
+		// e.g. a fresh bucket; nowhere to run 'veb init', so do it from here
+		repo, err = veb.New(crypto.SHA1, remote)
+		if err == nil {
+			err = t.SaveIndex(repo)
+		}
+		if err != nil {
+			return "", "", false, fmt.Errorf("veb could not initialize remote: %v", err)
+		}
+		fmt.Println("Initialized empty veb repository at", remote)
+	}
+	if err != nil {
+		return "", "", false, fmt.Errorf("veb could not load remote index: %v", err)
+	}
+	if repo.UUID == index.UUID {
+		return "", "", false, fmt.Errorf("veb remote can't be this repository")
+	}
+	save := repo.UnsavedUUID() // so the UUID recorded for it sticks
+	if opts.objects && repo.Layout != veb.LAYOUT_OBJECTS {
+		if len(repo.Files) > 0 {
+			return "", "", false, fmt.Errorf("veb can only store files by checksum on an empty remote")
+		}
+		repo.Layout = veb.LAYOUT_OBJECTS
+		save = true
+	}
+	if save {
+		err = t.SaveIndex(repo)
+		if err != nil {
+			return "", "", false, err
+		}
+	}
+
+	return remote, repo.UUID, encrypted, nil
+}
+
+// Checks that the local folder remote exists and is a veb repository.
+// Returns remote as an absolute path.
+func checkLocalRemote(remote string, log *veb.Log) (string, error) {
+	remote = strings.TrimPrefix(remote, "file://")
+
+	// make remote an absolute path
+	if !path.IsAbs(remote) {
+		remote = path.Join(WORK_DIR, remote)
+	}	
+
+	// check to see if remote exists
+	fi, err := os.Stat(remote)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Err().Println(err)
+			return "", fmt.Errorf("veb remote dir does not exist: %v", err)
+		} else {
+			log.Err().Println(err)
+			return "", err
+		}
+	} else if !fi.IsDir() {
+		// ain't a directory
+		log.Err().Println(remote, "isn't a directory")
+		return "", fmt.Errorf("veb remote must be a folder: %s is not a folder", remote)
+	}
+
+	// check to see if it's a veb repo
+	remoteRepo := path.Join(remote, veb.META_FOLDER)
+	fi, err = os.Stat(remoteRepo)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Err().Println(err)
+			fmt.Println("veb remote needs to be initialized as a veb repository",
+				"\n  (use 'veb init' in remote dir)")
+			return "", err
+		} else {
+			log.Err().Println(err)
+			return "", err
+		}
+	} else if !fi.IsDir() {
+		// ain't a directory
+		log.Err().Println(remoteRepo, "isn't a directory")
+		fmt.Println("veb remote needs", remoteRepo, "to be a folder",
+			"\nDelete or rename that file and run 'veb init' from", remote)
+		return "", fmt.Errorf("%s isn't a directory", remoteRepo)
+	}
+
+	return remote, nil
+}
+
+// Serves the veb repositories in folder dir (default: the current one) on
+// listen until killed, to the clients whose certificates' fingerprints are in
+// clientsFile. Logs to stderr.
+// With stdio set, serves just the client on the other end of stdin & stdout
+// instead, without TLS (ssh takes care of that) and without logging (stderr
+// goes to the client's terminal; errors reach the client anyway).
+func Serve(dir, listen, certFile, keyFile, clientsFile string, stdio bool) error {
+	if dir == "" {
+		dir = "."
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	if stdio {
+		log := veb.NewLog(log.New(io.Discard, "", 0))
+		veb.NewServer(dir, nil, log).ServeConn(stdioConn{})
+		return nil
+	}
+
+	log := veb.NewLog(log.New(os.Stderr, "", log.LstdFlags))
+	defer log.Un(log.Trace(SERVE))
+
+	cert, err := veb.LoadServeCert(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("veb could not load certificate: %v", err)
+	}
+	clients, clientsFile, err := veb.LoadClientFingerprints(clientsFile)
+	if err != nil {
+		return fmt.Errorf("veb could not load clients: %v", err)
+	}
+
+	host, _ := os.Hostname()
+	fmt.Println("serving veb repositories in", dir, "on", listen)
+	fmt.Println("certificate fingerprint:", veb.CertFingerprint(cert))
+	fmt.Printf("  (e.g. 'veb remote add nas veb://%s%s/<repo>?fingerprint=%s')\n",
+		host, listen[strings.LastIndex(listen, ":"):], veb.CertFingerprint(cert))
+	fmt.Println("letting in", len(clients), "clients, from", clientsFile)
+	fmt.Println("  (add the output of 'veb serve --fingerprint' on a client to let it in)")
+
+	return veb.NewServer(dir, veb.ServeTLS(cert, clients), log).ListenAndServe(listen)
+}
+
+// stdin & stdout, as one connection
+type stdioConn struct{}
+
+func (stdioConn) Read(p []byte) (int, error)  { return os.Stdin.Read(p) }
+func (stdioConn) Write(p []byte) (int, error) { return os.Stdout.Write(p) }
+func (stdioConn) Close() error                { return os.Stdout.Close() }
+
+// Compares local index against remote index, then copies the differing files
+// to the remote location if remote doesn't have same checksum.
+// Updates remote's index with the new file information after each file success,
+// but doesn't /save/ remote's index to disk until finished.
+// If trash is set, committed remote files that are not in the local index are
+// moved into the remote's trash instead of being left alone.
+// Remote files that get overwritten are kept as versions, unless config says no.
+// Refuses to start if the files won't fit on the remote, unless partial is set;
+// then it sends as many of the smallest files as will fit.
+// Pushes to the named remote, or the default remote if name is "".
+// If ctx is cancelled (ctrl-c), transfers stop and what's been pushed by then
+// is saved; deletes & pruning are left for the next push.
+func Push(ctx context.Context, local *veb.Index, name string, trash, partial bool, bwLimit, ioLimit string, log *veb.Log) error {
+	defer log.Un(log.Trace(PUSH))
+	var timer veb.Timer
+	timer.Start()
+
+	config, err := veb.LoadConfig(local.Root, log)
+	if err != nil {
+		return err
+	}
+
+	// open remote's index
+	dest, tr, remote, err := openRemote(local, name, log) // TODO: have log indicate local vs remote
+	if err != nil {
+		return err
+	}
+	defer tr.Close()
+	tr, err = limitRemote(tr, config, dest.Name, bwLimit, ioLimit)
+	if err != nil {
+		return err
+	}
+	versions, err := veb.LoadVersions(tr, log)
+	if err != nil {
+		return fmt.Errorf("veb could not load remote versions: %v", err)
+	}
+	fmt.Println("pushing to", dest.Name, "at", dest.URL)
+	if dest.LastGeneration != 0 && dest.LastGeneration != remote.Generation {
+		fmt.Printf("  (%s has changed since this repository last pushed to it)\n", dest.Name)
+	}
+
+	// get new/changed files for local & remote
+	// we'll ignore these, as they haven't been committed
+	locFilter, remFilter := uncommitted(ctx, local, tr, remote)
+	if ctx.Err() != nil {
+		return fmt.Errorf("veb push interrupted; nothing pushed")
+	}
+
+	// make list of files to send
+	numIgnored := 0
+	numNoChange := 0
+	for p := range locFilter {
+		if _, ok := local.Files[p]; !ok {
+			numIgnored++ // new local file
+		}
+	}
+	toSend := make([]veb.IndexEntry, 0)
+	replaces := make(map[string]veb.IndexEntry)
+	for p, f := range local.Files {
+		// ignore if it's one of the new/changed files
+		_, skipL := locFilter[p]
+		_, skipR := remFilter[p]
+		if skipL || skipR {
+			numIgnored++
+			continue
+		}
+
+		// compare checksum hashes
+		old, ok := remote.Files[p] // does file exist in remote yet?
+		if ok && bytes.Equal(f.Xsum, old.Xsum) {
+			numNoChange++
+			continue
+		}
+		if ok {
+			replaces[p] = old
+		}
+		toSend = append(toSend, f)
+	}
+
+	// make sure it all fits before sending anything
+	toSend, err = preflight(dest, tr, remote, versions, config, toSend, replaces, partial, log)
+	if err != nil {
+		return err
+	}
+
+	files := make(chan veb.IndexEntry, CHAN_SIZE)
+	go func() {
+		defer close(files)
+		for _, f := range toSend {
+			select {
+			case files <- f:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// send files to remote
+	done := make(chan int, MAX_HANDLERS)
+	updates := make(chan veb.IndexEntry, CHAN_SIZE)
+	errored := make(chan veb.IndexEntry, CHAN_SIZE)
+	numErrored := 0
+	numPushed  := 0
+	for i := 0; i < MAX_HANDLERS; i++ {
+		go func() {
+			for f := range files {
+				// TODO: verify f.Xsum == local file's actual xsum
+				//  - don't want corrupted files getting across.
+
+				// keep the remote's copy around before overwriting it
+				var err error
+				kept := false
+				old, ok := replaces[f.Path]
+				if ok && !config.NoVersions {
+					err = versions.Keep(old)
+					if os.IsNotExist(err) {
+						// nothing to keep
+						log.Warn().Println("remote file to keep was missing:", old.Path)
+						err = nil
+					} else {
+						kept = err == nil
+					}
+				}
+
+				if err == nil {
+					err = pushFile(ctx, local.Root, tr, f, log)
+					// the remote's index still lists the old copy there
+					if err != nil && kept {
+						uerr := versions.Unkeep(old)
+						if uerr != nil {
+							log.Err().Println("could not put back", old.Path, ":", uerr)
+						}
+					}
+				}
+				if ctx.Err() != nil {
+					continue // interrupted; counted as not pushed
+				}
+				if err != nil {
+					// notify of error, but continue with rest of files
+					// TODO: get the error out too
+					errored <- f
+					numErrored++
+				} else {
+					// save entry so index can be updated
+					updates <- f
+					numPushed++
+				}
+			}
+			done <- 1
+		}()
+	}
+
+	// listeners
+	var retVal error = nil
+	numListeners := 3
+	quit := make(chan int, numListeners)
+	go func() {
+		for i := 0; i < MAX_HANDLERS; i++ {
+			<-done
+		}
+		close(updates)
+		close(errored)
+		quit <- 1
+	}()
+	go func() {
+		for f := range errored {
+			// clear status line w/ 80 spaces & carriage return
+			fmt.Printf("\r%sError: could not push to remote: %s\n",
+				"                                                                                \r",
+				f.Path)
+
+			if retVal == nil {
+				retVal = fmt.Errorf("error transferring files to remote")
+			}
+		}
+		quit <- 1
+	}()
+	go func () {
+		first := true
+		for f := range updates {
+			if first {
+				fmt.Printf("%s%s\n%s\n%s\n",
+					"\r                                                                                \r",
+					"\n-------------",
+					"Pushed files:",
+					"-------------")
+				first = false
+			}
+
+			// clear status line w/ 80 spaces & carriage return
+			fmt.Printf("\r%s%s %s\n",
+				"                                                                                \r",
+				INDENT_F, f.Path)
+			err := veb.StatEntry(tr, &f)
+			if err != nil {
+				log.Err().Println(err)
+			}
+			f.ResetVerified() // the remote's copy hasn't been
+			remote.Set(f)
+		}
+		quit <- 1
+	}()
+
+	// print status while waiting for everyone to finish
+	for len(quit) < numListeners {
+		fmt.Printf("\rstatus: %4d ignored, %4d errors, %4d pushed, %4d unchanged",
+			numIgnored, numErrored, numPushed, numNoChange)
+	}	
+
+	fmt.Println("\r                                                                                ")
+
+	// find remote files that are gone from the local repository
+	gone := make([]veb.IndexEntry, 0)
+	for p, f := range remote.Files {
+		_, inLocal := local.Files[p]
+		_, skipL := locFilter[p]
+		_, skipR := remFilter[p]
+		if !inLocal && !skipL && !skipR {
+			gone = append(gone, f)
+		}
+	}
+	numTrashed := 0
+	numNotPushed := len(toSend) - numPushed - numErrored
+	if ctx.Err() == nil {
+		numTrashed, err = pushDeletes(tr, remote, config, gone, trash, log)
+		if err != nil && retVal == nil {
+			retVal = err
+		}
+
+		// delete versions past retention
+		err = pruneVersions(versions, config, log)
+		if err != nil && retVal == nil {
+			retVal = err
+		}
+	}
+	err = versions.Save()
+	if err != nil && retVal == nil {
+		retVal = err
+	}
+
+	// save remote index's updates
+	err = tr.SaveIndex(remote)
+	if err != nil && retVal == nil {
+		retVal = fmt.Errorf("veb could not save remote index: %v", err)
+	}
+
+	// remember how the push went
+	dest.LastPush = time.Now()
+	dest.LastGeneration = remote.Generation
+	local.Save()
+
+	// print outro
+	timer.Stop()
+	fmt.Printf("status: %4d ignored, %4d errors, %4d pushed, %4d unchanged, %4d trashed in %v\n",
+		numIgnored, numErrored, numPushed, numNoChange, numTrashed, timer.Duration())
+	
+	// info log
+	timer.Stop()
+	log.Info().Printf("%s (%d ignored, %d errors, %d pushed, %d unchanged, %d trashed, %d not pushed) took %v\n",
+		PUSH, numIgnored, numErrored, numPushed, numNoChange, numTrashed, numNotPushed, timer.Duration())
+	if ctx.Err() != nil && retVal == nil {
+		retVal = fmt.Errorf("veb push interrupted; %d files not pushed", numNotPushed)
+	}
+	return retVal
+}
+
+// Copies committed files the local repository doesn't have from the remote.
+// Files both repositories have, but with different checksums, are only listed;
+// 'veb fix' or 'veb push' can settle which copy wins.
+// Pulls from the named remote, or the default remote if name is "".
+// If ctx is cancelled (ctrl-c), it stops after the file it's on and saves
+// what it's pulled.
+func Pull(ctx context.Context, local *veb.Index, name, bwLimit, ioLimit string, log *veb.Log) error {
+	defer log.Un(log.Trace(PULL))
+	var timer veb.Timer
+	timer.Start()
+
+	config, err := veb.LoadConfig(local.Root, log)
+	if err != nil {
+		return err
+	}
+
+	// open remote's index
+	src, tr, remote, err := openRemote(local, name, log)
+	if err != nil {
+		return err
+	}
+	defer tr.Close()
+	tr, err = limitRemote(tr, config, src.Name, bwLimit, ioLimit)
+	if err != nil {
+		return err
+	}
+	fmt.Println("pulling from", src.Name, "at", src.URL)
+
+	// ignore anything uncommitted on either side
+	locFilter, remFilter := uncommitted(ctx, local, tr, remote)
+	if ctx.Err() != nil {
+		return fmt.Errorf("veb pull interrupted; nothing pulled")
+	}
+
+	// get what's missing, note what differs
+	var retVal error = nil
+	numPulled, numErrored, numDiffer := 0, 0, 0
+	first := true
+	for _, f := range sortedEntries(remote.Files) {
+		if ctx.Err() != nil {
+			retVal = fmt.Errorf("veb pull interrupted; run it again to pull the rest")
+			break
+		}
+		if locFilter[f.Path] || remFilter[f.Path] {
+			continue
+		}
+		have, ok := local.Files[f.Path]
+		if ok {
+			if !bytes.Equal(have.Xsum, f.Xsum) {
+				fmt.Println("differs from remote:", f.Path)
+				numDiffer++
+			}
+			continue
+		}
+
+		f.ResetVerified() // only the remote's copy has been
+		err = veb.Fetch(tr, f.Path, f, path.Join(local.Root, f.Path))
+		if err != nil {
+			log.Err().Println(err)
+			fmt.Println("Error: could not pull", f.Path, ":", err)
+			retVal = fmt.Errorf("error transferring files from remote")
+			numErrored++
+			continue
+		}
+		err = local.Update(&f)
+		if err != nil {
+			fmt.Println("Error: could not add", f.Path, "to index:", err)
+			retVal = fmt.Errorf("error transferring files from remote")
+			numErrored++
+			continue
+		}
+
+		if first {
+			fmt.Println("\n-------------")
+			fmt.Println("Pulled files:")
+			fmt.Println("-------------")
+			first = false
+		}
+		fmt.Println(INDENT_F, f.Path)
+		numPulled++
+	}
+	if numDiffer > 0 {
+		fmt.Println("\n  (use 'veb fix <file>' to take the remote's copy, or 'veb push' to send yours)")
+	}
+
+	// save local index's updates
+	if numPulled > 0 {
+		local.Save()
+	}
+
+	// print outro
+	timer.Stop()
+	fmt.Printf("\nsummary: %d pulled, %d differ, %d errors in %v\n",
+		numPulled, numDiffer, numErrored, timer.Duration())
+
+	// info log
+	log.Info().Printf("%s (%d pulled, %d differ, %d errors) took %v\n",
+		PULL, numPulled, numDiffer, numErrored, timer.Duration())
+	return retVal
+}
+
+// Replaces local files with the remote's copy.
+// Only fixes files where the remote's committed checksum matches the local
+// index. The remote's copy is checked against that checksum before it replaces
+// the local file.
+// Files with block checksums only get their damaged blocks from the remote.
+// Fixes from the named remote, or the default remote if name is "".
+// Gives up on the file it's on if ctx is cancelled.
+func Fix(ctx context.Context, local *veb.Index, name string, files []string, log *veb.Log) error {
+	defer log.Un(log.Trace(FIX))
+	var timer veb.Timer
+	timer.Start()
+
+	// open remote's index
+	src, tr, remote, err := openRemote(local, name, log)
+	if err != nil {
+		return err
+	}
+	defer tr.Close()
+
+	var retVal error = nil
+	numFixed := 0
+	for _, file := range files {
+		p := repoPath(local, file)
+		want, ok := local.Files[p]
+		if !ok {
+			fmt.Println("Error:", p, "isn't committed in this repository")
+			retVal = fmt.Errorf("veb could not fix all files")
+			continue
+		}
+		have, ok := remote.Files[p]
+		if !ok || !bytes.Equal(have.Xsum, want.Xsum) {
+			fmt.Println("Error:", src.Name, "doesn't have the committed version of", p)
+			retVal = fmt.Errorf("veb could not fix all files")
+			continue
+		}
+
+		fetched := have.Size
+		if len(want.Blocks) > 0 {
+			fetched, err = fixBlocks(ctx, local, tr, want, log)
+		} else {
+			err = veb.Fetch(tr, have.Path, have, path.Join(local.Root, have.Path))
+		}
+		if err != nil {
+			log.Err().Println(err)
+			fmt.Println("Error: could not fix", p, ":", err)
+			retVal = fmt.Errorf("veb could not fix all files")
+			continue
+		}
+		have.ResetVerified() // not here, since it was rewritten
+		if len(want.Blocks) > 0 {
+			// the remote's may be missing, or at another block size
+			have.BlockSize, have.Blocks = want.BlockSize, want.Blocks
+		}
+		err = local.Update(&have)
+		if err != nil {
+			fmt.Println("Error: could not update", p, "in the index:", err)
+			retVal = fmt.Errorf("veb could not fix all files")
+			continue
+		}
+		if fetched < have.Size {
+			fmt.Printf("fixed %s (got %s of %s from %s)\n", p, ByteSize(fetched), ByteSize(have.Size), src.Name)
+		} else {
+			fmt.Println("fixed", p)
+		}
+		numFixed++
+	}
+
+	// save local index's updated stats
+	if numFixed > 0 {
+		local.Save()
+	}
+
+	// info log
+	timer.Stop()
+	log.Info().Printf("%s (%d fixed) took %v\n", FIX, numFixed, timer.Duration())
+	return retVal
+}
+
+// Fixes local file f by getting just its damaged blocks from remote tr (see
+// veb.PatchBlocks). Returns how much it got from the remote.
+func fixBlocks(ctx context.Context, local *veb.Index, tr veb.Transport, f veb.IndexEntry,
+	log *veb.Log) (int64, error) {
+	file, err := os.Open(path.Join(local.Root, f.Path))
+	if os.IsNotExist(err) {
+		// nothing to patch; it all comes from the remote
+		return f.Size, veb.Fetch(tr, f.Path, f, path.Join(local.Root, f.Path))
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	patch := veb.PatchBlocks(ctx, tr, f.Path, file, f)
+	defer patch.Close()
+	err = veb.NewLocalTransport(local.Root, log).Write(f, patch)
+	return patch.FetchedSize(), err
+}
+
+// Makes parity for the committed files (all of them, or those in files, which
+// may be folders), so they can be repaired without a remote. percent (or
+// ParityPercent in the config) is how much, as a percent of each file's size.
+// Files whose parity is up to date are skipped, and parity of files that
+// aren't committed any more is deleted. ioLimit (or IOLimit) throttles
+// reading the files. If ctx is cancelled (ctrl-c), it stops after the file
+// it's on.
+func ParityCreate(ctx context.Context, index *veb.Index, files []string, percent int, ioLimit string,
+	log *veb.Log) error {
+	defer log.Un(log.Trace(PARITY))
+	var timer veb.Timer
+	timer.Start()
+
+	config, err := veb.LoadConfig(index.Root, log)
+	if err != nil {
+		return err
+	}
+	disk, err := parseLimit(ioLimit, config.IOLimit, "io-limit")
+	if err != nil {
+		return err
+	}
+	if percent == 0 {
+		percent = config.ParityPercent
+	}
+	if percent == 0 {
+		percent = PARITY_PERCENT
+	}
+	entries, err := committedFiles(index, files)
+	if err != nil {
+		return err
+	}
+
+	// forget what isn't committed any more
+	pruned, err := veb.PruneParity(index)
+	if err != nil {
+		log.Err().Println("could not delete old parity:", err)
+	}
+	if len(pruned) > 0 {
+		fmt.Println("Deleted parity of", len(pruned), "files that aren't committed any more.")
+	}
+
+	var retVal error = nil
+	numMade, numCurrent, numErrored := 0, 0, 0
+	var size int64
+	first := true
+	for _, f := range entries {
+		if ctx.Err() != nil {
+			retVal = fmt.Errorf("veb parity create interrupted; run it again to make the rest")
+			break
+		}
+		if f.Size == 0 {
+			continue // nothing to protect
+		}
+		p, err := veb.LoadParity(index.Root, f.Path)
+		if err == nil && bytes.Equal(p.Xsum, f.Xsum) && p.Percent == percent {
+			numCurrent++
+			continue
+		}
+
+		err = veb.CreateParity(ctx, index.Root, f, percent, disk, log)
+		if ctx.Err() != nil {
+			continue
+		}
+		if err != nil {
+			log.Err().Println(err)
+			fmt.Println("Error: could not make parity for", f.Path, ":", err)
+			retVal = fmt.Errorf("veb could not make parity for all files")
+			numErrored++
+			continue
+		}
+		if first {
+			fmt.Println("\n-----------------------")
+			fmt.Println("Files with new parity:")
+			fmt.Println("-----------------------")
+			first = false
+		}
+		fmt.Println(INDENT_F, f.Path)
+		if info, err := os.Stat(path.Join(index.Root, veb.ParityPath(f.Path))); err == nil {
+			size += info.Size()
+		}
+		numMade++
+	}
+
+	// print outro
+	timer.Stop()
+	fmt.Printf("\nsummary: %d made (%s at %d%%), %d up to date, %d errors in %v\n",
+		numMade, ByteSize(size), percent, numCurrent, numErrored, timer.Duration())
+
+	// info log
+	log.Info().Printf("%s %s (%d made, %d bytes, %d up to date, %d errors) took %v\n",
+		PARITY, PARITY_CREATE, numMade, size, numCurrent, numErrored, timer.Duration())
+	return retVal
+}
+
+// Repairs damaged committed files (or all those in folders) from their
+// parity, keeping the damaged copies in quarantine. Undamaged files are left
+// alone. Parity that's damaged itself is made again once the file is good.
+// ioLimit (or IOLimit) throttles reading the files.
+func Repair(ctx context.Context, index *veb.Index, files []string, ioLimit string, log *veb.Log) error {
+	defer log.Un(log.Trace(REPAIR))
+	var timer veb.Timer
+	timer.Start()
+
+	config, err := veb.LoadConfig(index.Root, log)
+	if err != nil {
+		return err
+	}
+	disk, err := parseLimit(ioLimit, config.IOLimit, "io-limit")
+	if err != nil {
+		return err
+	}
+	entries, err := committedFiles(index, files)
+	if err != nil {
+		return err
+	}
+
+	var retVal error = nil
+	bin := veb.QuarantineBin(time.Now())
+	numRepaired, numOK, numErrored := 0, 0, 0
+	for _, f := range entries {
+		if ctx.Err() != nil {
+			retVal = fmt.Errorf("veb repair interrupted")
+			break
+		}
+		if f.Size == 0 {
+			continue // no parity, and nothing to damage
+		}
+		report, err := veb.RepairFromParity(ctx, index.Root, f, bin, disk, log)
+		if ctx.Err() != nil {
+			continue
+		}
+		if os.IsNotExist(err) && report == nil {
+			fmt.Println("Error:", f.Path, "has no parity (see 'veb parity create'), or is missing")
+			retVal = fmt.Errorf("veb could not repair all files")
+			numErrored++
+			continue
+		}
+
+		// what was damaged
+		var ranges string
+		var damaged ByteSize
+		if report != nil && len(report.Damaged) > 0 {
+			ranges, damaged = rangeList(report.Damaged)
+		}
+		if err != nil {
+			log.Err().Println(err)
+			fmt.Println("Error: could not repair", f.Path, ":", err)
+			if ranges != "" {
+				fmt.Printf("%s damaged bytes: %s\n", INDENT_I, ranges)
+			}
+			retVal = fmt.Errorf("veb could not repair all files")
+			numErrored++
+			continue
+		}
+		if ranges == "" {
+			fmt.Println("ok", f.Path)
+			numOK++
+		} else {
+			fmt.Printf("repaired %s (%s damaged)\n", f.Path, damaged)
+			fmt.Printf("%s damaged bytes: %s\n", INDENT_I, ranges)
+			fmt.Printf("%s the damaged copy is in %s\n", INDENT_I, report.Quarantined)
+			numRepaired++
+		}
+
+		// parity is only as good as its own blocks
+		if report.BadParity > 0 {
+			p, err := veb.LoadParity(index.Root, f.Path)
+			if err == nil {
+				err = veb.CreateParity(ctx, index.Root, f, p.Percent, disk, log)
+			}
+			if err != nil && ctx.Err() == nil {
+				fmt.Printf("%s %d parity blocks were damaged, and making them again failed: %v\n",
+					INDENT_I, report.BadParity, err)
+				retVal = fmt.Errorf("veb could not repair all files")
+			} else if err == nil {
+				fmt.Printf("%s %d parity blocks were damaged; made them again\n", INDENT_I, report.BadParity)
+			}
+		}
+	}
+
+	// print outro
+	timer.Stop()
+	fmt.Printf("\nsummary: %d repaired, %d ok, %d errors in %v\n",
+		numRepaired, numOK, numErrored, timer.Duration())
+
+	// info log
+	log.Info().Printf("%s (%d repaired, %d ok, %d errors) took %v\n",
+		REPAIR, numRepaired, numOK, numErrored, timer.Duration())
+	return retVal
+}
+
+// The committed files in files (paths of files or folders, like the user gave
+// them), by path; all of them if files is empty.
+func committedFiles(index *veb.Index, files []string) ([]veb.IndexEntry, error) {
+	all := sortedEntries(index.Files)
+	if len(files) == 0 {
+		return all, nil
+	}
+
+	want := make(map[string]bool)
+	for _, file := range files {
+		p := repoPath(index, file)
+		found := false
+		for _, f := range all {
+			if p == "." || f.Path == p || strings.HasPrefix(f.Path, p+"/") {
+				want[f.Path] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("nothing committed in this repository at %s", p)
+		}
+	}
+	picked := make([]veb.IndexEntry, 0, len(want))
+	for _, f := range all {
+		if want[f.Path] {
+			picked = append(picked, f)
+		}
+	}
+	return picked, nil
+}
+
+// out.Fatal(err), but with err's own exit code if it has one (see
+// mismatchError)
+func fatal(out *log.Logger, err error) {
+	code := 1
+	if e, ok := err.(interface{ ExitCode() int }); ok {
+		code = e.ExitCode()
+	}
+	out.Print(err)
+	os.Exit(code)
+}
+
+// Returns a context that's cancelled on the first SIGINT (ctrl-c) or SIGTERM,
+// so long commands can stop, save what they've done and say what they didn't
+// get to. A second signal quits right away.
+func interruptible() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		fmt.Println("\ninterrupted; finishing up (interrupt again to quit now)")
+		cancel()
+		<-sigs
+		os.Exit(1)
+	}()
+	return ctx
+}
+
+// Adds the --bwlimit & --io-limit flags to a command's flags
+func limitFlags(flags *flag.FlagSet) (*string, *string) {
+	bwLimit := flags.String("bwlimit", "",
+		"most bytes per second to move to/from the remote, e.g. 2MB, or off (default: BwLimit in config)")
+	ioLimit := flags.String("io-limit", "",
+		"most bytes per second to read/write on disk, e.g. 20MB, or off (default: IOLimit in config)")
+	return bwLimit, ioLimit
+}
+
+// Returns the Limiter for a limit flag's value, or the config's if the flag
+// wasn't given. nil means no limit.
+func parseLimit(flagValue, configValue, name string) (*veb.Limiter, error) {
+	spec := configValue
+	if flagValue != "" {
+		spec = flagValue
+	}
+	l, err := veb.ParseLimit(spec)
+	if err != nil {
+		return nil, fmt.Errorf("veb %s: %v", name, err)
+	}
+	return l, nil
+}
+
+// Lists byte ranges like "0-4095, 8192-12287", and their total size
+func rangeList(ranges []veb.ByteRange) (string, ByteSize) {
+	var size int64
+	list := make([]string, 0, len(ranges))
+	for _, r := range ranges {
+		size += r.To - r.From
+		list = append(list, fmt.Sprintf("%d-%d", r.From, r.To-1))
+	}
+	return strings.Join(list, ", "), ByteSize(size)
+}
+
+// Size of the blocks files get block checksums of (BlockSize in the config);
+// 0 if they don't
+func parseBlockSize(config *veb.Config) (int64, error) {
+	size, err := veb.ParseSize(config.BlockSize)
+	if err != nil {
+		return 0, fmt.Errorf("veb could not read BlockSize: %v", err)
+	}
+	if size > 0 && size < veb.BLOCK_MIN {
+		return 0, fmt.Errorf("veb BlockSize can't be less than %s", ByteSize(veb.BLOCK_MIN))
+	}
+	return size, nil
+}
+
+// The block size a file of size bytes gets block checksums of: only files
+// bigger than one block get them
+func blocksFor(size, blockSize int64) int64 {
+	if blockSize > 0 && size > blockSize {
+		return blockSize
+	}
+	return 0
+}
+
+// Throttles what goes to & from the named remote by bwLimit (or its BwLimit)
+// and ioLimit (or the IOLimit), which are shared by all of push's or pull's
+// workers.
+func limitRemote(tr veb.Transport, config *veb.Config, name, bwLimit, ioLimit string) (veb.Transport, error) {
+	bw, err := parseLimit(bwLimit, config.Remote(name).BwLimit, "bwlimit")
+	if err != nil {
+		return nil, err
+	}
+	disk, err := parseLimit(ioLimit, config.IOLimit, "io-limit")
+	if err != nil {
+		return nil, err
+	}
+	return veb.WrapLimit(tr, bw, disk), nil
+}
+
+// Finds the named (or default) remote, connects to it, and loads its index.
+// If the remote had moved, the local index is saved with its new location.
+// The caller closes the returned Transport.
+func openRemote(local *veb.Index, name string, log *veb.Log) (*veb.Remote, veb.Transport, *veb.Index, error) {
+	r, err := local.GetRemote(name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	config, err := veb.LoadConfig(local.Root, log)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	uuid := r.UUID
+	tr, remote, moved, err := local.LocateRemote(r, config.Remote(r.Name), log)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if moved {
+		fmt.Println("veb found remote", r.Name, "at", r.URL)
+	}
+	if moved || uuid != r.UUID {
+		local.Save()
+	}
+
+	return r, tr, remote, nil
+}
+
+// Finds new/changed/deleted files in local & remote that haven't been
+// committed, and tells the user about them. Push & pull ignore these files.
+// Returns filters of the uncommitted files' paths for local & remote.
+func uncommitted(ctx context.Context, local *veb.Index, tr veb.Transport, remote *veb.Index) (map[string]bool, map[string]bool) {
+	locIgnore := make(chan veb.IndexEntry, CHAN_SIZE)
+	remIgnore := make(chan veb.IndexEntry, CHAN_SIZE)
+	go local.Check(ctx, locIgnore)
+	go tr.Check(remote, remIgnore)
+
+	// notify user of ignored files
+	cmt := true
+	cmtMsg := func() {
+		if cmt {
+			fmt.Println("use 'veb status' to check new/changed files")
+			fmt.Println("use 'veb commit' to add new/changed files to repository")
+			cmt = false
+		}		
+	}
+	first := true
+	locFilter := make(map[string]bool)
+	remFilter := make(map[string]bool)
+	for f := range locIgnore {
+		if first {
+			cmtMsg()
+			fmt.Println("\n--------------------")
+			fmt.Println("LOCAL ignored files:")
+			fmt.Println("--------------------")
+			first = false
+		}
 		fmt.Println(INDENT_F, f.Path) // filename
 		locFilter[f.Path] = true // add to filter
 	}
-	first = true
-	for f := range remIgnore {
-		if first {
-			cmtMsg()
-			fmt.Println("\n---------------------")
-			fmt.Println("REMOTE ignored files:")
-			fmt.Println("---------------------")
-			first = false
-		}
-		fmt.Println(INDENT_F, f.Path) // filename
-		remFilter[f.Path] = true // add to filter
+	for _, f := range local.Deleted() {
+		// deleted, but not committed yet
+		if first {
+			cmtMsg()
+			fmt.Println("\n--------------------")
+			fmt.Println("LOCAL ignored files:")
+			fmt.Println("--------------------")
+			first = false
+		}
+		fmt.Println(INDENT_F, f.Path, "(deleted)")
+		locFilter[f.Path] = true
+	}
+	first = true
+	for f := range remIgnore {
+		if first {
+			cmtMsg()
+			fmt.Println("\n---------------------")
+			fmt.Println("REMOTE ignored files:")
+			fmt.Println("---------------------")
+			first = false
+		}
+		fmt.Println(INDENT_F, f.Path) // filename
+		remFilter[f.Path] = true // add to filter
+	}
+
+	return locFilter, remFilter
+}
+
+// Makes sure files will fit on the remote before any are sent. The bytes to
+// send (less the bytes of the remote files they replace, unless those are kept
+// as versions) are checked against the free space where the remote lives, and
+// against the remote's quota if it has one.
+// Returns the files to send: all of them if they fit; if not, an error, or,
+// for a partial push, the smallest files that do fit.
+func preflight(dest *veb.Remote, tr veb.Transport, remote *veb.Index, versions *veb.Versions,
+	config *veb.Config, files []veb.IndexEntry, replaces map[string]veb.IndexEntry,
+	partial bool, log *veb.Log) ([]veb.IndexEntry, error) {
+	// bytes each file will take up on the remote
+	cost := func(f veb.IndexEntry) int64 {
+		old, ok := replaces[f.Path]
+		if ok && config.NoVersions {
+			return f.Size - old.Size
+		}
+		return f.Size
+	}
+	need := int64(0)
+	for _, f := range files {
+		need += cost(f)
+	}
+
+	// how much room there is, if anything says
+	room, known := int64(0), false
+	free, err := tr.FreeSpace()
+	if err != nil {
+		log.Warn().Println("couldn't get free space of remote:", err)
+	} else {
+		room, known = free, true
+	}
+	quota, err := veb.ParseSize(config.Remote(dest.Name).Quota)
+	if err != nil {
+		return nil, fmt.Errorf("veb config Quota for %s: %v", dest.Name, err)
+	}
+	if quota > 0 {
+		used := remote.Size() + versions.Size()
+		bins, err := veb.LoadTrash(tr, log)
+		if err == nil {
+			used += bins.Size()
+		}
+		if !known || quota-used < room {
+			room, known = quota-used, true
+		}
+	}
+	// a remote over its quota has no room
+	if room < 0 {
+		room = 0
+	}
+
+	if !known || need <= room {
+		return files, nil
+	}
+	fmt.Printf("push needs %s, but %s only has room for %s\n",
+		ByteSize(need), dest.Name, ByteSize(room))
+	if !partial {
+		return nil, fmt.Errorf("not enough room on remote %s; nothing was sent\n"+
+			"  (use 'veb push --partial' to send the smallest files that fit)", dest.Name)
+	}
+
+	// smallest first, until full
+	sort.Sort(entriesBySize(files))
+	fits := make([]veb.IndexEntry, 0)
+	total := int64(0)
+	for _, f := range files {
+		if total+cost(f) <= room {
+			fits = append(fits, f)
+			total += cost(f)
+		}
+	}
+	fmt.Printf("partial push: sending %d of %d files (%s of %s)\n\n",
+		len(fits), len(files), ByteSize(total), ByteSize(need))
+	log.Info().Printf("partial push: %d of %d files\n", len(fits), len(files))
+	return fits, nil
+}
+
+// sort.Interface for ordering entries smallest first
+type entriesBySize []veb.IndexEntry
+
+func (e entriesBySize) Len() int           { return len(e) }
+func (e entriesBySize) Less(i, j int) bool { return e[i].Size < e[j].Size }
+func (e entriesBySize) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+
+// container/heap.Interface for getting entries verified longest ago (or
+// never) first
+type verifyQueue []veb.IndexEntry
+
+func (q verifyQueue) Len() int           { return len(q) }
+func (q verifyQueue) Less(i, j int) bool { return q[i].LastVerified.Before(q[j].LastVerified) }
+func (q verifyQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+
+func (q *verifyQueue) Push(x interface{}) {
+	*q = append(*q, x.(veb.IndexEntry))
+}
+
+func (q *verifyQueue) Pop() interface{} {
+	last := (*q)[len(*q)-1]
+	*q = (*q)[:len(*q)-1]
+	return last
+}
+
+// Moves remote files that were deleted from the local repository into the
+// remote's trash, then empties any trash that is past the configured retention.
+// If trash is false, the files are only counted & left where they are.
+// Returns the number of files trashed.
+func pushDeletes(tr veb.Transport, remote *veb.Index, config *veb.Config, gone []veb.IndexEntry, trash bool, log *veb.Log) (int, error) {
+	if len(gone) == 0 {
+		return 0, nil
+	}
+	if !trash {
+		fmt.Println(len(gone), "remote files are no longer in this repository")
+		fmt.Println("  (use 'veb push --trash' to move them into the remote's trash)")
+		fmt.Printf("\n")
+		return 0, nil
+	}
+
+	bins, err := veb.LoadTrash(tr, log)
+	if err != nil {
+		return 0, fmt.Errorf("veb could not load remote trash: %v", err)
+	}
+	bin := bins.NewBin(time.Now())
+
+	var retVal error = nil
+	fmt.Println("--------------")
+	fmt.Println("Trashed files:")
+	fmt.Println("--------------")
+	for _, f := range gone {
+		err = bins.Put(bin, f)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				fmt.Println("Error: could not trash", f.Path, ":", err)
+				retVal = fmt.Errorf("error moving files to remote trash")
+				continue
+			}
+			// already gone from the remote; just forget about it
+			log.Warn().Println("trashed file was already missing:", f.Path)
+		}
+		remote.Remove(f.Path)
+		fmt.Println(INDENT_F, f.Path)
+	}
+	fmt.Printf("\n")
+
+	// empty anything past retention
+	err = pruneTrash(bins, config, log)
+	if err != nil && retVal == nil {
+		retVal = err
+	}
+
+	err = bins.Save()
+	if err != nil && retVal == nil {
+		retVal = err
+	}
+	return len(bin.Files), retVal
+}
+
+// Empties trash bins past the retention set in config.
+func pruneTrash(bins *veb.Trash, config *veb.Config, log *veb.Log) error {
+	maxAge, err := veb.ParseAge(config.TrashMaxAge)
+	if err != nil {
+		return fmt.Errorf("veb config TrashMaxAge: %v", err)
+	}
+	maxSize, err := veb.ParseSize(config.TrashMaxSize)
+	if err != nil {
+		return fmt.Errorf("veb config TrashMaxSize: %v", err)
+	}
+
+	pruned, err := bins.Prune(maxAge, maxSize)
+	for _, b := range pruned {
+		fmt.Printf("emptied trash %s (%d files, %s)\n", b.Name, len(b.Files), ByteSize(b.Size()))
+		log.Info().Println("emptied trash", b.Name)
+	}
+	return err
+}
+
+// Deletes versions past the retention set in config.
+func pruneVersions(versions *veb.Versions, config *veb.Config, log *veb.Log) error {
+	maxAge, err := veb.ParseAge(config.VersionsMaxAge)
+	if err != nil {
+		return fmt.Errorf("veb config VersionsMaxAge: %v", err)
+	}
+	maxSize, err := veb.ParseSize(config.VersionsMaxSize)
+	if err != nil {
+		return fmt.Errorf("veb config VersionsMaxSize: %v", err)
+	}
+
+	pruned, err := versions.Prune(maxAge, config.VersionsMaxCount, maxSize)
+	if pruned > 0 {
+		fmt.Println("deleted", pruned, "old versions")
+		log.Info().Println("deleted", pruned, "old versions")
+	}
+	return err
+}
+
+// Lists the versions of file that the named (or default) remote has kept.
+func Versions(index *veb.Index, name, file string, log *veb.Log) error {
+	defer log.Un(log.Trace(VERSIONS))
+	var timer veb.Timer
+	timer.Start()
+
+	_, tr, _, err := openRemote(index, name, log)
+	if err != nil {
+		return err
+	}
+	defer tr.Close()
+	versions, err := veb.LoadVersions(tr, log)
+	if err != nil {
+		return fmt.Errorf("veb could not load remote versions: %v", err)
+	}
+
+	file = repoPath(index, file)
+	kept := versions.Files[file]
+	if len(kept) == 0 {
+		fmt.Println("The remote has no previous versions of", file)
+	} else {
+		fmt.Println("Previous versions of", file, "(newest first):")
+	}
+	for i := len(kept) - 1; i >= 0; i-- {
+		v := kept[i]
+		fmt.Printf("%s %x\n", INDENT_F, v.Entry.Xsum)
+		fmt.Printf("%s %s, modified on (%v)\n", INDENT_I, ByteSize(v.Entry.Size), v.Entry.ModTime)
+		fmt.Printf("%s replaced on (%v)\n", INDENT_I, v.Saved)
+		fmt.Printf("\n")
+	}
+	fmt.Println("  (use 'veb restore <file> --version=<checksum|date>' to get one back)")
+
+	// info log
+	timer.Stop()
+	log.Info().Printf("%s took %v\n", VERSIONS, timer.Duration())
+	return nil
+}
+
+// Copies a version of file that the named (or default) remote kept back into
+// the local repository, replacing the local copy.
+// which is a checksum (or unique prefix of one) or a date; see Versions.Find().
+func Restore(index *veb.Index, name, file, which string, log *veb.Log) error {
+	defer log.Un(log.Trace(RESTORE))
+	var timer veb.Timer
+	timer.Start()
+
+	_, tr, _, err := openRemote(index, name, log)
+	if err != nil {
+		return err
+	}
+	defer tr.Close()
+	versions, err := veb.LoadVersions(tr, log)
+	if err != nil {
+		return fmt.Errorf("veb could not load remote versions: %v", err)
+	}
+
+	file = repoPath(index, file)
+	v, err := versions.Find(file, which)
+	if err != nil {
+		return fmt.Errorf("veb could not find that version: %v", err)
+	}
+
+	// copy next to the file, then swap it in
+	err = veb.Fetch(tr, versions.Path(v.Entry.Xsum), v.Entry, path.Join(index.Root, file))
+	if err != nil {
+		log.Err().Println(err)
+		return fmt.Errorf("veb could not restore %s: %v", file, err)
+	}
+	fmt.Printf("restored %s to version %x (replaced on %v)\n", file, v.Entry.Xsum, v.Saved)
+	fmt.Println("  (use 'veb verify' to check it, and 'veb commit' to keep it)")
+
+	// info log
+	timer.Stop()
+	log.Info().Printf("%s %s took %v\n", RESTORE, file, timer.Duration())
+	return nil
+}
+
+// Lists, restores from, or empties the named (or default) remote's trash.
+//   list                       - lists all bins & their files
+//   restore <bin> [<file>...]  - copies trashed files back into the local repo
+//   empty [<bin>...]           - deletes the bins (all of them, if none given)
+func Trash(index *veb.Index, name, cmd string, args []string, log *veb.Log) error {
+	defer log.Un(log.Trace(TRASH))
+	var timer veb.Timer
+	timer.Start()
+
+	_, tr, _, err := openRemote(index, name, log)
+	if err != nil {
+		return err
+	}
+	defer tr.Close()
+	bins, err := veb.LoadTrash(tr, log)
+	if err != nil {
+		return fmt.Errorf("veb could not load remote trash: %v", err)
 	}
 
-	// make list of files to check
-	files := make(chan veb.IndexEntry, CHAN_SIZE)
-	numIgnored := 0
-	go func() {
-		for p, f := range local.Files {
-			// ignore if it's one of the new/changed files
-			_, skipL := locFilter[p]
-			_, skipR := remFilter[p]
-			if skipL || skipR {
-				numIgnored++
-			} else {
-				files <- f
+	switch cmd {
+	case TRASH_LIST:
+		if len(bins.Bins) == 0 {
+			fmt.Println("The remote's trash is empty.")
+		}
+		for _, b := range bins.Bins {
+			fmt.Printf("%s: %d files, %s\n", b.Name, len(b.Files), ByteSize(b.Size()))
+			for _, f := range sortedEntries(b.Files) {
+				fmt.Println(INDENT_F, f.Path)
 			}
+			fmt.Printf("\n")
 		}
-		close(files)
-	}()
 
-	// send files to remote if xsums differ
-	done := make(chan int, MAX_HANDLERS)
-	updates := make(chan veb.IndexEntry, CHAN_SIZE)
-	errored := make(chan veb.IndexEntry, CHAN_SIZE)
-	numErrored := 0
-	numPushed  := 0
-	numNoChange := 0
-	for i := 0; i < MAX_HANDLERS; i++ {
-		go func() {
-			for f := range files {
-				// compare checksum hashes
-				_, ok := remote.Files[f.Path] // does file exist in remote yet?
-				if ! ok || !bytes.Equal(f.Xsum, remote.Files[f.Path].Xsum) {
-					// TODO: verify f.Xsum == local file's actual xsum
-					//  - don't want corrupted files getting across.
-
-					err := pushFile(local.Root, remote.Root, f, log)
-					if err != nil {
-						// notify of error, but continue with rest of files
-						// TODO: get the error out too
-						errored <- f
-						numErrored++
-					} else {
-						// save entry so index can be updated
-						updates <- f
-						numPushed++
-					}
-				} else {
-					numNoChange++
-				}
+	case TRASH_RESTORE:
+		if len(args) == 0 {
+			return fmt.Errorf("veb trash restore needs a trash bin (see 'veb trash list')")
+		}
+		bin := bins.Bin(args[0])
+		if bin == nil {
+			return fmt.Errorf("veb trash has no bin named %s", args[0])
+		}
+		files := args[1:]
+		if len(files) == 0 {
+			for _, f := range sortedEntries(bin.Files) {
+				files = append(files, f.Path)
 			}
-			done <- 1
-		}()
-	}
+		}
 
-	// listeners
-	var retVal error = nil
-	numListeners := 3
-	quit := make(chan int, numListeners)
-	go func() {
-		for i := 0; i < MAX_HANDLERS; i++ {
-			<-done
+		var retVal error = nil
+		for _, p := range files {
+			f, ok := bin.Files[p]
+			if !ok {
+				fmt.Println("Error:", p, "is not in trash bin", bin.Name)
+				retVal = fmt.Errorf("veb could not restore all files")
+				continue
+			}
+			_, err = os.Lstat(path.Join(index.Root, f.Path))
+			if err == nil {
+				fmt.Println("Error:", f.Path, "already exists; not overwriting it")
+				retVal = fmt.Errorf("veb could not restore all files")
+				continue
+			}
+			err = veb.Fetch(tr, bins.Path(bin, f.Path), f, path.Join(index.Root, f.Path))
+			if err != nil {
+				log.Err().Println(err)
+				fmt.Println("Error: could not restore", f.Path, ":", err)
+				retVal = fmt.Errorf("veb could not restore all files")
+				continue
+			}
+			fmt.Println("restored", f.Path)
+		}
+		fmt.Println("  (use 'veb commit' to add restored files back into the repository)")
+		if retVal != nil {
+			return retVal
 		}
-		close(updates)
-		close(errored)
-		quit <- 1
-	}()
-	go func() {
-		for f := range errored {
-			// clear status line w/ 80 spaces & carriage return
-			fmt.Printf("\r%sError: could not push to remote: %s\n",
-				"                                                                                \r",
-				f.Path)
 
-			if retVal == nil {
-				retVal = fmt.Errorf("error transferring files to remote")
+	case TRASH_EMPTY:
+		empty := make([]*veb.TrashBin, 0)
+		if len(args) == 0 {
+			empty = append(empty, bins.Bins...)
+		}
+		for _, name := range args {
+			bin := bins.Bin(name)
+			if bin == nil {
+				return fmt.Errorf("veb trash has no bin named %s", name)
 			}
+			empty = append(empty, bin)
 		}
-		quit <- 1
-	}()
-	go func () {
-		first := true
-		for f := range updates {
-			if first {
-				fmt.Printf("%s%s\n%s\n%s\n",
-					"\r                                                                                \r",
-					"\n-------------",
-					"Pushed files:",
-					"-------------")
-				first = false
+		for _, b := range empty {
+			err = bins.Empty(b)
+			if err != nil {
+				return fmt.Errorf("veb could not empty trash %s: %v", b.Name, err)
 			}
-
-			// clear status line w/ 80 spaces & carriage return
-			fmt.Printf("\r%s%s %s\n",
-				"                                                                                \r",
-				INDENT_F, f.Path)
-			remote.Update(&f)
+			fmt.Printf("emptied trash %s (%d files, %s)\n", b.Name, len(b.Files), ByteSize(b.Size()))
+		}
+		err = bins.Save()
+		if err != nil {
+			return err
 		}
-		quit <- 1
-	}()
-
-	// print status while waiting for everyone to finish
-	for len(quit) < numListeners {
-		fmt.Printf("\rstatus: %4d ignored, %4d errors, %4d pushed, %4d unchanged",
-			numIgnored, numErrored, numPushed, numNoChange)
-	}	
 
-	// save remote index's updates
-	remote.Save()
+	default:
+		return fmt.Errorf("veb trash doesn't know how to %q (try %s, %s, or %s)",
+			cmd, TRASH_LIST, TRASH_RESTORE, TRASH_EMPTY)
+	}
 
-	// print outro
-	timer.Stop()
-	fmt.Println("\r                                                                                ")
-	fmt.Printf("status: %4d ignored, %4d errors, %4d pushed, %4d unchanged in %v\n",
-		numIgnored, numErrored, numPushed, numNoChange, timer.Duration())
-	
 	// info log
 	timer.Stop()
-	log.Info().Printf("%s (%d ignored, %d errors, %d pushed, %d unchanged) took %v\n",
-		PUSH, numIgnored, numErrored, numPushed, numNoChange, timer.Duration())
-	return retVal
+	log.Info().Printf("%s %s took %v\n", TRASH, cmd, timer.Duration())
+	return nil
+}
+
+// Parses a command's flags, allowing them to be mixed in with the command's
+// arguments, so flags don't have to come before everything else.
+// Returns the non-flag arguments.
+func parseCmd(flags *flag.FlagSet, args []string) []string {
+	rest := make([]string, 0)
+	for {
+		flags.Parse(args) // ExitOnError FlagSets exit instead of returning errors
+		args = flags.Args()
+		if len(args) == 0 {
+			return rest
+		}
+		rest = append(rest, args[0])
+		args = args[1:]
+	}
+}
+
+// Turns a file name given on the command line into an index path, relative to
+// the repository root.
+func repoPath(index *veb.Index, file string) string {
+	if !path.IsAbs(file) && WORK_DIR != "" {
+		// relative to where veb was run from, not where it cd'd to
+		file = path.Join(WORK_DIR, file)
+	}
+	if path.IsAbs(file) {
+		rel, err := filepath.Rel(index.Root, file)
+		if err == nil {
+			return rel
+		}
+	}
+	return path.Clean(file)
+}
+
+// Returns the first of args, or "" if there aren't any.
+func firstArg(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	return args[0]
+}
+
+// Returns entries sorted by path
+func sortedEntries(files map[string]veb.IndexEntry) []veb.IndexEntry {
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	ret := make([]veb.IndexEntry, 0, len(files))
+	for _, p := range paths {
+		ret = append(ret, files[p])
+	}
+	return ret
 }
 
 // Finds veb META_FOLDER and changes to that directory's parent.
@@ -944,64 +3379,455 @@ func cdBaseDir() (string, error) {
 // Calculates checksums of item in files chan, then puts file stats & xsum
 // of changed files out on the changed chan.
 // Does not look at file stats to determine change. This is purely about xsums.
-func verifyHandler(root string, files, changed chan veb.IndexEntry, done chan int, log *veb.Log) {
+// Notes the files it finishes in progress. Stops when ctx is cancelled.
+func verifyHandler(ctx context.Context, files chan veb.IndexEntry, changed chan verifyMismatch,
+	done chan int, progress *verifyProgress, check fileChecker) {
 	for f := range files {
-		// save off old xsum for comparison
-		oldXsum := f.Xsum
+		m, ok := check(ctx, &f)
+		if !ok {
+			break // interrupted partway through; f doesn't count
+		}
+		progress.done(f, m == nil)
+		if m != nil {
+			changed <- *m
+		}
+	}
+	done <- 1
+}
+
+// Checks one committed file for verifyHandler. Returns nil if it's good, and
+// false if ctx was cancelled before it could tell. Checkers that work out a
+// good file's block checksums leave them in f, to be saved in the index.
+type fileChecker func(ctx context.Context, f *veb.IndexEntry) (*verifyMismatch, bool)
+
+// Checks files in the local repository at root. Files bigger than blockSize
+// (if not 0) committed without block checksums get them.
+func localChecker(root string, blockSize int64, disk *veb.Limiter, log *veb.Log) fileChecker {
+	return func(ctx context.Context, committed *veb.IndexEntry) (*verifyMismatch, bool) {
+		// save off the committed entry for comparison
+		was := *committed
+		f := was
+		if len(f.Blocks) == 0 {
+			f.BlockSize = blocksFor(f.Size, blockSize)
+		}
 
 		// get file size & such
 		err := veb.SetStats(root, &f)
 		if err != nil {
 			log.Err().Println("couldn't get stats:", err)
+		} else {
+			// calculate checksum hash
+			err = veb.VerifyXsum(ctx, &f, disk, log)
+			if ctx.Err() != nil {
+				return nil, false
+			}
+			if err != nil {
+				log.Err().Println("checksum for verify failed:", err)
+			}
+		}
+
+		// see if it changed...
+		if err == nil && bytes.Equal(f.Xsum, was.Xsum) {
+			committed.BlockSize, committed.Blocks = f.BlockSize, f.Blocks
+			return nil, true
+		}
+		return &verifyMismatch{was, f, classify(root, was, f, err), err, "", veb.DamagedBlocks(&was, &f)}, true
+	}
+}
+
+// Checks copies of files on remote tr against the checksums in its index.
+// For bad copies, checks local's copy too (reading no faster than disk allows),
+// to say which one is good. Counts the files it had to read here in streamed.
+func remoteChecker(tr veb.Transport, local *veb.Index, disk *veb.Limiter, streamed *int64,
+	log *veb.Log) fileChecker {
+	return func(ctx context.Context, committed *veb.IndexEntry) (*verifyMismatch, bool) {
+		f := *committed
+		now := f
+		xsum, stream, err := veb.RemoteXsum(ctx, tr, f.Path)
+		if ctx.Err() != nil {
+			return nil, false
+		}
+		if stream {
+			atomic.AddInt64(streamed, 1)
+		}
+		now.Xsum = xsum
+		if err == nil && bytes.Equal(xsum, f.Xsum) {
+			return nil, true
 		}
 
-		// calculate checksum hash
-		err = veb.Xsum(&f, log)
+		// which copy is good?
+		m := &verifyMismatch{was: f, now: now, class: MISMATCH_CORRUPT, err: err}
 		if err != nil {
-			log.Err().Println("checksum for verify failed:", err)
+			log.Err().Println("couldn't check remote file:", err)
+			m.class = MISMATCH_UNREADABLE
+		}
+		have, ok := local.Files[f.Path]
+		switch {
+		case !ok:
+			m.note = "this repository doesn't have it; look for a good copy on another remote"
+		case err == nil && bytes.Equal(xsum, have.Xsum):
+			m.class = MISMATCH_MODIFIED
+			m.note = "the remote's copy matches this repository's checksum; its index is out of date"
+		case !bytes.Equal(have.Xsum, f.Xsum):
+			m.note = "this repository committed it differently, so can't vouch for either copy"
+		default:
+			err := veb.VerifyXsum(ctx, &have, disk, log)
+			if ctx.Err() != nil {
+				return nil, false
+			}
+			if err == nil && bytes.Equal(have.Xsum, f.Xsum) {
+				m.note = "this repository's copy is good"
+			} else {
+				m.note = "this repository's copy is bad too; look for a good copy on another remote"
+			}
 		}
+		return m, true
+	}
+}
 
-		// see if it changed...
-		if !bytes.Equal(f.Xsum, oldXsum) {
-			changed <- f
+// How 'veb scrub --repair' checks each file's remote copy along with its
+// local one, and replaces whichever is bad from whichever is good.
+type scrubRepair struct {
+	local    *veb.Index
+	repo     veb.Transport // the local repository, for repairing it
+	tr       veb.Transport
+	remote   *veb.Index
+	name     string          // remote's
+	bin      string          // quarantine folder, on both sides
+	edited   map[string]bool // changed on the remote since committed there; not repaired there
+	disk     *veb.Limiter
+	progress *verifyProgress // the remote's copies that were good
+	lock     sync.Mutex
+	restat   []veb.IndexEntry // the remote's copies that were repaired, with their new stats
+	log      *veb.Log
+}
+
+// Checks f here with check, then on the remote (if it has the same file
+// committed), repairing a bad copy from a good one. A file with no good copy,
+// or only good copies that aren't its committed contents (e.g. edited here and
+// not committed), is left alone.
+func (s *scrubRepair) checker(check fileChecker) fileChecker {
+	return func(ctx context.Context, committed *veb.IndexEntry) (*verifyMismatch, bool) {
+		m, ok := check(ctx, committed)
+		if !ok {
+			return nil, false
+		}
+		f := *committed
+		r, ok := s.remote.Files[f.Path]
+		if !ok || !bytes.Equal(r.Xsum, f.Xsum) || s.edited[f.Path] {
+			return m, true // no second copy to go by
+		}
+
+		xsum, _, err := veb.RemoteXsum(ctx, s.tr, f.Path)
+		if ctx.Err() != nil {
+			return nil, false
+		}
+		if err != nil {
+			s.log.Err().Println("couldn't check remote file:", err)
+		}
+		remoteGood := err == nil && bytes.Equal(xsum, f.Xsum)
+		if remoteGood {
+			s.progress.done(r, true)
+		}
+
+		switch {
+		case m == nil && remoteGood:
+			return nil, true
+		case m == nil:
+			// ours is good; theirs isn't
+			class := MISMATCH_CORRUPT
+			if err != nil {
+				class = MISMATCH_UNREADABLE
+			}
+			now := r
+			now.Xsum = xsum
+			q, rerr := s.repairRemote(ctx, r)
+			if ctx.Err() != nil {
+				return nil, false
+			}
+			if rerr != nil {
+				return &verifyMismatch{r, now, class, err, fmt.Sprintf(
+					"%s's copy is bad, and replacing it with this repository's good one failed: %v", s.name, rerr), nil}, true
+			}
+			s.progress.done(r, true)
+			if q == "" {
+				return &verifyMismatch{r, now, MISMATCH_REPAIRED, nil, fmt.Sprintf(
+					"missing on %s; restored from this repository's copy", s.name), nil}, true
+			}
+			return &verifyMismatch{r, now, MISMATCH_REPAIRED, nil, fmt.Sprintf(
+				"%s on %s; replaced with this repository's copy (the bad one is in %s there)",
+				mismatchKinds[class], s.name, q), nil}, true
+		case remoteGood && m.class != MISMATCH_MODIFIED && !os.IsNotExist(m.err):
+			// theirs is good; ours isn't
+			q, fetched, rerr := s.repairLocal(ctx, f)
+			if ctx.Err() != nil {
+				return nil, false
+			}
+			if rerr != nil {
+				m.note = fmt.Sprintf("%s's copy is good, but replacing this one with it failed: %v", s.name, rerr)
+				return m, true
+			}
+			m.note = fmt.Sprintf("%s here; replaced with %s's copy (the bad one is in %s)",
+				mismatchKinds[m.class], s.name, q)
+			if fetched < f.Size {
+				m.note = fmt.Sprintf("%s here; replaced the damaged blocks (%s) with %s's (the bad copy is in %s)",
+					mismatchKinds[m.class], ByteSize(fetched), s.name, q)
+			}
+			m.class, m.err = MISMATCH_REPAIRED, nil
+			return m, true
+		case !remoteGood:
+			m.note = fmt.Sprintf("%s's copy is bad too; look for a good copy on another remote", s.name)
 		}
+		return m, true
 	}
-	done <- 1
 }
 
-// Pushes local committed file that are changed/new to remote repository.
-// TODO: Don't use Copy. Use rsync. 'rsync -qa' perhaps.
-func pushFile(localRoot, remoteRoot string, entry veb.IndexEntry, log *veb.Log) error {
-	// open local file
-	local, err := os.Open(path.Join(localRoot, entry.Path))
+// Replaces the local copy of f with the remote's, restoring its committed
+// modification time so it doesn't look changed. If f has block checksums,
+// only the damaged blocks come from the remote. Returns where the bad copy
+// went, and how much came from the remote.
+func (s *scrubRepair) repairLocal(ctx context.Context, f veb.IndexEntry) (string, int64, error) {
+	var in io.ReadCloser
+	var patch *veb.BlockPatcher
+	if len(f.Blocks) > 0 {
+		file, err := os.Open(path.Join(s.local.Root, f.Path))
+		if err != nil {
+			return "", 0, err
+		}
+		defer file.Close()
+		patch = veb.PatchBlocks(ctx, s.tr, f.Path, file, f)
+		in = patch
+	} else {
+		var err error
+		in, err = s.tr.Open(f.Path)
+		if err != nil {
+			return "", 0, err
+		}
+	}
+	defer in.Close()
+	q, err := veb.Repair(s.repo, s.bin, f, s.disk.Reader(veb.ContextReader(ctx, in)))
 	if err != nil {
-		log.Err().Println(err)
-		return err
+		return "", 0, err
 	}
-	defer local.Close()
+	fetched := f.Size
+	if patch != nil {
+		fetched = patch.FetchedSize()
+	}
+	return q, fetched, os.Chtimes(path.Join(s.local.Root, f.Path), f.ModTime, f.ModTime)
+}
 
-	// make remote dirs, if they don't exist
-	err = os.MkdirAll(path.Dir(path.Join(remoteRoot, entry.Path)), 0755)
+// Replaces the remote's copy of r with the local one, noting its new stats.
+// Returns where the bad copy went.
+func (s *scrubRepair) repairRemote(ctx context.Context, r veb.IndexEntry) (string, error) {
+	in, err := veb.OpenUncached(path.Join(s.local.Root, r.Path))
 	if err != nil {
-		log.Err().Println(err)
-		return err
+		return "", err
+	}
+	defer in.Close()
+	q, err := veb.Repair(s.tr, s.bin, r, s.disk.Reader(veb.ContextReader(ctx, in)))
+	if err != nil {
+		return "", err
+	}
+	err = veb.StatEntry(s.tr, &r)
+	if err != nil {
+		s.log.Err().Println(err)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.restat = append(s.restat, r)
+	return q, nil
+}
+
+// Saves what's been verified & repaired on the remote to its index
+func (s *scrubRepair) save() error {
+	s.lock.Lock()
+	for _, r := range s.restat {
+		s.remote.Set(r)
 	}
+	s.restat = s.restat[:0]
+	s.lock.Unlock()
+	s.progress.record(s.remote)
 
-	// open remote file
-	remote, err := os.OpenFile(path.Join(remoteRoot, entry.Path),
-		os.O_WRONLY|os.O_TRUNC|os.O_CREATE, entry.Mode)
+	err := s.tr.SaveIndex(s.remote)
 	if err != nil {
-		log.Err().Println(err)
-		return err
+		s.log.Err().Println("could not save remote index:", err)
 	}
-	defer remote.Close()
+	return err
+}
 
-	// send it!
-	_, err = io.Copy(remote, local)
+// Kinds of files that failed verify, most worrying first. Each is also a bit
+// of verify's (& scrub's) exit code, like fsck's, so scripts can tell them
+// apart. Bit 1 means something else went wrong too.
+const (
+	MISMATCH_CORRUPT    = 1 << (iota + 1) // contents changed, but size & mtime didn't: bit rot
+	MISMATCH_ZEROED                       // all zeros now
+	MISMATCH_TRUNCATED                    // shorter now, but mtime didn't change
+	MISMATCH_UNREADABLE                   // missing, or couldn't be read
+	MISMATCH_MODIFIED                     // mtime changed: edited, and not committed since
+	MISMATCH_REPAIRED                     // was bad, but replaced with a good copy
+)
+
+var mismatchTitles = map[int]string{
+	MISMATCH_CORRUPT:    "CORRUPTION SUSPECTED (contents changed, but size & modification time didn't):",
+	MISMATCH_ZEROED:     "Zero-filled files (contents are all zeros now):",
+	MISMATCH_TRUNCATED:  "Truncated files (shorter now, but not modified):",
+	MISMATCH_UNREADABLE: "Unreadable files:",
+	MISMATCH_MODIFIED:   "Modified files (changed since last committed):",
+	MISMATCH_REPAIRED:   "Repaired files (bad copies replaced with good ones, and kept in quarantine):",
+}
+
+// What was wrong with a file, for notes about it
+var mismatchKinds = map[int]string{
+	MISMATCH_CORRUPT:    "corrupt",
+	MISMATCH_ZEROED:     "zero-filled",
+	MISMATCH_TRUNCATED:  "truncated",
+	MISMATCH_UNREADABLE: "unreadable",
+	MISMATCH_MODIFIED:   "modified",
+}
+
+// A file that failed verify
+type verifyMismatch struct {
+	was     veb.IndexEntry  // as committed
+	now     veb.IndexEntry  // as it is
+	class   int             // MISMATCH_*
+	err     error           // why it couldn't be read, if it couldn't
+	note    string          // more about it, if anything, instead of its stats
+	damaged []veb.ByteRange // which bytes are bad, if block checksums can say
+}
+
+// Works out what kind of mismatch a file that was committed as was, and is
+// now now, is. err is the error reading it, if any.
+func classify(root string, was, now veb.IndexEntry, err error) int {
+	sameTime := now.ModTime.Equal(was.ModTime)
+	switch {
+	case err != nil:
+		return MISMATCH_UNREADABLE
+	case now.Size > 0 && allZeros(path.Join(root, now.Path)):
+		return MISMATCH_ZEROED
+	case sameTime && now.Size < was.Size:
+		return MISMATCH_TRUNCATED
+	case sameTime:
+		return MISMATCH_CORRUPT
+	}
+	return MISMATCH_MODIFIED
+}
+
+// Whether file is nothing but zeros
+func allZeros(file string) bool {
+	f, err := veb.OpenUncached(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := f.Read(buf)
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return false
+			}
+		}
+		if err == io.EOF {
+			return true
+		}
+		if err != nil {
+			return false
+		}
+	}
+}
+
+// sort.Interface for ordering mismatches most worrying first, then by path
+type mismatchesBySeverity []verifyMismatch
+
+func (m mismatchesBySeverity) Len() int      { return len(m) }
+func (m mismatchesBySeverity) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
+func (m mismatchesBySeverity) Less(i, j int) bool {
+	if m[i].class != m[j].class {
+		return m[i].class < m[j].class
+	}
+	return m[i].now.Path < m[j].now.Path
+}
+
+// Error for files that didn't match, carrying the exit code for them
+type mismatchError struct {
+	classes int // MISMATCH_* bits, plus 1 if something else went wrong
+	msg     string
+}
+
+func (e *mismatchError) Error() string { return e.msg }
+func (e *mismatchError) ExitCode() int { return e.classes }
+
+// What verify's handlers have got through so far
+type verifyProgress struct {
+	lock  sync.Mutex
+	count int                     // files checked, good or not
+	bytes int64                   // their total size
+	good  map[string]verifiedFile // files that matched; not yet recorded in the index
+}
+
+// When a file was found to match, and its block checksums if they were
+// worked out then
+type verifiedFile struct {
+	when      time.Time
+	blockSize int64
+	blocks    [][]byte
+}
+
+// Notes that a file has been checked
+func (p *verifyProgress) done(f veb.IndexEntry, good bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.count++
+	p.bytes += f.Size
+	if good {
+		p.good[f.Path] = verifiedFile{time.Now(), f.BlockSize, f.Blocks}
+	}
+}
+
+// How many files have been checked, and their total size
+func (p *verifyProgress) checked() (int, int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.count, p.bytes
+}
+
+// Marks the good files as verified in index
+func (p *verifyProgress) record(index *veb.Index) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for path, v := range p.good {
+		f, ok := index.Files[path]
+		if ok {
+			f.LastVerified = v.when
+			f.VerifyCount++
+			if len(f.Blocks) == 0 && len(v.blocks) > 0 {
+				f.BlockSize, f.Blocks = v.blockSize, v.blocks
+			}
+			index.Set(f)
+		}
+		delete(p.good, path)
+	}
+}
+
+// Pushes local committed file that are changed/new to remote repository.
+// The remote checks what it gets against the entry's checksum before the file
+// replaces its copy.
+// Gives up partway through (and the remote throws the file away) if ctx is
+// cancelled.
+func pushFile(ctx context.Context, localRoot string, tr veb.Transport, entry veb.IndexEntry, log *veb.Log) error {
+	// open local file
+	local, err := os.Open(path.Join(localRoot, entry.Path))
 	if err != nil {
 		log.Err().Println(err)
 		return err
 	}
+	defer local.Close()
 
+	// send it!
+	err = tr.Write(entry, veb.ContextReader(ctx, local))
+	if err != nil && ctx.Err() == nil {
+		log.Err().Println(err)
+	}
 	return err
 }
@@ -0,0 +1,249 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Block checksums: with BlockSize in the config, a big file's IndexEntry
+// holds a checksum of each BlockSize piece of it as well as of the whole file.
+// Verify uses them to say which bytes of a damaged file are bad, and fix &
+// scrub --repair to get only those blocks from a remote instead of the whole
+// file. Anything else that wants to know which parts of two copies differ,
+// like sending only changed blocks, can use them too.
+
+package veb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+)
+
+const (
+	BLOCK_MIN = 64 * 1024 // smallest BlockSize
+)
+
+// Transports that can read part of a file without reading what's before it
+type RangeReader interface {
+	// Reads n bytes of file p, starting at off
+	OpenRange(p string, off, n int64) (io.ReadCloser, error)
+}
+
+// RangeReader.OpenRange's error from transports that wrap one that can't
+var ErrNoRange = errors.New("remote can't read part of a file")
+
+// The n bytes from off of a ranged GET's response. Servers that ignore the
+// range send the whole file, which is skipped through to get there.
+func rangeBody(resp *http.Response, off, n int64) (io.ReadCloser, error) {
+	if resp.StatusCode != http.StatusPartialContent {
+		_, err := io.CopyN(io.Discard, resp.Body, off)
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(resp.Body, n), resp.Body}, nil
+}
+
+// Checksums each size bytes written to it
+type blockHasher struct {
+	size   int64
+	hasher hash.Hash
+	n      int64 // bytes in hasher
+	sums   [][]byte
+}
+
+func newBlockHasher(size int64) *blockHasher {
+	return &blockHasher{size: size, hasher: NewHasher()}
+}
+
+func (b *blockHasher) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		n := b.size - b.n
+		if n > int64(len(p)) {
+			n = int64(len(p))
+		}
+		b.hasher.Write(p[:n])
+		b.n += n
+		p = p[n:]
+		if b.n == b.size {
+			b.sums = append(b.sums, b.hasher.Sum(nil))
+			b.hasher.Reset()
+			b.n = 0
+		}
+	}
+	return written, nil
+}
+
+// Checksums of every block, the last one maybe short. Nil for a nil b.
+func (b *blockHasher) Sums() [][]byte {
+	if b == nil {
+		return nil
+	}
+	if b.n > 0 || len(b.sums) == 0 {
+		b.sums = append(b.sums, b.hasher.Sum(nil))
+		b.hasher.Reset()
+		b.n = 0
+	}
+	return b.sums
+}
+
+// Which block i of entry's file is
+func blockRange(entry *IndexEntry, i int) ByteRange {
+	from := int64(i) * entry.BlockSize
+	to := from + entry.BlockSize
+	if to > entry.Size {
+		to = entry.Size
+	}
+	return ByteRange{from, to}
+}
+
+// Which parts of a file changed from was to now, by their block checksums.
+// Bytes now has past the end of was count as changed. Nil if the block
+// checksums can't say: either has none, or they use different block sizes.
+func DamagedBlocks(was, now *IndexEntry) []ByteRange {
+	if len(was.Blocks) == 0 || len(now.Blocks) == 0 || was.BlockSize != now.BlockSize {
+		return nil
+	}
+	damaged := make([]ByteRange, 0)
+	for i, sum := range was.Blocks {
+		if i >= len(now.Blocks) || !bytes.Equal(sum, now.Blocks[i]) || blockRange(now, i) != blockRange(was, i) {
+			damaged = addRange(damaged, blockRange(was, i))
+		}
+	}
+	if now.Size > was.Size {
+		damaged = addRange(damaged, ByteRange{was.Size, now.Size})
+	}
+	return damaged
+}
+
+// Reads entry's file as it was committed, block by block: from local where
+// local's block matches its checksum, and from file p on remote t where it
+// doesn't (or can't be read). Remote blocks are checked too, so a remote copy
+// damaged in the same place is an error rather than a bad file. Entry must
+// have block checksums; the remote's copy only needs the same Xsum.
+type BlockPatcher struct {
+	Fetched []ByteRange // parts of the file that came from the remote
+	ctx     context.Context
+	t       Transport
+	p       string
+	local   io.ReaderAt
+	entry   IndexEntry
+	next    int    // next block to read
+	buf     []byte // what's left of the last block read
+	stream  io.ReadCloser
+	at      int64 // where stream is in the file
+}
+
+func PatchBlocks(ctx context.Context, t Transport, p string, local io.ReaderAt, entry IndexEntry) *BlockPatcher {
+	return &BlockPatcher{ctx: ctx, t: t, p: p, local: local, entry: entry}
+}
+
+// Bytes of the file that came from the remote
+func (b *BlockPatcher) FetchedSize() int64 {
+	n := int64(0)
+	for _, r := range b.Fetched {
+		n += r.To - r.From
+	}
+	return n
+}
+
+func (b *BlockPatcher) Read(p []byte) (int, error) {
+	for len(b.buf) == 0 {
+		if b.next >= len(b.entry.Blocks) {
+			return 0, io.EOF
+		}
+		if err := b.ctx.Err(); err != nil {
+			return 0, err
+		}
+		err := b.block(b.next)
+		if err != nil {
+			return 0, err
+		}
+		b.next++
+	}
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	return n, nil
+}
+
+// Reads block i into buf, from wherever it's good
+func (b *BlockPatcher) block(i int) error {
+	r := blockRange(&b.entry, i)
+	want := b.entry.Blocks[i]
+	if int64(cap(b.buf)) < r.To-r.From {
+		b.buf = make([]byte, r.To-r.From)
+	}
+	b.buf = b.buf[:r.To-r.From]
+
+	n, _ := b.local.ReadAt(b.buf, r.From)
+	if n == len(b.buf) && blockSum(b.buf) == string(want) {
+		return nil
+	}
+
+	err := b.fetch(r.From)
+	if err != nil {
+		return fmt.Errorf("could not get bytes %d-%d of %s from the remote: %v", r.From, r.To-1, b.p, err)
+	}
+	if blockSum(b.buf) != string(want) {
+		return fmt.Errorf("the remote's copy of %s is damaged too, at bytes %d-%d", b.p, r.From, r.To-1)
+	}
+	b.Fetched = addRange(b.Fetched, r)
+	return nil
+}
+
+// Reads buf's worth of the remote's file at off: just that part if the
+// remote can, otherwise by reading through the file until it gets there
+func (b *BlockPatcher) fetch(off int64) error {
+	if rr, ok := b.t.(RangeReader); ok && b.stream == nil {
+		part, err := rr.OpenRange(b.p, off, int64(len(b.buf)))
+		if err != ErrNoRange {
+			if err != nil {
+				return err
+			}
+			defer part.Close()
+			_, err = io.ReadFull(ContextReader(b.ctx, part), b.buf)
+			return err
+		}
+	}
+
+	if b.stream != nil && b.at > off {
+		b.stream.Close()
+		b.stream = nil
+	}
+	if b.stream == nil {
+		stream, err := b.t.Open(b.p)
+		if err != nil {
+			return err
+		}
+		b.stream, b.at = stream, 0
+	}
+	in := ContextReader(b.ctx, b.stream)
+	skipped, err := io.CopyN(io.Discard, in, off-b.at)
+	b.at += skipped
+	if err != nil {
+		return err
+	}
+	n, err := io.ReadFull(in, b.buf)
+	b.at += int64(n)
+	return err
+}
+
+func (b *BlockPatcher) Close() error {
+	if b.stream != nil {
+		return b.stream.Close()
+	}
+	return nil
+}
+
+func blockSum(data []byte) string {
+	hasher := NewHasher()
+	hasher.Write(data)
+	return string(hasher.Sum(nil))
+}
@@ -0,0 +1,282 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// A bundle is a whole repository in one file, for cold storage (optical
+// media, a drive in a drawer at a relative's). It's a plain tar file, so it
+// can always be opened without veb:
+//   .veb/index   - the repository's index; always the first member
+//   .veb/xsums   - checksums of every file, in sha1sum's format
+//   .veb/config  - the repository's settings, if it has any
+//   <path>       - every committed file, by path
+// The index carries the checksums, so a bundle can be checked from start to
+// end in one pass without extracting anything.
+
+package veb
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// What was (or wasn't) wrong with a bundle, or with a repository being bundled
+type BundleReport struct {
+	Files   int      // good files
+	Bytes   int64    // their total size
+	Bad     []string // files that don't match their checksums
+	Missing []string // committed files that aren't there
+	Extra   []string // files in the bundle that aren't committed
+}
+
+// Whether nothing was wrong
+func (r *BundleReport) OK() bool {
+	return len(r.Bad) == 0 && len(r.Missing) == 0 && len(r.Extra) == 0
+}
+
+// Writes repository x as a bundle to w. Files that can't be read are
+// reported as Missing, and files that changed since they were committed as
+// Bad; a bundle with any of those isn't worth keeping.
+func WriteBundle(x *Index, w io.Writer, log *Log) (*BundleReport, error) {
+	tw := tar.NewWriter(w)
+	report := &BundleReport{}
+	entries := make([]IndexEntry, 0, len(x.Files))
+	for _, e := range x.Files {
+		entries = append(entries, e)
+	}
+	sort.Sort(entriesByPath(entries))
+
+	// metadata first
+	var index, xsums bytes.Buffer
+	err := gob.NewEncoder(&index).Encode(x)
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		xsums.WriteString(XsumString(&entries[i]))
+	}
+	err = bundleMeta(tw, INDEX_FILE, index.Bytes())
+	if err == nil {
+		err = bundleMeta(tw, XSUMS_FILE, xsums.Bytes())
+	}
+	if err != nil {
+		return nil, err
+	}
+	config, err := os.ReadFile(path.Join(x.Root, META_FOLDER, CONFIG_FILE))
+	if err == nil {
+		err = bundleMeta(tw, CONFIG_FILE, config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// then the files
+	for _, e := range entries {
+		err = bundleFile(tw, x.Root, e, report, log)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return report, tw.Close()
+}
+
+// Adds a META_FOLDER file to a bundle
+func bundleMeta(tw *tar.Writer, name string, data []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    path.Join(META_FOLDER, name),
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+// Adds a committed file to a bundle, checking it on the way in.
+// Only returns an error if the bundle itself is no good now.
+func bundleFile(tw *tar.Writer, root string, e IndexEntry, report *BundleReport, log *Log) error {
+	file, err := os.Open(path.Join(root, e.Path))
+	if err != nil {
+		log.Err().Println(err)
+		report.Missing = append(report.Missing, e.Path)
+		return nil
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || info.Size() != e.Size {
+		log.Err().Println(e.Path, "changed since it was committed")
+		report.Bad = append(report.Bad, e.Path)
+		return nil
+	}
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:    e.Path,
+		Mode:    int64(e.Mode.Perm()),
+		Size:    e.Size,
+		ModTime: e.ModTime,
+	})
+	if err != nil {
+		return err
+	}
+	hasher := NewHasher()
+	_, err = io.CopyN(tw, io.TeeReader(file, hasher), e.Size)
+	if err != nil {
+		return fmt.Errorf("%s: %v", e.Path, err)
+	}
+	if !bytes.Equal(hasher.Sum(nil), e.Xsum) {
+		log.Err().Println(e.Path, "doesn't match its checksum")
+		report.Bad = append(report.Bad, e.Path)
+		return nil
+	}
+
+	report.Files++
+	report.Bytes += e.Size
+	return nil
+}
+
+// Checks every file in a bundle against its checksum, without writing
+// anything. Returns the bundle's index, too.
+func VerifyBundle(r io.Reader) (*Index, *BundleReport, error) {
+	return readBundle(r, nil, func(_ string, entry IndexEntry, body io.Reader) (bool, error) {
+		hasher := NewHasher()
+		_, err := io.Copy(hasher, body)
+		if err != nil {
+			return false, err
+		}
+		return bytes.Equal(hasher.Sum(nil), entry.Xsum), nil
+	})
+}
+
+// Extracts a bundle into root, leaving out files that don't match their
+// checksums. Returns the bundle's index, set up as root's; the caller saves
+// it.
+func ExtractBundle(r io.Reader, root string, log *Log) (*Index, *BundleReport, error) {
+	err := os.MkdirAll(path.Join(root, META_FOLDER), 0755)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	meta := func(name string, data []byte) error {
+		if name != CONFIG_FILE {
+			return nil // the index & xsums get saved by the caller
+		}
+		return os.WriteFile(path.Join(root, META_FOLDER, name), data, 0644)
+	}
+	file := func(name string, entry IndexEntry, body io.Reader) (bool, error) {
+		dest := path.Join(root, name)
+		hasher := NewHasher()
+		err := writeLocal(dest, entry, io.TeeReader(body, hasher))
+		if err != nil {
+			if !bytes.Equal(hasher.Sum(nil), entry.Xsum) {
+				log.Err().Println(err)
+				return false, nil
+			}
+			return false, err
+		}
+		return true, os.Chtimes(dest, entry.ModTime, entry.ModTime)
+	}
+
+	x, report, err := readBundle(r, meta, file)
+	if err != nil {
+		return nil, nil, err
+	}
+	x.Root = root
+	x.log = log
+	return x, report, nil
+}
+
+// Reads a bundle, handing each META_FOLDER file after the index to meta (if
+// set) and each committed file, with its cleaned name, to file, which says
+// whether it was good.
+func readBundle(r io.Reader, meta func(name string, data []byte) error,
+	file func(name string, entry IndexEntry, body io.Reader) (bool, error)) (*Index, *BundleReport, error) {
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err == io.EOF || (err == nil && cleanPath(hdr.Name) != path.Join(META_FOLDER, INDEX_FILE)) {
+		return nil, nil, fmt.Errorf("not a veb bundle (it doesn't start with an index)")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var x Index
+	err = gob.NewDecoder(tr).Decode(&x)
+	if err != nil {
+		return nil, nil, fmt.Errorf("bad index in bundle: %v", err)
+	}
+	if x.Files == nil {
+		x.Files = make(map[string]IndexEntry)
+	}
+	if x.Remotes == nil {
+		x.Remotes = make(map[string]*Remote)
+	}
+	// a path like "../x" would be outside the repository
+	for key, entry := range x.Files {
+		if key == "" || cleanPath(key) != key || entry.Path != key || strings.HasPrefix(key, META_FOLDER+"/") {
+			return nil, nil, fmt.Errorf("bad index in bundle: bad path %q", entry.Path)
+		}
+	}
+
+	report := &BundleReport{}
+	seen := make(map[string]bool)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if !hdr.FileInfo().Mode().IsRegular() {
+			continue
+		}
+
+		name := cleanPath(hdr.Name)
+		if strings.HasPrefix(name, META_FOLDER+"/") {
+			if meta != nil {
+				data, err := io.ReadAll(tr)
+				if err == nil {
+					err = meta(path.Base(name), data)
+				}
+				if err != nil {
+					return nil, nil, err
+				}
+			}
+			continue
+		}
+
+		entry, ok := x.Files[name]
+		if !ok {
+			report.Extra = append(report.Extra, name)
+			continue
+		}
+		seen[name] = true
+		good, err := file(name, entry, tr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", name, err)
+		}
+		if good {
+			report.Files++
+			report.Bytes += entry.Size
+		} else {
+			report.Bad = append(report.Bad, name)
+		}
+	}
+
+	for p := range x.Files {
+		if !seen[p] {
+			report.Missing = append(report.Missing, p)
+		}
+	}
+	sort.Strings(report.Missing)
+	return &x, report, nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package veb
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto"
+	"encoding/gob"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A repository under a new folder with files of the given sizes committed
+func newTestBundleRepo(t *testing.T, files map[string]int) *Index {
+	root := newTestRepo(t)
+	x, err := New(crypto.SHA1, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x.log = testLog()
+	when := time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)
+	for p, size := range files {
+		entry, data := testFile(p, size)
+		entry.ModTime = when
+		err := writeLocal(filepath.Join(root, p), entry, bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		x.Files[p] = entry
+	}
+	return x
+}
+
+func TestBundleRoundTrip(t *testing.T) {
+	x := newTestBundleRepo(t, map[string]int{"a.mp3": 1000, "b/c.txt": 100, "b/d/e": 0})
+	var bundle bytes.Buffer
+	report, err := WriteBundle(x, &bundle, testLog())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Files != 3 || report.Bytes != 1100 {
+		t.Errorf("WriteBundle reported %+v, want 3 good files of 1100 bytes", report)
+	}
+
+	_, report, err = VerifyBundle(bytes.NewReader(bundle.Bytes()))
+	if err != nil || !report.OK() || report.Files != 3 {
+		t.Errorf("VerifyBundle reported %+v, %v; want 3 good files", report, err)
+	}
+
+	root := t.TempDir()
+	got, report, err := ExtractBundle(bytes.NewReader(bundle.Bytes()), root, testLog())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Files != 3 || got.Root != root || len(got.Files) != 3 {
+		t.Errorf("ExtractBundle reported %+v, with %d files in %s; want 3 good files in %s", report, len(got.Files), got.Root, root)
+	}
+	for p, entry := range x.Files {
+		data, err := os.ReadFile(filepath.Join(root, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, want := testFile(p, int(entry.Size))
+		if !bytes.Equal(data, want) {
+			t.Errorf("%s has %d bytes after extracting, not what was bundled", p, len(data))
+		}
+	}
+}
+
+// A file changed since it was committed is reported, not bundled
+func TestBundleChanged(t *testing.T) {
+	x := newTestBundleRepo(t, map[string]int{"a.mp3": 1000, "b.mp3": 500})
+	err := os.WriteFile(filepath.Join(x.Root, "a.mp3"), bytes.Repeat([]byte("x"), 1000), 0644)
+	if err == nil {
+		err = os.Remove(filepath.Join(x.Root, "b.mp3"))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := WriteBundle(x, &bytes.Buffer{}, testLog())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Bad) != 1 || report.Bad[0] != "a.mp3" || len(report.Missing) != 1 || report.Missing[0] != "b.mp3" {
+		t.Errorf("WriteBundle reported %+v, want a.mp3 bad & b.mp3 missing", report)
+	}
+}
+
+// A bundle whose index has entry under key, followed by a member for it
+func craftBundle(t *testing.T, key string, entry IndexEntry, data []byte) []byte {
+	x, err := New(crypto.SHA1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	x.Files[key] = entry
+	var index, bundle bytes.Buffer
+	err = gob.NewEncoder(&index).Encode(x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(&bundle)
+	err = bundleMeta(tw, INDEX_FILE, index.Bytes())
+	if err == nil {
+		err = tw.WriteHeader(&tar.Header{Name: key, Mode: 0644, Size: int64(len(data))})
+	}
+	if err == nil {
+		_, err = tw.Write(data)
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bundle.Bytes()
+}
+
+// Paths that would land outside of the repository, or in its META_FOLDER, are
+// refused before anything is extracted
+func TestBundleBadPaths(t *testing.T) {
+	for _, test := range []struct{ key, path string }{
+		{"../x", "../x"},
+		{"a/../../x", "a/../../x"},
+		{"", ""},
+		{"a", "b"},
+		{"./a", "./a"},
+		{"a//b", "a//b"},
+		{META_FOLDER + "/" + CONFIG_FILE, META_FOLDER + "/" + CONFIG_FILE},
+	} {
+		entry, data := testFile(test.path, 10)
+		bundle := craftBundle(t, test.key, entry, data)
+
+		_, _, err := VerifyBundle(bytes.NewReader(bundle))
+		if err == nil || !strings.Contains(err.Error(), "bad path") {
+			t.Errorf("VerifyBundle with %q for %q: %v, want a bad path error", test.key, test.path, err)
+		}
+
+		parent := t.TempDir()
+		root := path.Join(parent, "repo")
+		_, _, err = ExtractBundle(bytes.NewReader(bundle), root, testLog())
+		if err == nil || !strings.Contains(err.Error(), "bad path") {
+			t.Errorf("ExtractBundle with %q for %q: %v, want a bad path error", test.key, test.path, err)
+		}
+		if _, err := os.Stat(filepath.Join(parent, "x")); !os.IsNotExist(err) {
+			t.Errorf("ExtractBundle with %q wrote outside of the repository", test.key)
+		}
+		if _, err := os.Stat(filepath.Join(root, META_FOLDER, CONFIG_FILE)); !os.IsNotExist(err) {
+			t.Errorf("ExtractBundle with %q wrote into %s", test.key, META_FOLDER)
+		}
+	}
+}
+
+func TestBundleNotABundle(t *testing.T) {
+	var bundle bytes.Buffer
+	tw := tar.NewWriter(&bundle)
+	tw.WriteHeader(&tar.Header{Name: "a.mp3", Mode: 0644})
+	tw.Close()
+	_, _, err := VerifyBundle(&bundle)
+	if err == nil {
+		t.Errorf("VerifyBundle of a tar file without an index worked")
+	}
+}
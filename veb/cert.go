@@ -0,0 +1,227 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// TLS certificates for 'veb serve' and how each end decides to trust the other.
+//
+// A server without a certificate of its own gets a self-signed one, made once
+// and kept in the user's config folder. Clients trust a server by its
+// certificate's fingerprint, by a CA file, or by the system's CAs, picked with
+// the remote URL's query:
+//   veb://nas:7419/music?fingerprint=<sha256 hex>
+//   veb://nas:7419/music?ca=/path/to/ca.pem
+//
+// Clients present the same default certificate (so each machine has one), and
+// the server only lets in clients whose fingerprints are in its clients file,
+// one per line, like ssh's authorized_keys.
+
+package veb
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	SERVE_CERT    = "serve-cert.pem" // default certificate, in the user's veb config folder
+	SERVE_KEY     = "serve-key.pem"  // its private key
+	SERVE_CLIENTS = "serve-clients"  // fingerprints of the clients 'veb serve' lets in
+)
+
+// Loads the server's certificate. With no files given, loads the default
+// self-signed certificate, making it first if there isn't one yet.
+func LoadServeCert(certFile, keyFile string) (tls.Certificate, error) {
+	if certFile != "" || keyFile != "" {
+		return tls.LoadX509KeyPair(certFile, keyFile)
+	}
+
+	dir, err := configDir()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	certFile = filepath.Join(dir, SERVE_CERT)
+	keyFile = filepath.Join(dir, SERVE_KEY)
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err == nil || !os.IsNotExist(err) {
+		return cert, err
+	}
+	err = makeServeCert(dir, certFile, keyFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("veb could not make a certificate: %v", err)
+	}
+	return tls.LoadX509KeyPair(certFile, keyFile)
+}
+
+// Makes a self-signed certificate & key
+func makeServeCert(dir, certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	host, _ := os.Hostname()
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "veb serve " + host},
+		DNSNames:     []string{host, "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(20, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// The user's veb config folder, where the default certificate is kept
+func configDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "veb"), nil
+}
+
+// Returns the certificate's SHA-256 fingerprint, in hex
+func CertFingerprint(cert tls.Certificate) string {
+	return fingerprint(cert.Certificate[0])
+}
+
+func fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// A fingerprint as CertFingerprint writes it, from hex with or without colons
+func normalFingerprint(fp string) string {
+	return strings.ToLower(strings.Replace(fp, ":", "", -1))
+}
+
+// Loads the fingerprints of the clients 'veb serve' lets in, one per line,
+// ignoring anything after a #. With no file given, loads the default one from
+// the user's config folder. A missing file lets no one in. Also returns the
+// file's name, for telling the user where to add clients.
+func LoadClientFingerprints(file string) (map[string]bool, string, error) {
+	if file == "" {
+		dir, err := configDir()
+		if err != nil {
+			return nil, "", err
+		}
+		file = filepath.Join(dir, SERVE_CLIENTS)
+	}
+
+	clients := make(map[string]bool)
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return clients, file, nil
+	}
+	if err != nil {
+		return nil, file, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if fp := strings.TrimSpace(line); fp != "" {
+			clients[normalFingerprint(fp)] = true
+		}
+	}
+	return clients, file, nil
+}
+
+// Returns the TLS config for 'veb serve': its certificate, and only clients
+// with certificates in clients let in.
+func ServeTLS(cert tls.Certificate, clients map[string]bool) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		// clients are trusted by fingerprint, not by who signed their certificate
+		ClientAuth: tls.RequireAnyClientCert,
+		VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+			if len(raw) == 0 {
+				return fmt.Errorf("client sent no certificate")
+			}
+			if fp := fingerprint(raw[0]); !clients[fp] {
+				return fmt.Errorf("client certificate %s isn't in the clients file", fp)
+			}
+			return nil
+		},
+	}
+}
+
+// Returns the TLS config for reaching the server in u, trusting what u's query
+// says to trust, and showing the server this machine's default certificate.
+func clientTLS(u *url.URL) (*tls.Config, error) {
+	cert, err := LoadServeCert("", "")
+	if err != nil {
+		return nil, fmt.Errorf("veb could not load its client certificate: %v", err)
+	}
+	config := &tls.Config{
+		ServerName:   u.Hostname(),
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	query := u.Query()
+
+	if fp := query.Get("fingerprint"); fp != "" {
+		want := normalFingerprint(fp)
+		// the fingerprint check replaces the usual chain & name checks
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+			if len(raw) == 0 {
+				return fmt.Errorf("veb server sent no certificate")
+			}
+			if fingerprint(raw[0]) != want {
+				return fmt.Errorf("veb server's certificate doesn't match fingerprint %s", fp)
+			}
+			return nil
+		}
+	}
+
+	if ca := query.Get("ca"); ca != "" {
+		pem, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", ca)
+		}
+	}
+
+	return config, nil
+}
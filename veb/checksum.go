@@ -7,6 +7,8 @@
 package veb
 
 import (
+	"context"
+	"hash"
 	"io"
 	"os"
 	"crypto/sha1"
@@ -19,28 +21,66 @@ import (
 // checksum of supplied entry is added to the entry itself
 // TODO: take in root string
 func Xsum(entry *IndexEntry, log *Log) error {
-	// TODO: make hasher from supplied crypto.Hash
-	// - crypto.Available(), crypto.New()
-	hasher := sha1.New()
+	return LimitedXsum(context.Background(), entry, nil, log)
+}
+
+// Xsum, reading the file no faster than limiter allows. Gives up partway
+// through the file (with ctx's error) if ctx is cancelled.
+func LimitedXsum(ctx context.Context, entry *IndexEntry, limiter *Limiter, log *Log) error {
+	return xsum(ctx, entry, openFile, limiter, log)
+}
+
+// LimitedXsum, but reading the file from the disk instead of the page cache
+// where it can (see OpenUncached), so a file that was just written is checked
+// as it was stored, not as it's remembered.
+func VerifyXsum(ctx context.Context, entry *IndexEntry, limiter *Limiter, log *Log) error {
+	return xsum(ctx, entry, OpenUncached, limiter, log)
+}
+
+func openFile(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
 
-	file, err := os.Open(entry.Path)
+func xsum(ctx context.Context, entry *IndexEntry, open func(string) (io.ReadCloser, error),
+	limiter *Limiter, log *Log) error {
+	hasher := NewHasher()
+
+	file, err := open(entry.Path)
 	if err != nil {
 		log.Err().Println(err)
 		return err
 	}
 	defer file.Close()
 
-	_, err = io.Copy(hasher, file)
+	// and each block, if the entry has block checksums
+	var blocks *blockHasher
+	w := io.Writer(hasher)
+	if entry.BlockSize > 0 {
+		blocks = newBlockHasher(entry.BlockSize)
+		w = io.MultiWriter(hasher, blocks)
+	}
+
+	_, err = io.Copy(w, limiter.Reader(ContextReader(ctx, file)))
 	if err != nil {
-		log.Err().Println(err)
+		if ctx.Err() == nil {
+			log.Err().Println(err)
+		}
 		return err
 	}
 
 	entry.Xsum = hasher.Sum(nil)
+	entry.Blocks = blocks.Sums()
 
 	return err
 }
 
+// returns a hasher for computing veb checksums
+func NewHasher() hash.Hash {
+	// TODO: make hasher from supplied crypto.Hash
+	// - crypto.Available(), crypto.New()
+	return sha1.New()
+}
+
 // returns xsum in shasum formatted string (<ASCII hex hash> <filepath>)
 func XsumString(entry *IndexEntry) string {
 	// shasum format
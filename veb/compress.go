@@ -0,0 +1,163 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// CompressTransport gzips files on their way to a remote that has Compress
+// set in its config, and gunzips them on the way back. Files that are already
+// compressed (photos, music, video, archives...) are sent as they are; they're
+// found by extension, or by sniffing their first bytes.
+//
+// Compressed files start with COMPRESS_MAGIC, so each file on the remote says
+// how it was stored, and files pushed before or after compression was turned
+// on or off all read back the same. The rare file that starts with
+// COMPRESS_MAGIC by itself is always compressed, so it can't be mistaken.
+//
+// Checksums are of the files as they were committed, not as they're stored,
+// so verify works just the same. The sizes of a remote's files are what they
+// take up there, which is also what push's Quota check counts.
+
+package veb
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+)
+
+const (
+	COMPRESS_GZIP  = "gzip"     // RemoteConfig.Compress value
+	COMPRESS_MAGIC = "VEBZ\x01" // start of every compressed file
+	COMPRESS_SNIFF = 512        // bytes looked at to see if a file is compressed already
+	COMPRESS_MIN   = 1024       // files smaller than this aren't worth it
+)
+
+// Extensions of files that are compressed already
+var compressedExts = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".heic": true,
+	".mp3": true, ".m4a": true, ".aac": true, ".ogg": true, ".opus": true, ".flac": true,
+	".mp4": true, ".m4v": true, ".mov": true, ".mkv": true, ".avi": true, ".webm": true,
+	".zip": true, ".gz": true, ".tgz": true, ".bz2": true, ".xz": true, ".zst": true,
+	".7z": true, ".rar": true, ".jar": true, ".dmg": true,
+	".docx": true, ".xlsx": true, ".pptx": true, ".odt": true, ".epub": true,
+}
+
+// Content types (as http.DetectContentType() names them) of compressed files
+var compressedTypes = []string{
+	"image/jpeg", "image/png", "image/gif", "image/webp",
+	"audio/mpeg", "application/ogg", "video/",
+	"application/zip", "application/x-gzip", "application/x-rar-compressed",
+	"font/woff",
+}
+
+type CompressTransport struct {
+	Transport      // the remote's own transport
+	compress  bool // compress what's written, where it helps
+	log       *Log // error/warn/info logging
+}
+
+// Wraps t in a CompressTransport if config says to compress, or if the remote
+// (whose index is x) has compressed files already.
+func WrapCompress(t Transport, x *Index, config *RemoteConfig, log *Log) (Transport, error) {
+	switch config.Compress {
+	case "":
+		if !x.Compressed {
+			return t, nil
+		}
+	case COMPRESS_GZIP:
+	default:
+		return nil, fmt.Errorf("veb can't compress with %q (only %q)", config.Compress, COMPRESS_GZIP)
+	}
+	return &CompressTransport{t, config.Compress != "", log}, nil
+}
+
+// Marks the remote as having compressed files before saving its index, so
+// they get read back properly even once compression is turned off.
+func (t *CompressTransport) SaveIndex(x *Index) error {
+	if t.compress {
+		x.Compressed = true
+	}
+	return t.Transport.SaveIndex(x)
+}
+
+func (t *CompressTransport) Open(p string) (io.ReadCloser, error) {
+	file, err := t.Transport.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(file)
+	head, _ := r.Peek(len(COMPRESS_MAGIC))
+	if string(head) != COMPRESS_MAGIC {
+		return struct {
+			io.Reader
+			io.Closer
+		}{r, file}, nil
+	}
+
+	r.Discard(len(COMPRESS_MAGIC))
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %v", p, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{gz, file}, nil
+}
+
+// Writes r compressed, if it's worth it. The remote can't check compressed
+// files against entry.Xsum, so r is checked here as it's compressed instead:
+// if it doesn't match, the stream fails at the end and the remote throws it
+// away.
+func (t *CompressTransport) Write(entry IndexEntry, r io.Reader) error {
+	in := bufio.NewReaderSize(r, COMPRESS_SNIFF)
+	head, _ := in.Peek(COMPRESS_SNIFF)
+	if !bytes.HasPrefix(head, []byte(COMPRESS_MAGIC)) &&
+		(!t.compress || !worthCompressing(entry, head)) {
+		return t.Transport.Write(entry, in)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		hasher := NewHasher()
+		pw.Write([]byte(COMPRESS_MAGIC))
+		gz := gzip.NewWriter(pw)
+		_, err := io.Copy(gz, io.TeeReader(in, hasher))
+		if cerr := gz.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil && entry.Xsum != nil && !bytes.Equal(hasher.Sum(nil), entry.Xsum) {
+			err = fmt.Errorf("%s doesn't match its checksum", entry.Path)
+		}
+		pw.CloseWithError(err)
+	}()
+
+	out := entry
+	out.Xsum = nil
+	out.Size = 0 // not known until it's compressed
+	err := t.Transport.Write(out, pr)
+	pr.Close() // stops the compressing if Write gave up early
+	return err
+}
+
+// Whether a file, which starts with head, is likely to get any smaller
+func worthCompressing(entry IndexEntry, head []byte) bool {
+	if len(head) < COMPRESS_SNIFF || (entry.Size > 0 && entry.Size < COMPRESS_MIN) {
+		return false // tiny
+	}
+	if compressedExts[strings.ToLower(path.Ext(entry.Path))] {
+		return false
+	}
+	kind := http.DetectContentType(head)
+	for _, t := range compressedTypes {
+		if strings.HasPrefix(kind, t) {
+			return false
+		}
+	}
+	return true
+}
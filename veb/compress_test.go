@@ -0,0 +1,149 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package veb
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// size bytes starting with head, padded with zeros
+func sniffData(head string, size int) []byte {
+	data := make([]byte, size)
+	copy(data, head)
+	return data
+}
+
+func TestWorthCompressing(t *testing.T) {
+	text := []byte(strings.Repeat("all work and no play makes veb a dull program\n", 100))
+	tests := []struct {
+		path  string
+		size  int64
+		data  []byte
+		worth bool
+	}{
+		{"notes.txt", int64(len(text)), text, true},
+		{"notes", 0, text, true},                     // size not known
+		{"small.txt", 100, text, false},              // too small to bother
+		{"short.txt", 10, text[:10], false},          // not enough to sniff
+		{"photo.JPG", int64(len(text)), text, false}, // by extension
+		{"album.zip", int64(len(text)), text, false},
+		// by sniffing
+		{"a.dat", 4096, sniffData("\xff\xd8\xff\xe0", 4096), false},
+		{"b.dat", 4096, sniffData("\x89PNG\r\n\x1a\n", 4096), false},
+		{"c.dat", 4096, sniffData("GIF89a", 4096), false},
+		{"d.dat", 4096, sniffData("ID3", 4096), false},
+		{"e.dat", 4096, sniffData("PK\x03\x04", 4096), false},
+		{"f.dat", 4096, sniffData("\x1f\x8b\x08", 4096), false},
+		{"g.dat", 4096, sniffData("OggS\x00", 4096), false},
+		{"h.dat", 4096, sniffData("%PDF-1.4", 4096), true},
+	}
+	for _, test := range tests {
+		entry := IndexEntry{Path: test.path, Size: test.size}
+		head := test.data
+		if len(head) > COMPRESS_SNIFF {
+			head = head[:COMPRESS_SNIFF]
+		}
+		if worth := worthCompressing(entry, head); worth != test.worth {
+			t.Errorf("worthCompressing(%s) = %v, want %v", test.path, worth, test.worth)
+		}
+	}
+}
+
+// A CompressTransport on a new repository, and the LocalTransport under it
+func newTestCompress(t *testing.T, compress string) (string, Transport, *LocalTransport) {
+	root := newTestRepo(t)
+	lt := NewLocalTransport(root, testLog())
+	ct, err := WrapCompress(lt, &Index{}, &RemoteConfig{Compress: compress}, testLog())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root, ct, lt
+}
+
+// Writes data to p through tr, & checks it reads back the same
+func compressRoundTrip(t *testing.T, tr Transport, p string, data []byte) {
+	t.Helper()
+	hasher := NewHasher()
+	hasher.Write(data)
+	entry := IndexEntry{Path: p, Size: int64(len(data)), Mode: 0640, Xsum: hasher.Sum(nil)}
+	err := tr.Write(entry, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := tr.Open(p)
+	if got := readAll(t, r, err); !bytes.Equal(got, data) {
+		t.Errorf("%s reads back %d bytes, not the %d written", p, len(got), len(data))
+	}
+}
+
+func TestCompressTransport(t *testing.T) {
+	root, ct, lt := newTestCompress(t, COMPRESS_GZIP)
+	stored := func(p string) []byte {
+		data, err := os.ReadFile(filepath.Join(root, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	text := []byte(strings.Repeat("all work and no play makes veb a dull program\n", 100))
+	compressRoundTrip(t, ct, "notes.txt", text)
+	if got := stored("notes.txt"); !bytes.HasPrefix(got, []byte(COMPRESS_MAGIC)) || len(got) >= len(text) {
+		t.Errorf("notes.txt is stored as %d bytes, want it compressed", len(got))
+	}
+
+	jpeg := sniffData("\xff\xd8\xff\xe0", 4096)
+	compressRoundTrip(t, ct, "photo.dat", jpeg)
+	if got := stored("photo.dat"); !bytes.Equal(got, jpeg) {
+		t.Errorf("photo.dat is stored as %d bytes, want it as it was", len(got))
+	}
+
+	// too small to compress, but it can't be stored as it is either
+	magic := []byte(COMPRESS_MAGIC + "not really")
+	compressRoundTrip(t, ct, "magic", magic)
+	if got := stored("magic"); bytes.Equal(got, magic) {
+		t.Errorf("file starting with %q was stored as it was", COMPRESS_MAGIC)
+	}
+
+	// without compression, compressed files still read back
+	plain, err := WrapCompress(lt, &Index{Compressed: true}, &RemoteConfig{}, testLog())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := plain.Open("notes.txt")
+	if got := readAll(t, r, err); !bytes.Equal(got, text) {
+		t.Errorf("notes.txt reads back %d bytes with compression off, not %d", len(got), len(text))
+	}
+
+	// a bad checksum fails the write, & leaves nothing behind
+	entry := IndexEntry{Path: "bad.txt", Size: int64(len(text)), Xsum: []byte("not its checksum")}
+	err = ct.Write(entry, bytes.NewReader(text))
+	if err == nil {
+		t.Errorf("Write of a file that doesn't match its checksum worked")
+	}
+	if _, err := os.Stat(filepath.Join(root, "bad.txt")); !os.IsNotExist(err) {
+		t.Errorf("file that doesn't match its checksum was stored: %v", err)
+	}
+}
+
+func TestWrapCompress(t *testing.T) {
+	lt := NewLocalTransport(t.TempDir(), testLog())
+	tr, err := WrapCompress(lt, &Index{}, &RemoteConfig{}, testLog())
+	if err != nil || tr != Transport(lt) {
+		t.Errorf("WrapCompress without Compress gave %T, %v; want the transport as it was", tr, err)
+	}
+	tr, err = WrapCompress(lt, &Index{Compressed: true}, &RemoteConfig{}, testLog())
+	if _, ok := tr.(*CompressTransport); err != nil || !ok {
+		t.Errorf("WrapCompress of a remote with compressed files gave %T, %v; want a CompressTransport", tr, err)
+	}
+	_, err = WrapCompress(lt, &Index{}, &RemoteConfig{Compress: "lzma"}, testLog())
+	if err == nil {
+		t.Errorf("WrapCompress with Compress %q worked", "lzma")
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Config holds the user-editable settings of a veb repository. Unlike the
+// index, it is saved as JSON so it can be changed with a text editor.
+
+package veb
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CONFIG_FILE = "config" // inside of META_FOLDER only
+)
+
+// Repository settings. Empty strings mean "use the default".
+type Config struct {
+	// Retention rules for the remote's trash. Checked after every push.
+	TrashMaxAge  string // e.g. "90d". Older trash is emptied.
+	TrashMaxSize string // e.g. "100GB". Oldest trash is emptied until under.
+
+	// Remote files that push overwrites are kept as versions, unless NoVersions.
+	// Retention rules are checked after every push.
+	NoVersions       bool
+	VersionsMaxAge   string // e.g. "1y". Older versions are deleted.
+	VersionsMaxCount int    // versions kept per file. 0 = no limit.
+	VersionsMaxSize  string // e.g. "50GB". Oldest versions are deleted until under.
+
+	// Most bytes per second push, pull & verify read or write on this disk,
+	// e.g. "20MB", or by time of day (see Limiter). Empty = no limit.
+	IOLimit string `json:",omitempty"`
+
+	// How long nightly 'veb scrub's take to get through the whole repository,
+	// e.g. "30d". Empty = 30 days.
+	ScrubPeriod string `json:",omitempty"`
+
+	// How much parity 'veb parity create' makes, as a percent of each file's
+	// size. 0 = 10%.
+	ParityPercent int `json:",omitempty"`
+
+	// Files bigger than this also get a checksum of each piece this size,
+	// e.g. "4MB", so verify can say which bytes of a damaged file are bad
+	// and fix & scrub --repair get only those from a remote. Empty = none.
+	BlockSize string `json:",omitempty"`
+
+	// Settings for each remote, by remote name
+	Remotes map[string]*RemoteConfig `json:",omitempty"`
+
+	root string // root of this veb repository
+	log  *Log   // error/warn/info logging
+}
+
+// Settings for one remote
+type RemoteConfig struct {
+	Quota string // e.g. "2TB". Push won't let the remote grow past this.
+
+	// "gzip" to compress files pushed to the remote, where it helps
+	Compress string `json:",omitempty"`
+
+	// Most bytes per second push & pull send to or get from the remote, e.g.
+	// "2MB", or by time of day (see Limiter). Empty = no limit.
+	BwLimit string `json:",omitempty"`
+
+	// The remote is encrypted (see CryptTransport), and veb refuses to use it
+	// if it isn't. Its key is read from KeyFile, or $VEB_PASSPHRASE if unset.
+	Encrypt bool   `json:",omitempty"`
+	KeyFile string `json:",omitempty"`
+}
+
+// Creates a new Config with default settings
+func NewConfig(root string, log *Log) *Config {
+	return &Config{Remotes: make(map[string]*RemoteConfig), root: root, log: log}
+}
+
+// Returns the settings for the named remote. Remotes without any settings
+// get the defaults.
+func (c *Config) Remote(name string) *RemoteConfig {
+	r, ok := c.Remotes[name]
+	if !ok {
+		return &RemoteConfig{}
+	}
+	return r
+}
+
+// Moves a remote's settings to its new name
+func (c *Config) RenameRemote(from, to string) {
+	r, ok := c.Remotes[from]
+	if ok {
+		delete(c.Remotes, from)
+		c.Remotes[to] = r
+	}
+}
+
+// Forgets a remote's settings
+func (c *Config) RemoveRemote(name string) {
+	delete(c.Remotes, name)
+}
+
+// Reads the config in from the config file.
+// A missing config file is not an error; the defaults are returned instead.
+func LoadConfig(root string, log *Log) (*Config, error) {
+	ret := NewConfig(root, log)
+
+	file, err := os.Open(path.Join(root, META_FOLDER, CONFIG_FILE))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ret, nil
+		}
+		log.Err().Println(err)
+		return nil, err
+	}
+	defer file.Close()
+
+	dec := json.NewDecoder(file)
+	err = dec.Decode(ret)
+	if err != nil {
+		log.Err().Println("couldn't load config:", err)
+		return nil, fmt.Errorf("veb could not read %s: %v", CONFIG_FILE, err)
+	}
+	if ret.Remotes == nil {
+		ret.Remotes = make(map[string]*RemoteConfig)
+	}
+
+	return ret, nil
+}
+
+// Saves config to file as indented JSON
+func (c *Config) Save() error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		c.log.Err().Println("couldn't save config:", err)
+		return err
+	}
+	data = append(data, '\n')
+
+	file, err := os.Create(path.Join(c.root, META_FOLDER, CONFIG_FILE))
+	if err != nil {
+		c.log.Err().Println(err)
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(data)
+	if err != nil {
+		c.log.Err().Println(err)
+	}
+	return err
+}
+
+// Parses an age like "90d", "2w" or "36h". Zero is returned for "".
+// Understands everything time.ParseDuration does, plus days (d), weeks (w) and
+// years (y).
+func ParseAge(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+
+	units := map[byte]time.Duration{
+		'd': 24 * time.Hour,
+		'w': 7 * 24 * time.Hour,
+		'y': 365 * 24 * time.Hour,
+	}
+	if unit, ok := units[s[len(s)-1]]; ok {
+		n, err := strconv.ParseFloat(s[:len(s)-1], 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid age: %q", s)
+		}
+		return time.Duration(n * float64(unit)), nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid age: %q", s)
+	}
+	return d, nil
+}
+
+// Parses a size like "100GB", "4MiB", "512k" or "1024" (bytes) into bytes.
+// Zero is returned for "". Units are powers of 1024, like ByteSize in main.
+func ParseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+
+	// split number & unit
+	i := 0
+	for i < len(s) && (s[i] == '.' || (s[i] >= '0' && s[i] <= '9')) {
+		i++
+	}
+	n, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: %q", s)
+	}
+
+	unit := strings.ToUpper(strings.TrimSpace(s[i:]))
+	unit = strings.TrimSuffix(strings.TrimSuffix(unit, "B"), "I")
+	shift := strings.Index("_KMGTPE", unit)
+	if unit == "" {
+		shift = 0
+	} else if shift < 1 || len(unit) != 1 {
+		return 0, fmt.Errorf("invalid size: %q", s)
+	}
+
+	return int64(n * float64(int64(1)<<(10*uint(shift)))), nil
+}
@@ -0,0 +1,33 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Helpers for stopping long reads & transfers once a command is cancelled
+// (e.g. by ctrl-c), instead of waiting for the file they're on to finish.
+
+package veb
+
+import (
+	"context"
+	"io"
+)
+
+// Returns r, which fails with ctx's error once ctx is done
+func ContextReader(ctx context.Context, r io.Reader) io.Reader {
+	if ctx.Done() == nil {
+		return r // can't be cancelled
+	}
+	return &contextReader{ctx, r}
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
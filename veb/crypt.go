@@ -0,0 +1,353 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// CryptTransport encrypts everything veb keeps on a remote, so whoever holds
+// the remote (a cloud provider, a friend's NAS) can't read it. It wraps the
+// remote's real Transport: file contents go out encrypted in chunks (see
+// cryptstream.go), the index is stored encrypted as index.crypt, and, if the
+// remote was set up that way, every file & folder name is encrypted too.
+//
+// The keys come from a passphrase ($VEB_PASSPHRASE) or a key file, stretched
+// with PBKDF2 and the salt in META_FOLDER/crypt. That file is the only thing
+// on the remote that isn't encrypted; it also says whether names are, and has
+// a check value so a wrong passphrase is caught before anything is written.
+//
+// Everything read back is authenticated, so a damaged or tampered-with file
+// fails instead of being decrypted into garbage. CheckTags() does that without
+// keeping the plaintext, to verify a remote's files.
+
+package veb
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	CRYPT_FILE       = "crypt"       // inside of META_FOLDER only
+	CRYPT_INDEX      = "index.crypt" // inside of META_FOLDER only
+	CRYPT_VERSION    = 1
+	CRYPT_ITERATIONS = 600000           // PBKDF2-SHA256 rounds for new remotes
+	CRYPT_PASSPHRASE = "VEB_PASSPHRASE" // environment variable with the passphrase
+)
+
+// Lowercase so encrypted names survive case-insensitive file systems
+var nameEncoding = base32.NewEncoding("0123456789abcdefghijklmnopqrstuv").WithPadding(base32.NoPadding)
+
+// Contents of META_FOLDER/crypt
+type cryptHeader struct {
+	Version    int
+	Salt       []byte
+	Iterations int
+	Names      bool   // file names are encrypted
+	Check      []byte // HMAC of a constant with the master key
+}
+
+type CryptTransport struct {
+	t          Transport // the remote's own transport
+	names      bool
+	contentKey []byte
+	nameKey    []byte      // for names' synthetic nonces
+	nameAEAD   cipher.AEAD // for names themselves
+	check      []byte
+	log        *Log // error/warn/info logging
+}
+
+// Returns where an encrypted remote's key comes from: the contents of keyFile
+// if it's set, otherwise the passphrase in $VEB_PASSPHRASE.
+func CryptSecret(keyFile string) ([]byte, error) {
+	if keyFile != "" {
+		secret, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("veb could not read key file: %v", err)
+		}
+		return secret, nil
+	}
+	if pass := os.Getenv(CRYPT_PASSPHRASE); pass != "" {
+		return []byte(pass), nil
+	}
+	return nil, fmt.Errorf("veb needs a key for encrypted remotes: set $%s, or KeyFile in the remote's config", CRYPT_PASSPHRASE)
+}
+
+// Whether the remote t reaches is encrypted
+func IsEncrypted(t Transport) (bool, error) {
+	_, err := t.Stat(path.Join(META_FOLDER, CRYPT_FILE))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Wraps t in a CryptTransport if its remote is encrypted, getting the key as
+// config says. Fails if config says the remote is encrypted but it isn't, so
+// a remote that lost its encryption is never pushed to in the clear.
+func WrapCrypt(t Transport, config *RemoteConfig, log *Log) (Transport, error) {
+	encrypted, err := IsEncrypted(t)
+	if err != nil {
+		return nil, err
+	}
+	if !encrypted {
+		if config.Encrypt {
+			return nil, fmt.Errorf("%s should be encrypted, but isn't", t.URL())
+		}
+		return t, nil
+	}
+
+	secret, err := CryptSecret(config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return OpenCrypt(t, secret, log)
+}
+
+// Returns a CryptTransport for t's already encrypted remote
+func OpenCrypt(t Transport, secret []byte, log *Log) (*CryptTransport, error) {
+	var h cryptHeader
+	err := loadGob(t, path.Join(META_FOLDER, CRYPT_FILE), &h)
+	if err != nil {
+		return nil, fmt.Errorf("veb could not read %s's encryption settings: %v", t.URL(), err)
+	}
+	if h.Version != CRYPT_VERSION {
+		return nil, fmt.Errorf("%s is encrypted by a different version of veb", t.URL())
+	}
+
+	ct, err := newCryptTransport(t, secret, h, log)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(ct.check, h.Check) {
+		return nil, fmt.Errorf("wrong passphrase or key file for %s", t.URL())
+	}
+	return ct, nil
+}
+
+// Turns t's remote into an encrypted one, encrypting names too if names is
+// set, and returns a CryptTransport for it. The remote has to be empty (or
+// missing, for remotes that are created from here); one that's encrypted
+// already is just opened.
+func EncryptRemote(t Transport, secret []byte, names bool, log *Log) (*CryptTransport, error) {
+	encrypted, err := IsEncrypted(t)
+	if err != nil {
+		return nil, err
+	}
+	if encrypted {
+		return OpenCrypt(t, secret, log)
+	}
+
+	x, err := t.LoadIndex()
+	if os.IsNotExist(err) {
+		x, err = New(crypto.SHA1, t.URL())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(x.Files) > 0 {
+		return nil, fmt.Errorf("%s already has unencrypted files; use a new, empty remote", t.URL())
+	}
+
+	h := cryptHeader{Version: CRYPT_VERSION, Iterations: CRYPT_ITERATIONS, Names: names}
+	h.Salt = make([]byte, 32)
+	_, err = io.ReadFull(rand.Reader, h.Salt)
+	if err != nil {
+		return nil, err
+	}
+	ct, err := newCryptTransport(t, secret, h, log)
+	if err != nil {
+		return nil, err
+	}
+	h.Check = ct.check
+	err = saveGob(t, path.Join(META_FOLDER, CRYPT_FILE), h)
+	if err != nil {
+		return nil, err
+	}
+	err = ct.SaveIndex(x)
+	if err != nil {
+		return nil, err
+	}
+
+	// the plain index is replaced by index.crypt
+	for _, f := range []string{INDEX_FILE, INDEX_FILE + "~", XSUMS_FILE, XSUMS_FILE + "~"} {
+		err = t.Remove(path.Join(META_FOLDER, f))
+		if err != nil && !os.IsNotExist(err) {
+			log.Warn().Println("could not remove unencrypted", f, ":", err)
+		}
+	}
+	return ct, nil
+}
+
+// Derives the keys from secret & h
+func newCryptTransport(t Transport, secret []byte, h cryptHeader, log *Log) (*CryptTransport, error) {
+	master, err := pbkdf2.Key(sha256.New, string(secret), h.Salt, h.Iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(hmacSHA256(master, "veb names"))
+	if err != nil {
+		return nil, err
+	}
+	nameAEAD, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CryptTransport{
+		t:          t,
+		names:      h.Names,
+		contentKey: hmacSHA256(master, "veb content"),
+		nameKey:    hmacSHA256(master, "veb name nonces"),
+		nameAEAD:   nameAEAD,
+		check:      hmacSHA256(master, "veb check"),
+		log:        log,
+	}, nil
+}
+
+func (t *CryptTransport) URL() string {
+	return t.t.URL()
+}
+
+func (t *CryptTransport) LoadIndex() (*Index, error) {
+	var x Index
+	err := loadGob(t, path.Join(META_FOLDER, CRYPT_INDEX), &x)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("couldn't load index: %v", err)
+	}
+	return remoteIndex(&x, t.URL(), t.log), nil
+}
+
+// Saves the index, keeping the old one as index.crypt~. There's no xsums
+// file; it would list every file name in the clear.
+func (t *CryptTransport) SaveIndex(x *Index) error {
+	indexFile := path.Join(META_FOLDER, CRYPT_INDEX)
+	err := t.Rename(indexFile, indexFile+"~")
+	if err != nil && !os.IsNotExist(err) {
+		t.log.Warn().Println("could not backup old", indexFile, ":", err)
+	}
+
+	x.Generation++
+	return saveGob(t, indexFile, x)
+}
+
+// Encrypted remotes have no working copy to check.
+func (t *CryptTransport) Check(x *Index, changed chan IndexEntry) error {
+	close(changed)
+	return nil
+}
+
+// Stats of the encrypted file, but with the name & size it has decrypted
+func (t *CryptTransport) Stat(p string) (os.FileInfo, error) {
+	info, err := t.t.Stat(t.encPath(p))
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if !info.IsDir() {
+		size = plainSize(size)
+	}
+	return netStat{path.Base(p), size, info.Mode(), info.ModTime()}, nil
+}
+
+func (t *CryptTransport) Open(p string) (io.ReadCloser, error) {
+	file, err := t.t.Open(t.encPath(p))
+	if err != nil {
+		return nil, err
+	}
+	r, err := newDecryptReader(file, t.contentKey)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %v", p, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, file}, nil
+}
+
+// Encrypts r on its way to the remote. The remote can only check what it gets
+// against the encrypted file's checksum, which isn't known until it's sent, so
+// r is checked against entry.Xsum here instead: if it doesn't match, the
+// stream fails at the end and the remote throws it away.
+func (t *CryptTransport) Write(entry IndexEntry, r io.Reader) error {
+	enc, err := newEncryptReader(r, t.contentKey, entry.Xsum)
+	if err != nil {
+		return err
+	}
+	out := entry
+	out.Path = t.encPath(entry.Path)
+	out.Xsum = nil
+	if entry.Size > 0 {
+		out.Size = cipherSize(entry.Size)
+	}
+	return t.t.Write(out, enc)
+}
+
+func (t *CryptTransport) Rename(from, to string) error {
+	return t.t.Rename(t.encPath(from), t.encPath(to))
+}
+
+func (t *CryptTransport) Remove(p string) error {
+	return t.t.Remove(t.encPath(p))
+}
+
+func (t *CryptTransport) FreeSpace() (int64, error) {
+	return t.t.FreeSpace()
+}
+
+func (t *CryptTransport) Close() error {
+	return t.t.Close()
+}
+
+// Reads all of p, checking every chunk's authentication tag, without keeping
+// any of the plaintext. Proves the remote still has p as veb wrote it.
+func (t *CryptTransport) CheckTags(p string) error {
+	file, err := t.Open(p)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(io.Discard, file)
+	if err != nil {
+		return fmt.Errorf("%s: %v", p, err)
+	}
+	return nil
+}
+
+// Remote path of p: p itself, or with every name but META_FOLDER encrypted
+func (t *CryptTransport) encPath(p string) string {
+	p = cleanPath(p)
+	if !t.names || p == "" {
+		return p
+	}
+
+	names := strings.Split(p, "/")
+	for i, name := range names {
+		if i == 0 && name == META_FOLDER {
+			continue
+		}
+		names[i] = t.encName(name)
+	}
+	return strings.Join(names, "/")
+}
+
+// Encrypts one name. The same name always encrypts the same way, so it can be
+// found again: the nonce is an HMAC of the name rather than random.
+func (t *CryptTransport) encName(name string) string {
+	nonce := hmacSHA256(t.nameKey, name)[:t.nameAEAD.NonceSize()]
+	sealed := t.nameAEAD.Seal(append([]byte{}, nonce...), nonce, []byte(name), nil)
+	return nameEncoding.EncodeToString(sealed)
+}
@@ -0,0 +1,210 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The encrypted file format CryptTransport uses:
+//   "VEB1" | salt (32 bytes) | chunk | chunk | ...
+// Each chunk is up to CRYPT_CHUNK bytes of the file sealed with AES-256-GCM,
+// so it's 16 bytes longer than what it holds. Every file gets its own key,
+// HMAC-SHA256(content key, salt), so nonces only need to count chunks: an
+// 11 byte chunk number, then 1 if it's the last chunk or 0 if not. Chunks
+// can't be reordered, dropped, or cut off at the end without the tags failing.
+
+package veb
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+const (
+	CRYPT_MAGIC = "VEB1"    // start of every encrypted file
+	CRYPT_SALT  = 32        // bytes of per-file salt
+	CRYPT_CHUNK = 64 * 1024 // bytes of the file per chunk
+	CRYPT_TAG   = 16        // bytes GCM adds to each chunk
+	CRYPT_HEAD  = len(CRYPT_MAGIC) + CRYPT_SALT
+)
+
+var ErrAuth = errors.New("encrypted data failed authentication (damaged, or the wrong key)")
+
+// Returns the AEAD for a file with the given salt
+func fileAEAD(contentKey, salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, contentKey)
+	mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Nonce of chunk number n
+func chunkNonce(n uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], n)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// Encrypted size of a file of size plain
+func cipherSize(plain int64) int64 {
+	chunks := (plain + CRYPT_CHUNK - 1) / CRYPT_CHUNK
+	if chunks == 0 {
+		chunks = 1 // empty files still get a (last) chunk
+	}
+	return int64(CRYPT_HEAD) + plain + chunks*CRYPT_TAG
+}
+
+// Size of the file an encrypted file of size encrypted holds
+func plainSize(encrypted int64) int64 {
+	body := encrypted - int64(CRYPT_HEAD)
+	chunks := (body + CRYPT_CHUNK + CRYPT_TAG - 1) / (CRYPT_CHUNK + CRYPT_TAG)
+	if chunks == 0 {
+		chunks = 1
+	}
+	plain := body - chunks*CRYPT_TAG
+	if plain < 0 {
+		return 0
+	}
+	return plain
+}
+
+// Encrypts what it reads from src. If xsum is set, what it read has to match
+// it, or the last Read fails instead of returning io.EOF, so the file never
+// gets finished.
+type encryptReader struct {
+	src    *bufio.Reader
+	aead   cipher.AEAD
+	out    bytes.Buffer // encrypted, not read yet
+	buf    []byte
+	n      uint64 // next chunk number
+	done   bool   // sealed the last chunk
+	hasher hash.Hash
+	xsum   []byte
+}
+
+func newEncryptReader(src io.Reader, contentKey, xsum []byte) (*encryptReader, error) {
+	salt := make([]byte, CRYPT_SALT)
+	_, err := io.ReadFull(rand.Reader, salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := fileAEAD(contentKey, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &encryptReader{
+		src:    bufio.NewReaderSize(src, CRYPT_CHUNK),
+		aead:   aead,
+		buf:    make([]byte, CRYPT_CHUNK),
+		hasher: NewHasher(),
+		xsum:   xsum,
+	}
+	r.out.WriteString(CRYPT_MAGIC)
+	r.out.Write(salt)
+	return r, nil
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	for r.out.Len() == 0 {
+		if r.done {
+			if r.xsum != nil && !bytes.Equal(r.hasher.Sum(nil), r.xsum) {
+				return 0, fmt.Errorf("file doesn't match its checksum")
+			}
+			return 0, io.EOF
+		}
+
+		n, err := io.ReadFull(r.src, r.buf)
+		last := false
+		switch err {
+		case io.EOF, io.ErrUnexpectedEOF:
+			last = true
+		case nil:
+			_, perr := r.src.Peek(1)
+			last = perr == io.EOF
+		default:
+			return 0, err
+		}
+
+		r.hasher.Write(r.buf[:n])
+		r.out.Write(r.aead.Seal(nil, chunkNonce(r.n, last), r.buf[:n], nil))
+		r.n++
+		r.done = last
+	}
+	return r.out.Read(p)
+}
+
+// Decrypts what it reads from src, failing with ErrAuth if any chunk doesn't
+// authenticate or the file was cut short.
+type decryptReader struct {
+	src  *bufio.Reader
+	aead cipher.AEAD
+	out  []byte // decrypted, not read yet
+	buf  []byte
+	n    uint64 // next chunk number
+	done bool   // opened the last chunk
+}
+
+func newDecryptReader(src io.Reader, contentKey []byte) (*decryptReader, error) {
+	in := bufio.NewReaderSize(src, CRYPT_CHUNK+CRYPT_TAG)
+	head := make([]byte, CRYPT_HEAD)
+	_, err := io.ReadFull(in, head)
+	if err == io.EOF || err == io.ErrUnexpectedEOF || (err == nil && string(head[:len(CRYPT_MAGIC)]) != CRYPT_MAGIC) {
+		return nil, fmt.Errorf("not a veb encrypted file")
+	}
+	if err != nil {
+		return nil, err
+	}
+	aead, err := fileAEAD(contentKey, head[len(CRYPT_MAGIC):])
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{src: in, aead: aead, buf: make([]byte, CRYPT_CHUNK+CRYPT_TAG)}, nil
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		n, err := io.ReadFull(r.src, r.buf)
+		last := false
+		switch err {
+		case io.EOF:
+			return 0, ErrAuth // no last chunk: cut short
+		case io.ErrUnexpectedEOF:
+			last = true
+		case nil:
+			_, perr := r.src.Peek(1)
+			last = perr == io.EOF
+		default:
+			return 0, err
+		}
+
+		plain, err := r.aead.Open(r.buf[:0], chunkNonce(r.n, last), r.buf[:n], nil)
+		if err != nil {
+			return 0, ErrAuth
+		}
+		r.out = plain
+		r.n++
+		r.done = last
+	}
+
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
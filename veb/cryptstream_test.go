@@ -0,0 +1,163 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package veb
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+var testContentKey = bytes.Repeat([]byte{0x42}, 32)
+
+// Encrypts data with the test key
+func encryptAll(t *testing.T, data []byte) []byte {
+	t.Helper()
+	hasher := NewHasher()
+	hasher.Write(data)
+	r, err := newEncryptReader(bytes.NewReader(data), testContentKey, hasher.Sum(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encrypted
+}
+
+// Decrypts encrypted with key
+func decryptAll(encrypted, key []byte) ([]byte, error) {
+	r, err := newDecryptReader(bytes.NewReader(encrypted), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestCryptRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, CRYPT_CHUNK - 1, CRYPT_CHUNK, CRYPT_CHUNK + 1, 3*CRYPT_CHUNK + 5} {
+		_, data := testFile("f", size)
+		encrypted := encryptAll(t, data)
+		if int64(len(encrypted)) != cipherSize(int64(size)) {
+			t.Errorf("%d bytes encrypted to %d, cipherSize says %d", size, len(encrypted), cipherSize(int64(size)))
+		}
+		if plainSize(int64(len(encrypted))) != int64(size) {
+			t.Errorf("plainSize(%d) = %d, want %d", len(encrypted), plainSize(int64(len(encrypted))), size)
+		}
+		got, err := decryptAll(encrypted, testContentKey)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%d bytes decrypted to %d bytes, %v", size, len(got), err)
+		}
+	}
+
+	// every file gets its own salt
+	_, data := testFile("f", 100)
+	if bytes.Equal(encryptAll(t, data), encryptAll(t, data)) {
+		t.Errorf("the same file encrypted the same way twice")
+	}
+}
+
+// Encrypted file with its chunks split out
+func chunks(encrypted []byte) ([]byte, [][]byte) {
+	head, body := encrypted[:CRYPT_HEAD], encrypted[CRYPT_HEAD:]
+	parts := make([][]byte, 0)
+	for len(body) > 0 {
+		n := CRYPT_CHUNK + CRYPT_TAG
+		if n > len(body) {
+			n = len(body)
+		}
+		parts = append(parts, body[:n])
+		body = body[n:]
+	}
+	return head, parts
+}
+
+func join(head []byte, parts ...[]byte) []byte {
+	return bytes.Join(append([][]byte{head}, parts...), nil)
+}
+
+func TestCryptTruncated(t *testing.T) {
+	_, data := testFile("f", 3*CRYPT_CHUNK+5)
+	encrypted := encryptAll(t, data)
+	chunk := CRYPT_CHUNK + CRYPT_TAG
+
+	// cut at every chunk boundary, and inside each chunk & the header
+	cuts := []int{0, 3, CRYPT_HEAD, CRYPT_HEAD + 1, len(encrypted) - 1}
+	for i := 1; i <= 3; i++ {
+		cuts = append(cuts, CRYPT_HEAD+i*chunk, CRYPT_HEAD+i*chunk-1, CRYPT_HEAD+i*chunk+1)
+	}
+	for _, n := range cuts {
+		got, err := decryptAll(encrypted[:n], testContentKey)
+		if err == nil {
+			t.Errorf("cut to %d of %d bytes: decrypted %d bytes without an error", n, len(encrypted), len(got))
+		}
+	}
+}
+
+func TestCryptReordered(t *testing.T) {
+	_, data := testFile("f", 3*CRYPT_CHUNK+5)
+	head, parts := chunks(encryptAll(t, data))
+	if len(parts) != 4 {
+		t.Fatalf("%d chunks, want 4", len(parts))
+	}
+
+	bad := map[string][]byte{
+		"swapped first two":    join(head, parts[1], parts[0], parts[2], parts[3]),
+		"swapped middle two":   join(head, parts[0], parts[2], parts[1], parts[3]),
+		"middle one dropped":   join(head, parts[0], parts[2], parts[3]),
+		"first one dropped":    join(head, parts[1], parts[2], parts[3]),
+		"last one twice":       join(head, parts[0], parts[1], parts[2], parts[3], parts[3]),
+		"a middle one twice":   join(head, parts[0], parts[1], parts[1], parts[2], parts[3]),
+		"last one dropped":     join(head, parts[0], parts[1], parts[2]),
+		"last one moved first": join(head, parts[3], parts[0], parts[1], parts[2]),
+	}
+	for what, encrypted := range bad {
+		_, err := decryptAll(encrypted, testContentKey)
+		if err != ErrAuth {
+			t.Errorf("%s: %v, want ErrAuth", what, err)
+		}
+	}
+
+	// chunks from another file with the same key don't fit either
+	_, other := chunks(encryptAll(t, data))
+	_, err := decryptAll(join(head, parts[0], other[1], parts[2], parts[3]), testContentKey)
+	if err != ErrAuth {
+		t.Errorf("chunk from another file: %v, want ErrAuth", err)
+	}
+}
+
+func TestCryptDamaged(t *testing.T) {
+	_, data := testFile("f", 2*CRYPT_CHUNK)
+	encrypted := encryptAll(t, data)
+	for _, at := range []int{CRYPT_HEAD - 1, CRYPT_HEAD, CRYPT_HEAD + CRYPT_CHUNK, len(encrypted) - 1} {
+		damaged := append([]byte(nil), encrypted...)
+		damaged[at] ^= 1
+		if _, err := decryptAll(damaged, testContentKey); err != ErrAuth {
+			t.Errorf("bit flipped at %d: %v, want ErrAuth", at, err)
+		}
+	}
+
+	if _, err := decryptAll(encrypted, bytes.Repeat([]byte{0x43}, 32)); err != ErrAuth {
+		t.Errorf("wrong key: %v, want ErrAuth", err)
+	}
+	if _, err := decryptAll(append([]byte("VEB0"), encrypted[4:]...), testContentKey); err == nil {
+		t.Errorf("wrong magic decrypted")
+	}
+}
+
+// A file that doesn't match its checksum is never finished
+func TestCryptXsum(t *testing.T) {
+	entry, data := testFile("f", CRYPT_CHUNK+1)
+	data[0]++
+	r, err := newEncryptReader(bytes.NewReader(data), testContentKey, entry.Xsum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(r)
+	if err == nil {
+		t.Errorf("encrypting a file that doesn't match its checksum worked")
+	}
+}
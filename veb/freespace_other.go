@@ -0,0 +1,20 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux && !darwin && !freebsd
+
+// free space of a filesystem
+
+package veb
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Returns the bytes available to this user on the filesystem dir is on.
+// Not supported here; callers should carry on as if there's room.
+func FreeSpace(dir string) (int64, error) {
+	return 0, fmt.Errorf("veb can't check free space on %s", runtime.GOOS)
+}
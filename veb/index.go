@@ -15,11 +15,13 @@
 package veb
 
 import (
+	"context"
 	"crypto"
 	"encoding/gob"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 )
@@ -34,11 +36,18 @@ const (
 // The veb index is a map indexed by relative paths
 // (paths start at the dir where the .veb directory is located)
 type Index struct {
-	Files  map[string]IndexEntry
-	Remote string      // absolute path to backup location root
-	Hash   crypto.Hash // hash function used. 0 = not yet hashed
-	Root   string      // root of this veb repository
-	log    *Log        // error/warn/info logging
+	Files      map[string]IndexEntry
+	Remote     string             // old single remote; moved into Remotes on Load
+	Remotes    map[string]*Remote // backup locations, by name
+	Generation uint64             // incremented every Save()
+	UUID       string             // identifies this repository, even if it moves
+	Hash       crypto.Hash        // hash function used. 0 = not yet hashed
+	Root       string             // root of this veb repository
+	Compressed bool               // remote has compressed files (see CompressTransport)
+	Layout     string             // how a remote stores files: "" = by path, or LAYOUT_OBJECTS
+	VerifyRun  time.Time          // when the last verify without --resume started
+	log        *Log               // error/warn/info logging
+	newUUID    bool               // UUID was made up by Load, and isn't saved yet
 }
 
 // A veb index entry/value
@@ -53,12 +62,24 @@ type IndexEntry struct {
 	Size    int64       // length in bytes
 	Mode    os.FileMode // file mode bits
 	ModTime time.Time   // modification time
+
+	LastVerified time.Time // when verify last found the file matched Xsum; zero = never
+	VerifyCount  int       // how many times verify has found it matched
+
+	BlockSize int64    // bytes per block checksum; 0 = none (see blocks.go)
+	Blocks    [][]byte // checksum of each BlockSize piece of the file
 }
 
-// Creates a new, empty, Index
-func New(hash crypto.Hash, root string) *Index {
-	ret := Index{make(map[string]IndexEntry), "", hash, root, nil}
-	return &ret
+// Creates a new, empty, Index with a new UUID
+func New(hash crypto.Hash, root string) (*Index, error) {
+	uuid, err := NewUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := Index{make(map[string]IndexEntry), "", make(map[string]*Remote), 0,
+		uuid, hash, root, false, "", time.Time{}, nil, false}
+	return &ret, nil
 }
 
 // Reads the index in from the index file, decodes with gob and returns it
@@ -84,9 +105,37 @@ func Load(root string, log *Log) (*Index, error) {
 	ret.log = log
 	ret.Root = root
 
+	// Upgrade indexes from before named remotes
+	if ret.Remotes == nil {
+		ret.Remotes = make(map[string]*Remote)
+	}
+	if ret.Remote != "" {
+		if _, ok := ret.Remotes[DEFAULT_REMOTE]; !ok {
+			ret.Remotes[DEFAULT_REMOTE] = &Remote{Name: DEFAULT_REMOTE, URL: ret.Remote}
+		}
+		ret.Remote = ""
+	}
+
+	// Upgrade indexes from before UUIDs.
+	// Only in memory; it sticks the next time a command saves the index.
+	if ret.UUID == "" {
+		ret.UUID, err = NewUUID()
+		if err != nil {
+			log.Err().Println("couldn't make a UUID:", err)
+			return nil, err
+		}
+		ret.newUUID = true
+	}
+
 	return &ret, nil
 }
 
+// Whether the index is from before UUIDs, and its UUID won't be the same
+// next time it's loaded unless it's saved first
+func (x *Index) UnsavedUUID() bool {
+	return x.newUUID
+}
+
 // Saves index to file, encoded with gob
 func (x *Index) Save() error {
 	// move previous index file to backup file, in case something goes badly.
@@ -108,12 +157,14 @@ func (x *Index) Save() error {
 	defer file.Close() // make sure to close that file
 
 	// send index to file
+	x.Generation++
 	enc := gob.NewEncoder(file)
 	err = enc.Encode(x)
 	if err != nil {
 		x.log.Err().Println("couldn't save index:", err)
 		return err
 	}
+	x.newUUID = false
 
 	// move previous xsums file to backup file, in case something goes badly.
 	// overwrites previous backup xsums, if it exists.
@@ -142,12 +193,13 @@ func (x *Index) Save() error {
 }
 
 // Checks file stats against stats in the index; does not recompute checksum.
-// Pushed files whose stats differ out to the changed channel.
-// Closes the channel when complete.
-func (x Index) Check(changed chan IndexEntry) error {
+// Pushed files whose stats differ out to the changed channel. New files are
+// pushed as entries with only their Path set.
+// Closes the channel when complete, or when ctx is cancelled.
+func (x Index) Check(ctx context.Context, changed chan IndexEntry) error {
 	// find changes
-	err := filepath.Walk(x.Root, x.checkWalker(changed))
-	if err != nil {
+	err := filepath.Walk(x.Root, x.checkWalker(ctx, changed))
+	if err != nil && err != ctx.Err() {
 		x.log.Err().Println(err)
 	}
 	close(changed)
@@ -181,15 +233,53 @@ func (x Index) Update(entry *IndexEntry) error {
 	}
 
 	// Add/Update entry in Index
-	x.Files[entry.Path] = *entry
+	x.Set(*entry)
 
 	return nil
 }
 
+// Adds/updates an entry whose stats & xsum are already filled in.
+func (x Index) Set(entry IndexEntry) {
+	x.Files[entry.Path] = entry
+}
+
+// Returns entries in the index whose files no longer exist, sorted by path.
+func (x Index) Deleted() []IndexEntry {
+	deleted := make([]IndexEntry, 0)
+	for p, e := range x.Files {
+		_, err := os.Lstat(path.Join(x.Root, p))
+		if os.IsNotExist(err) {
+			deleted = append(deleted, e)
+		}
+	}
+
+	sort.Sort(entriesByPath(deleted))
+	return deleted
+}
+
+// Total size of the files in the index
+func (x Index) Size() int64 {
+	size := int64(0)
+	for _, e := range x.Files {
+		size += e.Size
+	}
+	return size
+}
+
+// File is gone; remove it from the Index.
+func (x Index) Remove(path string) {
+	delete(x.Files, path)
+}
+
 // Returns a closure that implements filepath.WalkFn
 // checkWalker's closure checks files encountered against those in the index
-func (x Index) checkWalker(changed chan IndexEntry) func(path string, info os.FileInfo, err error) error {
+func (x Index) checkWalker(ctx context.Context, changed chan IndexEntry) func(path string, info os.FileInfo, err error) error {
 	return func(path string, info os.FileInfo, err error) error {
+		// stop walking once cancelled
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
 		if err != nil {
 			// ignoring errors so we can continue if possible
 			x.log.Err().Println(err)
@@ -207,6 +297,11 @@ func (x Index) checkWalker(changed chan IndexEntry) func(path string, info os.Fi
 			return nil // ignore
 		}
 
+		// ignore veb's half-written files
+		if strings.HasSuffix(info.Name(), TEMP_SUFFIX) {
+			return nil
+		}
+
 		// make path relative
 		// TODO: how does Go treat paths on Windows? / or \ as path seperator?
 		path = strings.Replace(path, x.Root+"/", "", 1)
@@ -215,11 +310,8 @@ func (x Index) checkWalker(changed chan IndexEntry) func(path string, info os.Fi
 		file, ok := x.Files[path]
 		if !ok {
 			// not in index (new file)
-			// add to index (w/ no stats)
-			x.Files[path] = IndexEntry{Path: path}
-
-			// add to channel for processing
-			changed <- x.Files[path]
+			// add to channel for processing (w/ no stats)
+			changed <- IndexEntry{Path: path}
 		} else if file.Size != info.Size() ||
 			file.ModTime != info.ModTime() ||
 			file.Mode != info.Mode() {
@@ -232,8 +324,21 @@ func (x Index) checkWalker(changed chan IndexEntry) func(path string, info os.Fi
 	}
 }
 
+// Forgets that the file was ever verified, for when it has new contents (or
+// is a new copy somewhere else).
+func (e *IndexEntry) ResetVerified() {
+	e.LastVerified = time.Time{}
+	e.VerifyCount = 0
+}
+
+// sort.Interface for ordering entries by path
+type entriesByPath []IndexEntry
+
+func (e entriesByPath) Len() int           { return len(e) }
+func (e entriesByPath) Less(i, j int) bool { return e[i].Path < e[j].Path }
+func (e entriesByPath) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+
 // TODO
-//  - notice deleted files!
 //  - statistics!
 //    - time, etc
 //  - non-main!
@@ -0,0 +1,161 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// LocalTransport is a Transport for remote repositories in local (or mounted)
+// folders.
+
+package veb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+)
+
+const (
+	TEMP_SUFFIX = ".veb~" // temp files being written, before they're renamed into place
+)
+
+type LocalTransport struct {
+	root string // remote repository's root folder
+	log  *Log   // error/warn/info logging
+}
+
+func NewLocalTransport(root string, log *Log) *LocalTransport {
+	return &LocalTransport{root, log}
+}
+
+func (t *LocalTransport) URL() string {
+	return t.root
+}
+
+func (t *LocalTransport) LoadIndex() (*Index, error) {
+	_, err := os.Stat(path.Join(t.root, META_FOLDER, INDEX_FILE))
+	if err != nil {
+		return nil, err
+	}
+	return Load(t.root, t.log)
+}
+
+func (t *LocalTransport) SaveIndex(x *Index) error {
+	return x.Save()
+}
+
+func (t *LocalTransport) Check(x *Index, changed chan IndexEntry) error {
+	return x.Check(context.Background(), changed)
+}
+
+func (t *LocalTransport) Stat(p string) (os.FileInfo, error) {
+	return os.Lstat(path.Join(t.root, p))
+}
+
+func (t *LocalTransport) Open(p string) (io.ReadCloser, error) {
+	return os.Open(path.Join(t.root, p))
+}
+
+func (t *LocalTransport) OpenRange(p string, off, n int64) (io.ReadCloser, error) {
+	return openRange(path.Join(t.root, p), off, n)
+}
+
+func (t *LocalTransport) Write(entry IndexEntry, r io.Reader) error {
+	return writeLocal(path.Join(t.root, entry.Path), entry, r)
+}
+
+func (t *LocalTransport) Rename(from, to string) error {
+	to = path.Join(t.root, to)
+	err := os.MkdirAll(path.Dir(to), 0755)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path.Join(t.root, from), to)
+}
+
+// Hard links file from to to, making folders as needed
+func (t *LocalTransport) link(from, to string) error {
+	to = path.Join(t.root, to)
+	err := os.MkdirAll(path.Dir(to), 0755)
+	if err != nil {
+		return err
+	}
+	return os.Link(path.Join(t.root, from), to)
+}
+
+// Won't remove the repository itself, or its META_FOLDER, whoever asks.
+func (t *LocalTransport) Remove(p string) error {
+	p = cleanPath(p)
+	if p == "" || p == META_FOLDER {
+		return fmt.Errorf("veb won't remove the repository at %s, or its %s", t.root, META_FOLDER)
+	}
+	p = path.Join(t.root, p)
+	_, err := os.Lstat(p)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(p)
+}
+
+func (t *LocalTransport) FreeSpace() (int64, error) {
+	return FreeSpace(t.root)
+}
+
+func (t *LocalTransport) Close() error {
+	return nil
+}
+
+// Opens n bytes of local file name, starting at off
+func openRange(name string, off, n int64) (io.ReadCloser, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(file, off, n), file}, nil
+}
+
+// Writes r to a temp file next to dest, checks it against entry's checksum (if
+// it has one), then renames it over dest.
+func writeLocal(dest string, entry IndexEntry, r io.Reader) error {
+	err := os.MkdirAll(path.Dir(dest), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp := dest + TEMP_SUFFIX
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	hasher := NewHasher()
+	_, err = io.Copy(file, io.TeeReader(r, hasher))
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && entry.Xsum != nil && !bytes.Equal(hasher.Sum(nil), entry.Xsum) {
+		err = fmt.Errorf("%s doesn't match its checksum", entry.Path)
+	}
+	if err == nil {
+		mode := entry.Mode.Perm()
+		if mode == 0 {
+			mode = 0644
+		}
+		err = os.Chmod(tmp, mode)
+	}
+	if err == nil {
+		err = os.Rename(tmp, dest)
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
@@ -0,0 +1,216 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// A Merkle tree over a repository's committed files: each file's hash is of
+// its checksum, each folder's is of the names & hashes of what's in it, and
+// the root folder's is the repository's root hash. Two repositories with the
+// same root hash have the same files with the same contents. If they don't,
+// comparing what's in each folder that differs finds where, without looking
+// at any folder that's the same (see CompareTrees).
+//
+// The root hash also makes tampering show: write it down somewhere safe, and
+// any change to the committed files or their checksums since gives another.
+
+package veb
+
+import (
+	"bytes"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	TREE_FILE = 'f' // what a file's hash starts with
+	TREE_DIR  = 'd' // what a folder's hash starts with
+)
+
+// A file or folder in a Tree
+type TreeNode struct {
+	Name string
+	Dir  bool
+	Hash []byte
+}
+
+// A folder's hash and what's in it, sorted by name. Hash is nil for a folder
+// that isn't there.
+type Subtree struct {
+	Hash     []byte
+	Children []TreeNode
+}
+
+// Transports whose remote can hash its own tree, so comparing it with another
+// doesn't need the remote's whole index
+type TreeHasher interface {
+	// The remote repository's UUID, and the subtrees of folders dirs. No
+	// dirs starts a comparison: the remote hashes its tree again, as it is now.
+	Subtrees(dirs []string) (string, []Subtree, error)
+}
+
+// The Merkle tree of an index's files
+type Tree struct {
+	dirs map[string]*Subtree // by folder path; "" = the root
+}
+
+// Hashes the tree of files. The hashes aren't kept with the index, so this
+// goes over every file each time.
+func NewTree(files map[string]IndexEntry) *Tree {
+	t := &Tree{map[string]*Subtree{"": &Subtree{}}}
+	for p, e := range files {
+		dir, name := splitPath(p)
+		s := t.folder(dir)
+		s.Children = append(s.Children, TreeNode{Name: name, Hash: treeHash(TREE_FILE, e.Xsum)})
+	}
+	t.hash("")
+	return t
+}
+
+// The repository's root hash
+func (t *Tree) Root() []byte {
+	return t.dirs[""].Hash
+}
+
+// The subtrees of folders dirs, in the same order
+func (t *Tree) Subtrees(dirs []string) []Subtree {
+	subtrees := make([]Subtree, len(dirs))
+	for i, dir := range dirs {
+		if s, ok := t.dirs[dir]; ok {
+			subtrees[i] = *s
+		}
+	}
+	return subtrees
+}
+
+// Gets folder dir, adding it (and the folders it's in) if it's new
+func (t *Tree) folder(dir string) *Subtree {
+	s, ok := t.dirs[dir]
+	if !ok {
+		s = &Subtree{}
+		t.dirs[dir] = s
+		parent, name := splitPath(dir)
+		p := t.folder(parent)
+		p.Children = append(p.Children, TreeNode{Name: name, Dir: true})
+	}
+	return s
+}
+
+// Works out the hashes of folder dir and the folders in it
+func (t *Tree) hash(dir string) []byte {
+	s := t.dirs[dir]
+	sort.Sort(nodesByName(s.Children))
+	var buf bytes.Buffer
+	for i := range s.Children {
+		c := &s.Children[i]
+		kind := byte(TREE_FILE)
+		if c.Dir {
+			kind = TREE_DIR
+			c.Hash = t.hash(path.Join(dir, c.Name))
+		}
+		buf.WriteByte(kind)
+		buf.WriteString(c.Name)
+		buf.WriteByte(0)
+		buf.Write(c.Hash)
+	}
+	s.Hash = treeHash(TREE_DIR, buf.Bytes())
+	return s.Hash
+}
+
+func treeHash(kind byte, data []byte) []byte {
+	hasher := NewHasher()
+	hasher.Write([]byte{kind})
+	hasher.Write(data)
+	return hasher.Sum(nil)
+}
+
+// Splits an index path into its folder ("" for the root) and name
+func splitPath(p string) (string, string) {
+	i := strings.LastIndex(p, "/")
+	if i < 0 {
+		return "", p
+	}
+	return p[:i], p[i+1:]
+}
+
+// What differs between two trees
+const (
+	TREE_DIFFERENT = iota // in both, but not the same
+	TREE_ONLY_A           // only in the first tree
+	TREE_ONLY_B           // only in the second
+)
+
+// A file, or a whole folder, where two trees differ
+type TreeDiff struct {
+	Path string
+	Dir  bool // a folder only one side has (or a folder on one side and a file on the other)
+	Kind int  // TREE_*
+}
+
+// Gets the subtrees of folders dirs (as Tree.Subtrees does), from wherever
+// the tree is
+type SubtreeFunc func(dirs []string) ([]Subtree, error)
+
+// Finds where trees a & b differ, going down one level of folders at a time
+// (one call each of a & b per level) and only into folders whose hashes
+// differ. Folders only one side has are one TreeDiff, not one per file.
+// Sorted by path.
+func CompareTrees(a, b SubtreeFunc) ([]TreeDiff, error) {
+	diffs := make([]TreeDiff, 0)
+	level := []string{""}
+	for len(level) > 0 {
+		as, err := a(level)
+		if err != nil {
+			return nil, err
+		}
+		bs, err := b(level)
+		if err != nil {
+			return nil, err
+		}
+
+		next := make([]string, 0)
+		for i, dir := range level {
+			if bytes.Equal(as[i].Hash, bs[i].Hash) {
+				continue
+			}
+			ac, bc := as[i].Children, bs[i].Children
+			for len(ac) > 0 || len(bc) > 0 {
+				switch {
+				case len(bc) == 0 || (len(ac) > 0 && ac[0].Name < bc[0].Name):
+					diffs = append(diffs, TreeDiff{path.Join(dir, ac[0].Name), ac[0].Dir, TREE_ONLY_A})
+					ac = ac[1:]
+				case len(ac) == 0 || bc[0].Name < ac[0].Name:
+					diffs = append(diffs, TreeDiff{path.Join(dir, bc[0].Name), bc[0].Dir, TREE_ONLY_B})
+					bc = bc[1:]
+				default:
+					p := path.Join(dir, ac[0].Name)
+					switch {
+					case bytes.Equal(ac[0].Hash, bc[0].Hash) && ac[0].Dir == bc[0].Dir:
+					case ac[0].Dir && bc[0].Dir:
+						next = append(next, p)
+					default:
+						diffs = append(diffs, TreeDiff{p, ac[0].Dir || bc[0].Dir, TREE_DIFFERENT})
+					}
+					ac, bc = ac[1:], bc[1:]
+				}
+			}
+		}
+		level = next
+	}
+
+	sort.Sort(diffsByPath(diffs))
+	return diffs, nil
+}
+
+// sort.Interface for ordering tree nodes by name
+type nodesByName []TreeNode
+
+func (n nodesByName) Len() int           { return len(n) }
+func (n nodesByName) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
+func (n nodesByName) Less(i, j int) bool { return n[i].Name < n[j].Name }
+
+// sort.Interface for ordering tree diffs by path
+type diffsByPath []TreeDiff
+
+func (d diffsByPath) Len() int           { return len(d) }
+func (d diffsByPath) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d diffsByPath) Less(i, j int) bool { return d[i].Path < d[j].Path }
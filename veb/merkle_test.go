@@ -0,0 +1,183 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package veb
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// A random path, made of few enough names that trees share lots of them
+func randomPath(rng *rand.Rand) string {
+	names := make([]string, 1+rng.Intn(4))
+	for i := range names {
+		names[i] = string(rune('a' + rng.Intn(3)))
+	}
+	return strings.Join(names, "/")
+}
+
+// Adds p to files, unless a file there is a folder's name or the other way
+// around, which a filesystem can't have
+func addFile(files map[string]IndexEntry, p string, xsum byte) {
+	for have := range files {
+		if have == p || strings.HasPrefix(have, p+"/") || strings.HasPrefix(p, have+"/") {
+			return
+		}
+	}
+	files[p] = IndexEntry{Path: p, Xsum: []byte{xsum}}
+}
+
+// Two random sets of files, the second mostly like the first
+func randomTrees(rng *rand.Rand) (map[string]IndexEntry, map[string]IndexEntry) {
+	a := make(map[string]IndexEntry)
+	for i := rng.Intn(30); i > 0; i-- {
+		addFile(a, randomPath(rng), byte(rng.Intn(4)))
+	}
+	b := make(map[string]IndexEntry)
+	for p, e := range a {
+		switch rng.Intn(6) {
+		case 0: // not in b
+		case 1:
+			b[p] = IndexEntry{Path: p, Xsum: []byte{e.Xsum[0] + 1}}
+		default:
+			b[p] = e
+		}
+	}
+	for i := rng.Intn(5); i > 0; i-- {
+		addFile(b, randomPath(rng), byte(rng.Intn(4)))
+	}
+	return a, b
+}
+
+// Every file & folder in files: path -> whether it's a folder
+func allNodes(files map[string]IndexEntry) map[string]bool {
+	nodes := make(map[string]bool)
+	for p := range files {
+		nodes[p] = false
+		for dir, _ := splitPath(p); dir != ""; dir, _ = splitPath(dir) {
+			nodes[dir] = true
+		}
+	}
+	return nodes
+}
+
+// What CompareTrees should find, the slow way: every file or folder that's
+// different or only on one side, where the folders it's in are on both
+func bruteDiff(a, b map[string]IndexEntry) []TreeDiff {
+	an, bn := allNodes(a), allNodes(b)
+	inBoth := func(p string) bool {
+		for dir, _ := splitPath(p); dir != ""; dir, _ = splitPath(dir) {
+			if !an[dir] || !bn[dir] {
+				return false
+			}
+		}
+		return true
+	}
+
+	diffs := make([]TreeDiff, 0)
+	for p, aDir := range an {
+		if !inBoth(p) {
+			continue
+		}
+		bDir, ok := bn[p]
+		switch {
+		case !ok:
+			diffs = append(diffs, TreeDiff{p, aDir, TREE_ONLY_A})
+		case aDir != bDir:
+			diffs = append(diffs, TreeDiff{p, true, TREE_DIFFERENT})
+		case !aDir && !bytes.Equal(a[p].Xsum, b[p].Xsum):
+			diffs = append(diffs, TreeDiff{p, false, TREE_DIFFERENT})
+		}
+	}
+	for p, bDir := range bn {
+		if _, ok := an[p]; !ok && inBoth(p) {
+			diffs = append(diffs, TreeDiff{p, bDir, TREE_ONLY_B})
+		}
+	}
+	sort.Sort(diffsByPath(diffs))
+	return diffs
+}
+
+func TestCompareTrees(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for trial := 0; trial < 2000; trial++ {
+		a, b := randomTrees(rng)
+		ta, tb := NewTree(a), NewTree(b)
+
+		// only folders that differ get looked into
+		subtrees := func(tree, other *Tree) SubtreeFunc {
+			return func(dirs []string) ([]Subtree, error) {
+				for _, dir := range dirs {
+					mine, theirs := tree.Subtrees([]string{dir})[0], other.Subtrees([]string{dir})[0]
+					if dir != "" && bytes.Equal(mine.Hash, theirs.Hash) {
+						t.Errorf("asked for folder %s, which is the same in both", dir)
+					}
+				}
+				return tree.Subtrees(dirs), nil
+			}
+		}
+		got, err := CompareTrees(subtrees(ta, tb), subtrees(tb, ta))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := bruteDiff(a, b)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("a: %v\nb: %v\nCompareTrees: %v\nwant:         %v", keys(a), keys(b), got, want)
+		}
+		if (len(want) == 0) != bytes.Equal(ta.Root(), tb.Root()) {
+			t.Fatalf("a: %v\nb: %v\n%d differences, but root hashes %x & %x", keys(a), keys(b), len(want), ta.Root(), tb.Root())
+		}
+	}
+}
+
+func keys(files map[string]IndexEntry) []string {
+	ks := make([]string, 0, len(files))
+	for p, e := range files {
+		ks = append(ks, fmt.Sprintf("%s=%x", p, e.Xsum))
+	}
+	sort.Strings(ks)
+	return ks
+}
+
+func TestTreeRoot(t *testing.T) {
+	files := map[string]IndexEntry{
+		"a/b/c": {Path: "a/b/c", Xsum: []byte{1}},
+		"a/d":   {Path: "a/d", Xsum: []byte{2}},
+		"e":     {Path: "e", Xsum: []byte{3}},
+	}
+	root := NewTree(files).Root()
+	if len(root) == 0 || !bytes.Equal(root, NewTree(files).Root()) {
+		t.Fatalf("root hash %x isn't the same each time", root)
+	}
+
+	// what changes the root hash: contents, names, & which folder a file is in
+	changes := map[string]map[string]IndexEntry{
+		"contents": {"a/b/c": {Xsum: []byte{9}}, "a/d": files["a/d"], "e": files["e"]},
+		"name":     {"a/b/x": files["a/b/c"], "a/d": files["a/d"], "e": files["e"]},
+		"folder":   {"a/c": files["a/b/c"], "a/d": files["a/d"], "e": files["e"]},
+		"file":     {"a/b/c": files["a/b/c"], "a/d": files["a/d"]},
+		"none":     {},
+	}
+	for what, changed := range changes {
+		if bytes.Equal(NewTree(changed).Root(), root) {
+			t.Errorf("changing the %s didn't change the root hash", what)
+		}
+	}
+
+	// a file & a folder with the same name & hash aren't the same
+	dirAsFile := map[string]IndexEntry{"x": {Xsum: NewTree(map[string]IndexEntry{"y": {Xsum: []byte{1}}}).Root()}}
+	dir := map[string]IndexEntry{"x/y": {Xsum: []byte{1}}}
+	if bytes.Equal(NewTree(dirAsFile).Root(), NewTree(dir).Root()) {
+		t.Errorf("a file with a folder's hash has the same root hash as the folder")
+	}
+
+	if s := NewTree(files).Subtrees([]string{"missing"})[0]; s.Hash != nil || s.Children != nil {
+		t.Errorf("subtree of a missing folder = %v, want nothing", s)
+	}
+}
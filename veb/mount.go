@@ -0,0 +1,98 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// finds where removable drives & network shares are mounted, so remotes that
+// moved to a different mount point can be found again
+
+package veb
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	MOUNTS_FILE = "/proc/mounts" // Linux
+)
+
+// The usual places drives get mounted, for systems without MOUNTS_FILE
+var mountGlobs = []string{
+	"/Volumes/*",     // OS X
+	"/media/*",       // Linux, older desktops
+	"/media/*/*",     // Linux, per-user
+	"/run/media/*/*", // Linux, per-user
+	"/mnt/*",         // by hand
+}
+
+// Returns the current mount points, sorted.
+func MountPoints() []string {
+	found := make(map[string]bool)
+
+	// the system's mount table, if it has one
+	file, err := os.Open(MOUNTS_FILE)
+	if err == nil {
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) > 1 {
+				found[unescapeMount(fields[1])] = true
+			}
+		}
+		file.Close()
+	}
+
+	// and the usual places
+	for _, glob := range mountGlobs {
+		matches, _ := filepath.Glob(glob)
+		for _, m := range matches {
+			fi, err := os.Stat(m)
+			if err == nil && fi.IsDir() {
+				found[m] = true
+			}
+		}
+	}
+
+	ret := make([]string, 0, len(found))
+	for m := range found {
+		ret = append(ret, m)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Returns the places dir might be if its drive were mounted somewhere else:
+// every mount point joined with every tail of dir.
+// e.g. /media/backup1/veb/music could be /media/backup2/veb/music or
+// /Volumes/backup/music.
+func MountCandidates(dir string) []string {
+	parts := strings.Split(strings.Trim(filepath.Clean(dir), "/"), "/")
+	ret := make([]string, 0)
+	for _, m := range MountPoints() {
+		for i := range parts {
+			ret = append(ret, filepath.Join(m, filepath.Join(parts[i:]...)))
+		}
+	}
+	return ret
+}
+
+// Undoes the octal escapes (e.g. "\040" for space) in MOUNTS_FILE
+func unescapeMount(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			n, err := strconv.ParseUint(s[i+1:i+4], 8, 8)
+			if err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,300 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// NetTransport is a Transport for remote repositories served by 'veb serve'.
+//
+// It keeps a few connections to the server open so that push's handlers can
+// send files side by side; each call takes a connection for as long as it
+// needs one. See Server for the protocol.
+
+package veb
+
+import (
+	"crypto/tls"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+)
+
+const (
+	MAX_CONNS = 8 // idle connections kept per NetTransport
+)
+
+type NetTransport struct {
+	url  string
+	repo string // repository's path on the server
+	dial func() (io.ReadWriteCloser, error)
+	idle chan *netConn // open connections not in use
+	log  *Log          // error/warn/info logging
+}
+
+// One connection to the server
+type netConn struct {
+	rwc io.ReadWriteCloser
+	enc *gob.Encoder
+	dec *gob.Decoder
+}
+
+// Returns a NetTransport for a veb://host[:port]/path URL.
+// Nothing is connected until the first call.
+func NewNetTransport(u *url.URL, log *Log) (*NetTransport, error) {
+	config, err := clientTLS(u)
+	if err != nil {
+		return nil, err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), SERVE_PORT)
+	}
+
+	dial := func() (io.ReadWriteCloser, error) {
+		return tls.Dial("tcp", addr, config)
+	}
+	return newNetTransport(u.String(), u.Path, dial, log), nil
+}
+
+// Returns a NetTransport that makes connections with dial
+func newNetTransport(rawurl, repo string, dial func() (io.ReadWriteCloser, error), log *Log) *NetTransport {
+	return &NetTransport{rawurl, repo, dial, make(chan *netConn, MAX_CONNS), log}
+}
+
+func (t *NetTransport) URL() string {
+	return t.url
+}
+
+func (t *NetTransport) LoadIndex() (*Index, error) {
+	resp, err := t.call(request{Op: OP_LOAD_INDEX})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Index == nil {
+		return nil, fmt.Errorf("veb server at %s sent no index", t.url)
+	}
+	return remoteIndex(resp.Index, t.url, t.log), nil
+}
+
+func (t *NetTransport) SaveIndex(x *Index) error {
+	resp, err := t.call(request{Op: OP_SAVE_INDEX, Index: x})
+	if err != nil {
+		return err
+	}
+	x.Generation = resp.Generation
+	return nil
+}
+
+func (t *NetTransport) Check(x *Index, changed chan IndexEntry) error {
+	defer close(changed)
+	resp, err := t.call(request{Op: OP_CHECK})
+	if err != nil {
+		t.log.Err().Println(err)
+		return err
+	}
+	for _, e := range resp.Entries {
+		changed <- e
+	}
+	return nil
+}
+
+func (t *NetTransport) Stat(p string) (os.FileInfo, error) {
+	resp, err := t.call(request{Op: OP_STAT, Path: p})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Stat, nil
+}
+
+func (t *NetTransport) Open(p string) (io.ReadCloser, error) {
+	c, err := t.get()
+	if err != nil {
+		return nil, err
+	}
+	req := request{Op: OP_OPEN, Path: p}
+	resp, err := c.roundTrip(req)
+	if err != nil {
+		c.rwc.Close()
+		return nil, err
+	}
+	if resp.Err != "" {
+		t.put(c)
+		return nil, resp.err(req)
+	}
+	return &netReader{chunkReader{dec: c.dec}, c, t}, nil
+}
+
+func (t *NetTransport) OpenRange(p string, off, n int64) (io.ReadCloser, error) {
+	c, err := t.get()
+	if err != nil {
+		return nil, err
+	}
+	req := request{Op: OP_READ, Path: p, Off: off, N: n}
+	resp, err := c.roundTrip(req)
+	if err != nil {
+		c.rwc.Close()
+		return nil, err
+	}
+	if resp.Err != "" {
+		t.put(c)
+		return nil, resp.err(req)
+	}
+	return &netReader{chunkReader{dec: c.dec}, c, t}, nil
+}
+
+// The server hashes its own tree, and only sends the subtrees asked for
+func (t *NetTransport) Subtrees(dirs []string) (string, []Subtree, error) {
+	resp, err := t.call(request{Op: OP_TREE, Dirs: dirs})
+	if err != nil {
+		return "", nil, err
+	}
+	return resp.UUID, resp.Subtrees, nil
+}
+
+func (t *NetTransport) Write(entry IndexEntry, r io.Reader) error {
+	c, err := t.get()
+	if err != nil {
+		return err
+	}
+	req := request{Op: OP_WRITE, Path: entry.Path, Entry: entry}
+	err = c.enc.Encode(req)
+	if err == nil {
+		err = sendChunks(c.enc, r)
+	}
+	var resp response
+	if err == nil {
+		err = c.dec.Decode(&resp)
+	}
+	if err != nil {
+		c.rwc.Close()
+		return err
+	}
+	t.put(c)
+	return resp.err(req)
+}
+
+func (t *NetTransport) Rename(from, to string) error {
+	_, err := t.call(request{Op: OP_RENAME, Path: from, To: to})
+	return err
+}
+
+func (t *NetTransport) Remove(p string) error {
+	_, err := t.call(request{Op: OP_REMOVE, Path: p})
+	return err
+}
+
+func (t *NetTransport) FreeSpace() (int64, error) {
+	resp, err := t.call(request{Op: OP_FREE})
+	return resp.Free, err
+}
+
+// Checksums the file on the server, without sending it over
+func (t *NetTransport) Xsum(p string) ([]byte, error) {
+	resp, err := t.call(request{Op: OP_XSUM, Path: p})
+	return resp.Xsum, err
+}
+
+func (t *NetTransport) Close() error {
+	for {
+		select {
+		case c := <-t.idle:
+			c.rwc.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// Sends a request that has no file contents & returns the response.
+// Errors from the server come back as errors.
+func (t *NetTransport) call(req request) (response, error) {
+	c, err := t.get()
+	if err != nil {
+		return response{}, err
+	}
+	resp, err := c.roundTrip(req)
+	if err != nil {
+		c.rwc.Close()
+		return resp, err
+	}
+	t.put(c)
+	return resp, resp.err(req)
+}
+
+// Takes an idle connection, or makes a new one
+func (t *NetTransport) get() (*netConn, error) {
+	select {
+	case c := <-t.idle:
+		return c, nil
+	default:
+	}
+
+	rwc, err := t.dial()
+	if err != nil {
+		return nil, fmt.Errorf("veb could not connect to %s: %v", t.url, err)
+	}
+	c := &netConn{rwc, gob.NewEncoder(rwc), gob.NewDecoder(rwc)}
+	resp, err := c.roundTrip(hello{SERVE_VERSION, t.repo})
+	if err == nil && resp.Err != "" {
+		err = errors.New(resp.Err)
+	}
+	if err != nil {
+		rwc.Close()
+		return nil, fmt.Errorf("veb could not connect to %s: %v", t.url, err)
+	}
+	return c, nil
+}
+
+// Keeps a connection for the next call, if there's room
+func (t *NetTransport) put(c *netConn) {
+	select {
+	case t.idle <- c:
+	default:
+		c.rwc.Close()
+	}
+}
+
+// Sends msg, then reads the response
+func (c *netConn) roundTrip(msg interface{}) (response, error) {
+	var resp response
+	err := c.enc.Encode(msg)
+	if err == nil {
+		err = c.dec.Decode(&resp)
+	}
+	return resp, err
+}
+
+// The server's error, if it sent one
+func (resp response) err(req request) error {
+	if resp.Err == "" {
+		return nil
+	}
+	if resp.NotExist {
+		return &os.PathError{Op: req.Op, Path: req.Path, Err: os.ErrNotExist}
+	}
+	return errors.New(resp.Err)
+}
+
+// A file being read from the server. Its connection is busy until it's closed.
+type netReader struct {
+	chunkReader
+	c *netConn
+	t *NetTransport
+}
+
+func (r *netReader) Close() error {
+	if r.c == nil {
+		return nil
+	}
+	// finish reading the file so the connection can be used again
+	_, err := io.Copy(io.Discard, &r.chunkReader)
+	if err != nil && !r.done {
+		r.c.rwc.Close()
+	} else {
+		r.t.put(r.c)
+	}
+	r.c = nil
+	return nil
+}
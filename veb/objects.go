@@ -0,0 +1,303 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// ObjectTransport stores a remote's files by checksum instead of by path,
+// git-style: each file's contents are an object at
+//   .veb/objects/<first 2 hex digits>/<hex xsum>
+// and .veb/paths maps the paths veb uses (including the trash's & versions')
+// to their objects. Identical files are only stored once, renames & moves
+// into the trash or versions don't copy anything, and a remote object is good
+// if its checksum matches its name.
+//
+// Objects nothing refers to any more are deleted once the path map that stops
+// referring to them is saved. The path map is saved along with the remote's
+// index, and when the transport is closed.
+
+package veb
+
+import (
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+const (
+	LAYOUT_OBJECTS = "objects" // Index.Layout of remotes stored by checksum
+	OBJECTS_FOLDER = "objects" // inside of META_FOLDER only
+	PATHS_FILE     = "paths"   // inside of META_FOLDER only
+)
+
+type ObjectTransport struct {
+	Transport                          // the remote's own transport
+	paths     map[string][]byte        // path -> xsum of every file stored as an object
+	refs      map[string]int           // hex xsum -> paths that refer to it
+	unused    map[string]bool          // hex xsums whose refs dropped to 0
+	writing   map[string]chan struct{} // hex xsums being written; closed when done
+	dirty     bool                     // paths changed since saved
+	lock      sync.Mutex
+	log       *Log // error/warn/info logging
+}
+
+// Wraps t in an ObjectTransport if the remote (whose index is x) is laid out
+// by checksum.
+func WrapObjects(t Transport, x *Index, log *Log) (Transport, error) {
+	if x.Layout != LAYOUT_OBJECTS {
+		return t, nil
+	}
+
+	ot := &ObjectTransport{
+		Transport: t,
+		paths:     make(map[string][]byte),
+		refs:      make(map[string]int),
+		unused:    make(map[string]bool),
+		writing:   make(map[string]chan struct{}),
+		log:       log,
+	}
+	err := loadGob(t, path.Join(META_FOLDER, PATHS_FILE), &ot.paths)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, xsum := range ot.paths {
+		ot.refs[hex.EncodeToString(xsum)]++
+	}
+	return ot, nil
+}
+
+// Where the object with checksum xsum is kept
+func ObjectPath(xsum []byte) string {
+	h := hex.EncodeToString(xsum)
+	return path.Join(META_FOLDER, OBJECTS_FOLDER, h[:2], h)
+}
+
+// Saves the path map (see save()) before the index that relies on it
+func (t *ObjectTransport) SaveIndex(x *Index) error {
+	err := t.save()
+	if err != nil {
+		return err
+	}
+	return t.Transport.SaveIndex(x)
+}
+
+// Remotes stored by checksum have no working copy to check.
+func (t *ObjectTransport) Check(x *Index, changed chan IndexEntry) error {
+	close(changed)
+	return nil
+}
+
+// Stats of p's object, under p's name
+func (t *ObjectTransport) Stat(p string) (os.FileInfo, error) {
+	xsum, ok := t.object(p)
+	if !ok {
+		return t.Transport.Stat(p)
+	}
+	info, err := t.Transport.Stat(ObjectPath(xsum))
+	if err != nil {
+		return nil, err
+	}
+	return netStat{path.Base(p), info.Size(), info.Mode(), info.ModTime()}, nil
+}
+
+func (t *ObjectTransport) Open(p string) (io.ReadCloser, error) {
+	xsum, ok := t.object(p)
+	if !ok {
+		return t.Transport.Open(p)
+	}
+	return t.Transport.Open(ObjectPath(xsum))
+}
+
+func (t *ObjectTransport) OpenRange(p string, off, n int64) (io.ReadCloser, error) {
+	rr, ok := t.Transport.(RangeReader)
+	if !ok {
+		return nil, ErrNoRange
+	}
+	xsum, ok := t.object(p)
+	if ok {
+		p = ObjectPath(xsum)
+	}
+	return rr.OpenRange(p, off, n)
+}
+
+// Files with a checksum become objects; if the remote has the object already,
+// nothing is sent. Files without one (veb's own metadata) are written to p.
+// Identical files written at once are sent once: the others wait for it.
+func (t *ObjectTransport) Write(entry IndexEntry, r io.Reader) error {
+	if entry.Xsum == nil {
+		return t.Transport.Write(entry, r)
+	}
+
+	h := hex.EncodeToString(entry.Xsum)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for t.refs[h] == 0 {
+		done, busy := t.writing[h]
+		if !busy {
+			err := t.writeObject(h, entry, r)
+			if err != nil {
+				return err
+			}
+			break
+		}
+		// see whether the other write worked
+		t.lock.Unlock()
+		<-done
+		t.lock.Lock()
+	}
+	t.set(cleanPath(entry.Path), entry.Xsum)
+	return nil
+}
+
+// Writes entry's object, if the remote doesn't have it, with the object
+// marked as being written. Call with lock held; it's let go while writing.
+func (t *ObjectTransport) writeObject(h string, entry IndexEntry, r io.Reader) error {
+	done := make(chan struct{})
+	t.writing[h] = done
+	t.lock.Unlock()
+
+	obj := entry
+	obj.Path = ObjectPath(entry.Xsum)
+	_, err := t.Transport.Stat(obj.Path)
+	if os.IsNotExist(err) {
+		err = t.Transport.Write(obj, r)
+	}
+
+	t.lock.Lock()
+	delete(t.writing, h)
+	close(done)
+	return err
+}
+
+// Moves p, or every file under folder p, to another path. No objects move.
+func (t *ObjectTransport) Rename(from, to string) error {
+	from, to = cleanPath(from), cleanPath(to)
+	t.lock.Lock()
+	var moving []string
+	for p := range t.paths {
+		if p == from || strings.HasPrefix(p, from+"/") {
+			moving = append(moving, p)
+		}
+	}
+	for _, p := range moving {
+		xsum := t.paths[p]
+		t.unset(p)
+		t.set(to+p[len(from):], xsum)
+	}
+	t.lock.Unlock()
+
+	if len(moving) == 0 {
+		return t.Transport.Rename(from, to)
+	}
+	return nil
+}
+
+// Forgets p, or every file under folder p. Their objects go when the path
+// map is next saved, if nothing else refers to them.
+func (t *ObjectTransport) Remove(p string) error {
+	p = cleanPath(p)
+	t.lock.Lock()
+	removed := false
+	for have := range t.paths {
+		if have == p || strings.HasPrefix(have, p+"/") {
+			t.unset(have)
+			removed = true
+		}
+	}
+	t.lock.Unlock()
+
+	err := t.Transport.Remove(p)
+	if removed && os.IsNotExist(err) {
+		err = nil // it was all objects
+	}
+	return err
+}
+
+// Checksums p's object where it is, if the remote's own transport can
+func (t *ObjectTransport) Xsum(p string) ([]byte, error) {
+	cs, ok := t.Transport.(Checksummer)
+	if !ok {
+		return nil, ErrNoXsum
+	}
+	xsum, ok := t.object(p)
+	if ok {
+		p = ObjectPath(xsum)
+	}
+	return cs.Xsum(p)
+}
+
+// Replaces the bad object entry's file is stored as, which every path
+// sharing it gets the good copy of
+func (t *ObjectTransport) Repair(bin string, entry IndexEntry, r io.Reader) (string, error) {
+	return replace(t.Transport, ObjectPath(entry.Xsum), QuarantinePath(bin, entry.Path), entry, r)
+}
+
+func (t *ObjectTransport) Close() error {
+	err := t.save()
+	if err != nil {
+		t.log.Err().Println("could not save", PATHS_FILE, ":", err)
+	}
+	return t.Transport.Close()
+}
+
+// Saves the path map if it changed, then deletes the objects it doesn't
+// refer to any more.
+func (t *ObjectTransport) save() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.dirty {
+		return nil
+	}
+
+	err := saveGob(t.Transport, path.Join(META_FOLDER, PATHS_FILE), t.paths)
+	if err != nil {
+		return err
+	}
+	t.dirty = false
+
+	for h := range t.unused {
+		if t.refs[h] == 0 {
+			xsum, _ := hex.DecodeString(h)
+			err := t.Transport.Remove(ObjectPath(xsum))
+			if err != nil && !os.IsNotExist(err) {
+				t.log.Warn().Println("could not delete unused object", h, ":", err)
+				continue
+			}
+		}
+		delete(t.unused, h)
+	}
+	return nil
+}
+
+// The checksum of p's object, if p is stored as one
+func (t *ObjectTransport) object(p string) ([]byte, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	xsum, ok := t.paths[cleanPath(p)]
+	return xsum, ok
+}
+
+// Points p at xsum's object. Call with lock held.
+func (t *ObjectTransport) set(p string, xsum []byte) {
+	t.unset(p)
+	t.paths[p] = xsum
+	t.refs[hex.EncodeToString(xsum)]++
+	t.dirty = true
+}
+
+// Forgets p. Call with lock held.
+func (t *ObjectTransport) unset(p string) {
+	xsum, ok := t.paths[p]
+	if !ok {
+		return
+	}
+	h := hex.EncodeToString(xsum)
+	delete(t.paths, p)
+	t.refs[h]--
+	if t.refs[h] <= 0 {
+		delete(t.refs, h)
+		t.unused[h] = true
+	}
+	t.dirty = true
+}
@@ -0,0 +1,262 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package veb
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A LocalTransport that counts the objects written to it, and can hold each
+// object write until it's let go
+type gatedTransport struct {
+	*LocalTransport
+	lock    sync.Mutex
+	writes  int           // objects written, or tried
+	started chan struct{} // if not nil, gets a value as each object write starts
+	gate    chan error    // if not nil, each object write waits (a second at most) for a value, & fails with it
+}
+
+func (t *gatedTransport) Write(entry IndexEntry, r io.Reader) error {
+	if !strings.HasPrefix(entry.Path, META_FOLDER+"/"+OBJECTS_FOLDER+"/") {
+		return t.LocalTransport.Write(entry, r)
+	}
+	t.lock.Lock()
+	t.writes++
+	t.lock.Unlock()
+	if t.started != nil {
+		t.started <- struct{}{}
+	}
+	if t.gate != nil {
+		select {
+		case err := <-t.gate:
+			if err != nil {
+				return err
+			}
+		case <-time.After(time.Second):
+			return errors.New("gate never opened")
+		}
+	}
+	return t.LocalTransport.Write(entry, r)
+}
+
+// An ObjectTransport for a new repository, on top of a gatedTransport
+func newTestObjects(t *testing.T) (string, *ObjectTransport, *gatedTransport) {
+	root := newTestRepo(t)
+	gt := &gatedTransport{LocalTransport: NewLocalTransport(root, testLog())}
+	return root, openTestObjects(t, gt), gt
+}
+
+// Wraps tr in an ObjectTransport, loading the path map it has saved
+func openTestObjects(t *testing.T, tr Transport) *ObjectTransport {
+	ot, err := WrapObjects(tr, &Index{Layout: LAYOUT_OBJECTS}, testLog())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ot.(*ObjectTransport)
+}
+
+// Whether xsum's object is on disk under root
+func haveObject(root string, xsum []byte) bool {
+	_, err := os.Stat(filepath.Join(root, ObjectPath(xsum)))
+	return err == nil
+}
+
+func TestObjectsShared(t *testing.T) {
+	root, ot, gt := newTestObjects(t)
+	entry, data := testFile("a/x.mp3", 1000)
+	for _, p := range []string{"a/x.mp3", "b/y.mp3"} {
+		entry.Path = p
+		err := ot.Write(entry, bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if gt.writes != 1 {
+		t.Errorf("%d objects written for 2 identical files, want 1", gt.writes)
+	}
+	for _, p := range []string{"a/x.mp3", "b/y.mp3"} {
+		r, err := ot.Open(p)
+		if got := readAll(t, r, err); !bytes.Equal(got, data) {
+			t.Errorf("%s has %d bytes, not what was written", p, len(got))
+		}
+	}
+
+	// one path goes; the other still has the object
+	err := ot.Remove("a/x.mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ot.save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !haveObject(root, entry.Xsum) {
+		t.Fatalf("removing one of two paths deleted their object")
+	}
+	if _, err := ot.Open("a/x.mp3"); !os.IsNotExist(err) {
+		t.Errorf("Open of a removed path: %v, want a not-exist error", err)
+	}
+	r, err := ot.Open("b/y.mp3")
+	if got := readAll(t, r, err); !bytes.Equal(got, data) {
+		t.Errorf("b/y.mp3 has %d bytes after a/x.mp3 was removed", len(got))
+	}
+
+	// the other path goes; the object stays until the path map is saved
+	err = ot.Remove("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !haveObject(root, entry.Xsum) {
+		t.Fatalf("object deleted before the path map was saved")
+	}
+	err = ot.save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if haveObject(root, entry.Xsum) {
+		t.Errorf("object nothing refers to is still there after saving")
+	}
+}
+
+// An object removed & written again before a save isn't deleted by it
+func TestObjectsUnusedThenUsed(t *testing.T) {
+	root, ot, _ := newTestObjects(t)
+	entry, data := testFile("a.mp3", 100)
+	err := ot.Write(entry, bytes.NewReader(data))
+	if err == nil {
+		err = ot.save()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ot.Remove(entry.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry.Path = "b.mp3"
+	err = ot.Write(entry, bytes.NewReader(data))
+	if err == nil {
+		err = ot.save()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !haveObject(root, entry.Xsum) {
+		t.Errorf("object written again before the save was deleted by it")
+	}
+}
+
+// Moving a folder into the trash moves every path in it, & copies nothing
+func TestObjectsRenameToTrash(t *testing.T) {
+	root, ot, gt := newTestObjects(t)
+	files := map[string][]byte{}
+	for i, p := range []string{"music/a.mp3", "music/b/c.mp3", "musical.mp3"} {
+		entry, data := testFile(p, 100+i)
+		files[p] = data
+		err := ot.Write(entry, bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	trash := path.Join(META_FOLDER, TRASH_FOLDER, "20120304-050607", "music")
+	err := ot.Rename("music", trash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ot.save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gt.writes != 3 {
+		t.Errorf("%d objects written, want 3", gt.writes)
+	}
+
+	// as a new transport would find it
+	ot = openTestObjects(t, gt)
+	for p, data := range files {
+		if strings.HasPrefix(p, "music/") {
+			if _, err := ot.Open(p); !os.IsNotExist(err) {
+				t.Errorf("Open of %s after it went to the trash: %v, want a not-exist error", p, err)
+			}
+			p = trash + p[len("music"):]
+		}
+		r, err := ot.Open(p)
+		if got := readAll(t, r, err); !bytes.Equal(got, data) {
+			t.Errorf("%s has %d bytes, not what was written", p, len(got))
+		}
+		entry, _ := testFile(p, len(data))
+		if !haveObject(root, entry.Xsum) {
+			t.Errorf("%s's object is gone", p)
+		}
+	}
+}
+
+// Identical files written at once are sent once
+func TestObjectsWriteTogether(t *testing.T) {
+	_, ot, gt := newTestObjects(t)
+	gt.started, gt.gate = make(chan struct{}, 4), make(chan error)
+	entry, data := testFile("a.mp3", 1000)
+
+	errs := make(chan error)
+	write := func(p string) {
+		e := entry
+		e.Path = p
+		errs <- ot.Write(e, bytes.NewReader(data))
+	}
+	go write("a.mp3")
+	<-gt.started
+	go write("b.mp3")
+	time.Sleep(20 * time.Millisecond) // b.mp3 waits for a.mp3's object
+	gt.gate <- nil
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if gt.writes != 1 {
+		t.Errorf("%d objects written for 2 identical files at once, want 1", gt.writes)
+	}
+	for _, p := range []string{"a.mp3", "b.mp3"} {
+		r, err := ot.Open(p)
+		if got := readAll(t, r, err); !bytes.Equal(got, data) {
+			t.Errorf("%s has %d bytes, not what was written", p, len(got))
+		}
+	}
+
+	// if the first write fails, the one waiting for it writes the object
+	entry, data = testFile("c.mp3", 2000)
+	go write("c.mp3")
+	<-gt.started
+	go write("d.mp3")
+	time.Sleep(20 * time.Millisecond)
+	gt.gate <- errors.New("cut off")
+	<-gt.started
+	gt.gate <- nil
+	failed := 0
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			failed++
+		}
+	}
+	if failed != 1 || gt.writes != 3 {
+		t.Errorf("%d writes failed & %d objects written in all, want 1 & 3", failed, gt.writes)
+	}
+	_, cerr := ot.Stat("c.mp3")
+	_, derr := ot.Stat("d.mp3")
+	if (cerr == nil) == (derr == nil) {
+		t.Errorf("Stat of c.mp3: %v, & of d.mp3: %v; want just the one that worked", cerr, derr)
+	}
+}
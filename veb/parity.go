@@ -0,0 +1,474 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Parity is recovery data for a committed file, so a repository with no other
+// copy can still repair it ('veb parity create', 'veb repair'). Each file's
+// parity is kept at
+//   .veb/parity/<path>.vpar
+// The file is cut into rows of up to PARITY_MAX_DATA equal blocks, and each
+// row gets Reed-Solomon parity blocks (see RSCode), enough to make up the
+// percentage asked for. Every block's CRC is kept, so damaged blocks can be
+// found; a row can lose as many blocks as it has parity blocks, whether data
+// or parity, and still be rebuilt. Blocks are small enough that a row spans
+// at most 64MB, so the file is read and repaired front to back.
+//
+// A .vpar file is "VEBPAR1\n", then the parity blocks row by row, then its
+// header (a gob encoded Parity), then the header's length (8 bytes, big
+// endian). This isn't PAR2; par2 tools can't read it.
+
+package veb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	PARITY_FOLDER   = "parity" // inside of META_FOLDER only
+	PARITY_SUFFIX   = ".vpar"
+	PARITY_MAGIC    = "VEBPAR1\n"
+	PARITY_MAX_DATA = 64          // most data blocks per row
+	PARITY_MIN_CELL = 512         // smallest block size; all are a multiple of it
+	PARITY_MAX_CELL = 1024 * 1024 // largest block size
+)
+
+var parityCRC = crc32.MakeTable(crc32.Castagnoli)
+
+// How a file's parity is laid out, and the CRCs to find damage with
+type Parity struct {
+	Xsum       []byte   // checksum of the file it was made for
+	Size       int64    // ...and its size
+	CellSize   int      // bytes per block
+	Data       int      // data blocks per row
+	Parity     int      // parity blocks per row
+	Percent    int      // how much parity was asked for
+	DataCRCs   []uint32 // every data block's CRC, row by row
+	ParityCRCs []uint32 // every parity block's CRC, row by row
+}
+
+// Part of a file
+type ByteRange struct {
+	From, To int64 // To is the first byte after it
+}
+
+// What repairing a file found and did
+type ParityReport struct {
+	Damaged     []ByteRange // parts of the file that were damaged
+	BadParity   int         // parity blocks that were damaged too
+	Quarantined string      // where the bad copy went, if it was repaired
+}
+
+// Where the parity of a file is kept
+func ParityPath(file string) string {
+	return path.Join(META_FOLDER, PARITY_FOLDER, file+PARITY_SUFFIX)
+}
+
+// Works out the block size, and data & parity blocks per row, for percent
+// parity on a file of size bytes
+func parityLayout(size int64, percent int) (*Parity, error) {
+	cell := (size + PARITY_MAX_DATA - 1) / PARITY_MAX_DATA
+	cell = (cell + PARITY_MIN_CELL - 1) / PARITY_MIN_CELL * PARITY_MIN_CELL
+	if cell < PARITY_MIN_CELL {
+		cell = PARITY_MIN_CELL
+	}
+	if cell > PARITY_MAX_CELL {
+		cell = PARITY_MAX_CELL
+	}
+	k := (size + cell - 1) / cell
+	if k > PARITY_MAX_DATA {
+		k = PARITY_MAX_DATA
+	}
+	m := (k*int64(percent) + 99) / 100
+	if m < 1 {
+		m = 1
+	}
+	if k+m > RS_TOTAL {
+		return nil, fmt.Errorf("%d%% parity is too much (at most %d%%)", percent, (RS_TOTAL-k)*100/k)
+	}
+	return &Parity{Size: size, CellSize: int(cell), Data: int(k), Parity: int(m), Percent: percent}, nil
+}
+
+// Rows of blocks in the file
+func (p *Parity) rows() int64 {
+	row := int64(p.CellSize) * int64(p.Data)
+	return (p.Size + row - 1) / row
+}
+
+// Makes percent parity for entry's file in repository root, reading it no
+// faster than limiter allows. The file must match its committed checksum;
+// parity for a bad copy would only help put the damage back.
+func CreateParity(ctx context.Context, root string, entry IndexEntry, percent int, limiter *Limiter, log *Log) error {
+	if entry.Size == 0 {
+		return fmt.Errorf("%s is empty; there's nothing to protect", entry.Path)
+	}
+	p, err := parityLayout(entry.Size, percent)
+	if err != nil {
+		return err
+	}
+	p.Xsum = entry.Xsum
+	code, err := NewRSCode(p.Data, p.Parity)
+	if err != nil {
+		return err
+	}
+
+	file, err := OpenUncached(path.Join(root, entry.Path))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	dest := path.Join(root, ParityPath(entry.Path))
+	err = os.MkdirAll(path.Dir(dest), 0755)
+	if err != nil {
+		return err
+	}
+	tmp := dest + TEMP_SUFFIX
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp) // if it didn't get renamed into place
+	defer out.Close()
+
+	// read the file a row at a time, checksumming it on the way
+	hasher := NewHasher()
+	in := io.TeeReader(limiter.Reader(ContextReader(ctx, file)), hasher)
+	data, parity := makeBlocks(p.Data, p.CellSize), makeBlocks(p.Parity, p.CellSize)
+	_, err = out.WriteString(PARITY_MAGIC)
+	for r := int64(0); r < p.rows() && err == nil; r++ {
+		for _, block := range data {
+			n, rerr := io.ReadFull(in, block)
+			zero(block[n:]) // the last row is padded with zeros
+			if rerr != nil && rerr != io.EOF && rerr != io.ErrUnexpectedEOF {
+				return rerr
+			}
+			p.DataCRCs = append(p.DataCRCs, crc32.Checksum(block, parityCRC))
+		}
+		code.Encode(data, parity)
+		for _, block := range parity {
+			p.ParityCRCs = append(p.ParityCRCs, crc32.Checksum(block, parityCRC))
+			_, err = out.Write(block)
+			if err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(io.Discard, in) // anything past the committed size
+	if err != nil {
+		return err
+	}
+	if n != 0 || !bytes.Equal(hasher.Sum(nil), entry.Xsum) {
+		return fmt.Errorf("%s doesn't match its checksum; no parity made for a bad copy", entry.Path)
+	}
+
+	// header last, as it has the CRCs
+	var header bytes.Buffer
+	err = gob.NewEncoder(&header).Encode(p)
+	if err == nil {
+		_, err = out.Write(header.Bytes())
+	}
+	if err == nil {
+		err = binary.Write(out, binary.BigEndian, uint64(header.Len()))
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
+
+// Reads the header of file's parity in repository root
+func LoadParity(root, file string) (*Parity, error) {
+	in, err := os.Open(path.Join(root, ParityPath(file)))
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	return readParity(in)
+}
+
+func readParity(in *os.File) (*Parity, error) {
+	info, err := in.Stat()
+	if err != nil {
+		return nil, err
+	}
+	magic := make([]byte, len(PARITY_MAGIC))
+	_, err = in.ReadAt(magic, 0)
+	var length uint64
+	if err == nil {
+		err = binary.Read(io.NewSectionReader(in, info.Size()-8, 8), binary.BigEndian, &length)
+	}
+	if err != nil || string(magic) != PARITY_MAGIC || length > uint64(info.Size()) {
+		return nil, fmt.Errorf("%s isn't veb parity", in.Name())
+	}
+
+	var p Parity
+	err = gob.NewDecoder(io.NewSectionReader(in, info.Size()-8-int64(length), int64(length))).Decode(&p)
+	if err != nil {
+		return nil, fmt.Errorf("bad parity header in %s: %v", in.Name(), err)
+	}
+	rows := p.rows()
+	if int64(len(p.DataCRCs)) != rows*int64(p.Data) || int64(len(p.ParityCRCs)) != rows*int64(p.Parity) {
+		return nil, fmt.Errorf("bad parity header in %s", in.Name())
+	}
+	return &p, nil
+}
+
+// Checks entry's file in repository root against its parity, reading no
+// faster than limiter allows, and rebuilds what's damaged. The repaired file
+// replaces the bad one, which goes into quarantine folder bin (see Repair).
+// Files that aren't damaged are left alone. Fails, changing nothing, if the
+// parity is for some other version of the file, or too much is damaged.
+func RepairFromParity(ctx context.Context, root string, entry IndexEntry, bin string, limiter *Limiter,
+	log *Log) (*ParityReport, error) {
+	par, err := os.Open(path.Join(root, ParityPath(entry.Path)))
+	if err != nil {
+		return nil, err
+	}
+	defer par.Close()
+	p, err := readParity(par)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(p.Xsum, entry.Xsum) || p.Size != entry.Size {
+		return nil, fmt.Errorf("%s's parity is for another version of it (see 'veb parity create')", entry.Path)
+	}
+
+	file, err := os.Open(path.Join(root, entry.Path))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// find the damage
+	report := &ParityReport{}
+	rows := newParityRows(ctx, p, file, par, limiter)
+	for r := int64(0); r < p.rows(); r++ {
+		err := rows.read(r, report)
+		if err != nil {
+			return report, err
+		}
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return report, err
+	}
+	if len(report.Damaged) == 0 && info.Size() == entry.Size {
+		return report, nil
+	}
+	if info.Size() > entry.Size {
+		report.Damaged = addRange(report.Damaged, ByteRange{entry.Size, info.Size()})
+	}
+
+	// write it out repaired
+	repo := NewLocalTransport(root, log)
+	report.Quarantined, err = Repair(repo, bin, entry, &parityReader{rows: newParityRows(ctx, p, file, par, limiter)})
+	if err != nil {
+		return report, err
+	}
+	return report, os.Chtimes(path.Join(root, entry.Path), entry.ModTime, entry.ModTime)
+}
+
+// Reads a file & its parity a row at a time, rebuilding damaged blocks
+type parityRows struct {
+	p            *Parity
+	code         *RSCode
+	file, par    io.ReaderAt
+	data, parity [][]byte
+}
+
+func newParityRows(ctx context.Context, p *Parity, file, par *os.File, limiter *Limiter) *parityRows {
+	code, _ := NewRSCode(p.Data, p.Parity) // checked by parityLayout when made
+	return &parityRows{p, code, &ctxReaderAt{ctx, file, limiter}, &ctxReaderAt{ctx, par, limiter},
+		makeBlocks(p.Data, p.CellSize), makeBlocks(p.Parity, p.CellSize)}
+}
+
+// Reads row r into data, repaired. Notes damage in report, if it's given.
+// Blocks that can't be read count as damaged; only being cancelled, or more
+// damage than there's parity for, is an error.
+func (rr *parityRows) read(r int64, report *ParityReport) error {
+	p := rr.p
+	cell := int64(p.CellSize)
+	bad := make([]bool, p.Data)
+	parityBad := make([]bool, p.Parity)
+	numBad := 0
+	for i, block := range rr.data {
+		from := (r*int64(p.Data) + int64(i)) * cell
+		n, err := rr.file.ReadAt(block, from)
+		zero(block[n:])
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			return err
+		}
+		if crc32.Checksum(block, parityCRC) != p.DataCRCs[r*int64(p.Data)+int64(i)] ||
+			(err != nil && err != io.EOF) {
+			bad[i] = true
+			numBad++
+			if report != nil {
+				to := from + cell
+				if to > p.Size {
+					to = p.Size
+				}
+				report.Damaged = addRange(report.Damaged, ByteRange{from, to})
+			}
+		}
+	}
+	for j, block := range rr.parity {
+		from := int64(len(PARITY_MAGIC)) + (r*int64(p.Parity)+int64(j))*cell
+		_, err := rr.par.ReadAt(block, from)
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			return err
+		}
+		if err != nil || crc32.Checksum(block, parityCRC) != p.ParityCRCs[r*int64(p.Parity)+int64(j)] {
+			parityBad[j] = true
+			if report != nil {
+				report.BadParity++
+			}
+		}
+	}
+	if numBad == 0 {
+		return nil
+	}
+
+	err := rr.code.Reconstruct(rr.data, rr.parity, bad, parityBad)
+	if err != nil {
+		from := r * int64(p.Data) * cell
+		return fmt.Errorf("too damaged to repair around bytes %d-%d: %v", from, from+int64(p.Data)*cell, err)
+	}
+	for i, block := range rr.data {
+		if bad[i] && crc32.Checksum(block, parityCRC) != p.DataCRCs[r*int64(p.Data)+int64(i)] {
+			return fmt.Errorf("rebuilding bytes %d-%d didn't work", (r*int64(p.Data)+int64(i))*cell,
+				(r*int64(p.Data)+int64(i)+1)*cell)
+		}
+	}
+	return nil
+}
+
+// The repaired file, front to back
+type parityReader struct {
+	rows *parityRows
+	row  int64
+	buf  []byte // what's left of the current row
+	pos  int64  // bytes read so far
+}
+
+func (pr *parityReader) Read(b []byte) (int, error) {
+	p := pr.rows.p
+	if pr.pos >= p.Size {
+		return 0, io.EOF
+	}
+	if len(pr.buf) == 0 {
+		err := pr.rows.read(pr.row, nil)
+		if err != nil {
+			return 0, err
+		}
+		pr.row++
+		pr.buf = bytes.Join(pr.rows.data, nil)
+		if left := p.Size - pr.pos; int64(len(pr.buf)) > left {
+			pr.buf = pr.buf[:left]
+		}
+	}
+	n := copy(b, pr.buf)
+	pr.buf = pr.buf[n:]
+	pr.pos += int64(n)
+	return n, nil
+}
+
+// ReadAt that stops when ctx is cancelled, no faster than limiter allows
+type ctxReaderAt struct {
+	ctx     context.Context
+	r       io.ReaderAt
+	limiter *Limiter
+}
+
+func (r *ctxReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	if r.ctx.Err() != nil {
+		return 0, r.ctx.Err()
+	}
+	n, err := r.r.ReadAt(b, off)
+	r.limiter.Wait(n)
+	return n, err
+}
+
+// Deletes the parity of files that aren't committed in x any more. Returns
+// which files' parity went.
+func PruneParity(x *Index) ([]string, error) {
+	folder := path.Join(x.Root, META_FOLDER, PARITY_FOLDER)
+	pruned := make([]string, 0)
+	err := filepath.Walk(folder, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(folder, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if strings.HasSuffix(rel, PARITY_SUFFIX) {
+			if _, ok := x.Files[strings.TrimSuffix(rel, PARITY_SUFFIX)]; ok {
+				return nil
+			}
+			pruned = append(pruned, strings.TrimSuffix(rel, PARITY_SUFFIX))
+		}
+		return os.Remove(p) // not veb parity for a committed file
+	})
+
+	// and the folders that left empty, deepest first
+	for _, p := range pruned {
+		for dir := path.Dir(path.Join(folder, p)); dir != folder; dir = path.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break // not empty
+			}
+		}
+	}
+	return pruned, err
+}
+
+// n blocks of size bytes
+func makeBlocks(n, size int) [][]byte {
+	blocks := make([][]byte, n)
+	for i := range blocks {
+		blocks[i] = make([]byte, size)
+	}
+	return blocks
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// Adds r to ranges (sorted), merging it into the last one if they touch
+func addRange(ranges []ByteRange, r ByteRange) []ByteRange {
+	if n := len(ranges); n > 0 && ranges[n-1].To >= r.From {
+		if r.To > ranges[n-1].To {
+			ranges[n-1].To = r.To
+		}
+		return ranges
+	}
+	return append(ranges, r)
+}
@@ -0,0 +1,95 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Quarantine holds bad copies of files that veb replaced with a good copy
+// from elsewhere ('veb scrub --repair'), so nothing is ever thrown away on
+// veb's say-so alone. Each run that repairs anything gets its own folder,
+// named after when it started:
+//   .veb/quarantine/<timestamp>/<path>
+// veb never empties the quarantine; look the files over, then delete them.
+
+package veb
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+const (
+	QUARANTINE_FOLDER = "quarantine" // inside of META_FOLDER only
+	REPAIR_SUFFIX     = ".good"      // good copies waiting to replace bad ones
+)
+
+// Transports that don't keep a file's contents at its path, so have to
+// replace bad copies their own way
+type Repairer interface {
+	Repair(bin string, entry IndexEntry, r io.Reader) (string, error)
+}
+
+// Names the quarantine folder for a run started at when
+func QuarantineBin(when time.Time) string {
+	return when.Format(TRASH_TIME)
+}
+
+// Returns where the bad copy of file goes in quarantine folder bin
+func QuarantinePath(bin, file string) string {
+	return path.Join(META_FOLDER, QUARANTINE_FOLDER, bin, file)
+}
+
+// Replaces the bad copy of entry's file in repo with r's contents, keeping the
+// bad copy in quarantine folder bin. r is written out and checked against
+// entry's checksum before anything is moved, so a bad or cut off good copy
+// changes nothing. Returns where the bad copy went, or "" if the file was
+// missing and there was no bad copy to keep.
+func Repair(repo Transport, bin string, entry IndexEntry, r io.Reader) (string, error) {
+	if rp, ok := repo.(Repairer); ok {
+		return rp.Repair(bin, entry, r)
+	}
+	return replace(repo, entry.Path, QuarantinePath(bin, entry.Path), entry, r)
+}
+
+// Replaces file p in repo with r (see Repair), moving the old p to q.
+// In local folders, the bad copy is hard linked into quarantine and the good
+// one renamed over it, so p is never missing. Elsewhere, the good copy waits
+// next to q until the bad one is out of the way. A missing p is just written.
+func replace(repo Transport, p, q string, entry IndexEntry, r io.Reader) (string, error) {
+	good := entry
+	_, err := repo.Stat(p)
+	if os.IsNotExist(err) {
+		good.Path = p
+		return "", repo.Write(good, r)
+	}
+
+	if local, ok := repo.(*LocalTransport); ok {
+		err := local.link(p, q)
+		if err == nil {
+			err = writeLocal(path.Join(local.root, p), entry, r)
+			if err != nil {
+				os.Remove(path.Join(local.root, q))
+				return "", err
+			}
+			return q, nil
+		}
+		local.log.Warn().Println("could not link", p, "into quarantine, so moving it:", err)
+	}
+
+	good.Path = q + REPAIR_SUFFIX
+	err = repo.Write(good, r)
+	if err != nil {
+		return "", err
+	}
+	err = repo.Rename(p, q)
+	if err != nil {
+		repo.Remove(good.Path)
+		return "", err
+	}
+	err = repo.Rename(good.Path, p)
+	if err != nil {
+		return q, fmt.Errorf("%s is in quarantine, but its good copy is stuck at %s: %v", p, good.Path, err)
+	}
+	return q, nil
+}
@@ -0,0 +1,174 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// A systematic Reed-Solomon erasure code over GF(2^8): k equal-sized data
+// blocks get m parity blocks, and any m of the k+m blocks can be lost and
+// rebuilt from the rest, as long as it's known which ones were lost.
+//
+// Parity block j is the sum over data blocks i of cauchy(j, i) * data block i,
+// byte by byte. Every square piece of a Cauchy matrix is invertible, so
+// whichever data blocks are lost, the parity blocks left can solve for them.
+
+package veb
+
+import (
+	"fmt"
+)
+
+const (
+	GF_POLY  = 0x11d // x^8 + x^4 + x^3 + x^2 + 1, as used by most RS codes
+	RS_TOTAL = 256   // most data + parity blocks a code can have
+)
+
+var gfExp [2 * 255]byte // gfExp[i] = 2^i
+var gfLog [256]int      // gfLog[gfExp[i]] = i
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfExp[i+255] = byte(x)
+		gfLog[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= GF_POLY
+		}
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[gfLog[a]+gfLog[b]]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-gfLog[a]]
+}
+
+// dst ^= c * src, byte by byte
+func gfMulAdd(dst, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	var table [256]byte
+	for i := range table {
+		table[i] = gfMul(c, byte(i))
+	}
+	for i, b := range src {
+		dst[i] ^= table[b]
+	}
+}
+
+// An erasure code for k data blocks and m parity blocks
+type RSCode struct {
+	k, m int
+}
+
+func NewRSCode(k, m int) (*RSCode, error) {
+	if k < 1 || m < 1 || k+m > RS_TOTAL {
+		return nil, fmt.Errorf("can't have %d data and %d parity blocks (at most %d in all)", k, m, RS_TOTAL)
+	}
+	return &RSCode{k, m}, nil
+}
+
+// Coefficient of data block i in parity block j: 1/(x_j + y_i), with the x's
+// and y's all different so it's never 1/0.
+func (c *RSCode) cauchy(j, i int) byte {
+	return gfInv(byte(c.k+j) ^ byte(i))
+}
+
+// Computes the parity blocks from the data blocks. All blocks must be the
+// same size.
+func (c *RSCode) Encode(data, parity [][]byte) {
+	for j := 0; j < c.m; j++ {
+		p := parity[j]
+		for x := range p {
+			p[x] = 0
+		}
+		for i := 0; i < c.k; i++ {
+			gfMulAdd(p, data[i], c.cauchy(j, i))
+		}
+	}
+}
+
+// Rebuilds the data blocks that bad says are lost, in place, from the good
+// ones and the parity blocks that parityBad doesn't say are lost. Fails if
+// more data blocks were lost than there are good parity blocks. Lost parity
+// blocks aren't rebuilt; Encode can do that from the repaired data.
+func (c *RSCode) Reconstruct(data, parity [][]byte, bad, parityBad []bool) error {
+	lost := make([]int, 0)
+	for i := 0; i < c.k; i++ {
+		if bad[i] {
+			lost = append(lost, i)
+		}
+	}
+	if len(lost) == 0 {
+		return nil
+	}
+	use := make([]int, 0, len(lost))
+	for j := 0; j < c.m && len(use) < len(lost); j++ {
+		if !parityBad[j] {
+			use = append(use, j)
+		}
+	}
+	if len(use) < len(lost) {
+		return fmt.Errorf("%d blocks lost, but only %d good parity blocks to rebuild them from", len(lost), len(use))
+	}
+
+	// what's left of each parity block after taking out the good data blocks
+	// is the lost data blocks' share of it: rhs = a * lost
+	size := len(parity[use[0]])
+	n := len(lost)
+	a := make([][]byte, n)
+	rhs := make([][]byte, n)
+	for r, j := range use {
+		a[r] = make([]byte, n)
+		for col, i := range lost {
+			a[r][col] = c.cauchy(j, i)
+		}
+		rhs[r] = make([]byte, size)
+		copy(rhs[r], parity[j])
+		for i := 0; i < c.k; i++ {
+			if !bad[i] {
+				gfMulAdd(rhs[r], data[i], c.cauchy(j, i))
+			}
+		}
+	}
+
+	// Gauss-Jordan elimination; a is invertible, so there's always a pivot
+	for col := 0; col < n; col++ {
+		pivot := col
+		for a[pivot][col] == 0 {
+			pivot++
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		rhs[col], rhs[pivot] = rhs[pivot], rhs[col]
+
+		inv := gfInv(a[col][col])
+		for x := range a[col] {
+			a[col][x] = gfMul(a[col][x], inv)
+		}
+		scaled := make([]byte, size)
+		gfMulAdd(scaled, rhs[col], inv)
+		rhs[col] = scaled
+
+		for r := 0; r < n; r++ {
+			if r == col || a[r][col] == 0 {
+				continue
+			}
+			f := a[r][col]
+			for x := range a[r] {
+				a[r][x] ^= gfMul(f, a[col][x])
+			}
+			gfMulAdd(rhs[r], rhs[col], f)
+		}
+	}
+
+	for col, i := range lost {
+		copy(data[i], rhs[col])
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package veb
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGF(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if p := gfMul(byte(a), gfInv(byte(a))); p != 1 {
+			t.Errorf("%d * 1/%d = %d", a, a, p)
+		}
+		for b := 0; b < 256; b++ {
+			if gfMul(byte(a), byte(b)) != gfMul(byte(b), byte(a)) {
+				t.Fatalf("%d * %d != %d * %d", a, b, b, a)
+			}
+		}
+	}
+	// x * x^7 = x^8 = x^4 + x^3 + x^2 + 1
+	if p := gfMul(2, 0x80); p != 0x1d {
+		t.Errorf("2 * 0x80 = %#x, want 0x1d", p)
+	}
+}
+
+// Random data blocks & their parity
+func testRows(t *testing.T, rng *rand.Rand, k, m, size int) (*RSCode, [][]byte, [][]byte) {
+	code, err := NewRSCode(k, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, parity := makeBlocks(k, size), makeBlocks(m, size)
+	for _, b := range data {
+		rng.Read(b)
+	}
+	code.Encode(data, parity)
+	return code, data, parity
+}
+
+// Loses the blocks in lost (data blocks first, then parity), rebuilds them,
+// and checks they came back
+func checkReconstruct(t *testing.T, code *RSCode, data, parity [][]byte, lost []int) {
+	t.Helper()
+	k, m := len(data), len(parity)
+	work, workParity := makeBlocks(k, len(data[0])), makeBlocks(m, len(data[0]))
+	for i := range data {
+		copy(work[i], data[i])
+	}
+	for j := range parity {
+		copy(workParity[j], parity[j])
+	}
+	bad, parityBad := make([]bool, k), make([]bool, m)
+	for _, b := range lost {
+		if b < k {
+			bad[b] = true
+			work[b][0] ^= 0xff
+			zero(work[b][1:])
+		} else {
+			parityBad[b-k] = true
+			zero(workParity[b-k])
+		}
+	}
+
+	err := code.Reconstruct(work, workParity, bad, parityBad)
+	if err != nil {
+		t.Fatalf("k=%d m=%d, lost %v: %v", k, m, lost, err)
+	}
+	for i := range data {
+		if !bytes.Equal(work[i], data[i]) {
+			t.Fatalf("k=%d m=%d, lost %v: data block %d came back wrong", k, m, lost, i)
+		}
+	}
+}
+
+// Every way of losing up to m blocks of small codes
+func TestRSReconstructAll(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, km := range [][2]int{{1, 1}, {3, 1}, {1, 3}, {5, 3}, {4, 4}, {6, 2}} {
+		k, m := km[0], km[1]
+		code, data, parity := testRows(t, rng, k, m, 33)
+		for set := 0; set < 1<<(k+m); set++ {
+			lost := make([]int, 0)
+			for b := 0; b < k+m; b++ {
+				if set&(1<<b) != 0 {
+					lost = append(lost, b)
+				}
+			}
+			if len(lost) <= m {
+				checkReconstruct(t, code, data, parity, lost)
+			}
+		}
+	}
+}
+
+// Random ways of losing m blocks of big codes
+func TestRSReconstructRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	for _, km := range [][2]int{{64, 7}, {64, 64}, {200, 56}} {
+		k, m := km[0], km[1]
+		code, data, parity := testRows(t, rng, k, m, 64)
+		for trial := 0; trial < 20; trial++ {
+			checkReconstruct(t, code, data, parity, rng.Perm(k + m)[:m])
+		}
+	}
+}
+
+func TestRSTooMuchLost(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	code, data, parity := testRows(t, rng, 6, 2, 16)
+	bad := []bool{true, false, true, false, false, false}
+	err := code.Reconstruct(data, parity, bad, []bool{false, true})
+	if err == nil {
+		t.Errorf("rebuilt 2 data blocks from 1 parity block")
+	}
+
+	if _, err := NewRSCode(200, 57); err == nil {
+		t.Errorf("NewRSCode(200, 57) worked; that's more than %d blocks", RS_TOTAL)
+	}
+}
+
+// Parity made for a file in a repository repairs it
+func TestParityRepair(t *testing.T) {
+	root := newTestRepo(t)
+	entry, data := testFile("a/song.mp3", 300000)
+	entry.ModTime = time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)
+	name := filepath.Join(root, "a/song.mp3")
+	err := os.MkdirAll(filepath.Dir(name), 0755)
+	if err == nil {
+		err = os.WriteFile(name, data, 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	err = CreateParity(ctx, root, entry, 10, nil, testLog())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := LoadParity(root, entry.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// damage as many blocks as there's parity for, the short last one too
+	damaged := append([]byte(nil), data...)
+	for i := 0; i < p.Parity-1; i++ {
+		damaged[i*p.CellSize*3+7] ^= 0x55
+	}
+	damaged[len(damaged)-1] ^= 0x55
+	err = os.WriteFile(name, damaged, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := RepairFromParity(ctx, root, entry, "test", nil, testLog())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := os.ReadFile(name)
+	if !bytes.Equal(got, data) {
+		t.Errorf("repaired file doesn't match what parity was made for")
+	}
+	if len(report.Damaged) != p.Parity {
+		t.Errorf("repair found %d damaged ranges (%v), want %d", len(report.Damaged), report.Damaged, p.Parity)
+	}
+	quarantined, _ := os.ReadFile(filepath.Join(root, report.Quarantined))
+	if !bytes.Equal(quarantined, damaged) {
+		t.Errorf("bad copy isn't in quarantine at %s", report.Quarantined)
+	}
+
+	// one block too many in a row: nothing changes
+	for i := 0; i <= p.Parity; i++ {
+		damaged[i*p.CellSize+1] ^= 0x55
+	}
+	err = os.WriteFile(name, damaged, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = RepairFromParity(ctx, root, entry, "test2", nil, testLog())
+	if err == nil {
+		t.Errorf("repaired more damage than there's parity for")
+	}
+	got, _ = os.ReadFile(name)
+	if !bytes.Equal(got, damaged) {
+		t.Errorf("failed repair changed the file")
+	}
+}
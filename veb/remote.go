@@ -0,0 +1,260 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Remotes are the named backup locations of a repository, a la 'git remote'.
+// They live in the index along with what veb last knew about them.
+//
+// Remotes are identified by their repository's UUID, not their path. A drive
+// that gets mounted somewhere else is found again by looking at the other
+// places it has been and at the current mount points. A different repository
+// sitting at the remote's path is never mistaken for it.
+
+package veb
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+const (
+	DEFAULT_REMOTE = "origin" // name used when a repository has only one remote
+)
+
+// A remote repository this one backs up to
+type Remote struct {
+	Name           string
+	URL            string    // absolute path or URL of backup location root
+	UUID           string    // UUID of the remote's repository
+	Paths          []string  // other paths the remote has been found at
+	LastPush       time.Time // when this repository last pushed to it
+	LastGeneration uint64    // remote index's Generation as of the last push
+}
+
+// Adds a new remote
+func (x *Index) AddRemote(name, url string) (*Remote, error) {
+	if name == "" {
+		return nil, fmt.Errorf("veb remotes need a name")
+	}
+	if _, ok := x.Remotes[name]; ok {
+		return nil, fmt.Errorf("veb remote %s already exists", name)
+	}
+
+	r := &Remote{Name: name, URL: url}
+	x.Remotes[name] = r
+	return r, nil
+}
+
+// Removes a remote. Doesn't touch the remote repository itself.
+func (x *Index) RemoveRemote(name string) error {
+	if _, ok := x.Remotes[name]; !ok {
+		return fmt.Errorf("veb has no remote named %s", name)
+	}
+	delete(x.Remotes, name)
+	return nil
+}
+
+// Renames a remote
+func (x *Index) RenameRemote(from, to string) error {
+	r, ok := x.Remotes[from]
+	if !ok {
+		return fmt.Errorf("veb has no remote named %s", from)
+	}
+	if _, ok := x.Remotes[to]; ok {
+		return fmt.Errorf("veb remote %s already exists", to)
+	}
+	if to == "" {
+		return fmt.Errorf("veb remotes need a name")
+	}
+
+	delete(x.Remotes, from)
+	r.Name = to
+	x.Remotes[to] = r
+	return nil
+}
+
+// Returns the named remote.
+// An empty name means the default remote: the only remote if there's just one,
+// otherwise DEFAULT_REMOTE.
+func (x *Index) GetRemote(name string) (*Remote, error) {
+	if len(x.Remotes) == 0 {
+		return nil, fmt.Errorf("No remote veb repository. Use 'veb remote add' to set one.")
+	}
+
+	if name == "" {
+		if len(x.Remotes) == 1 {
+			for _, r := range x.Remotes {
+				return r, nil
+			}
+		}
+		name = DEFAULT_REMOTE
+		if _, ok := x.Remotes[name]; !ok {
+			return nil, fmt.Errorf("veb has more than one remote; say which one (see 'veb remote list')")
+		}
+	}
+
+	r, ok := x.Remotes[name]
+	if !ok {
+		return nil, fmt.Errorf("veb has no remote named %s (see 'veb remote list')", name)
+	}
+	return r, nil
+}
+
+// Returns all remotes, sorted by name
+func (x *Index) RemoteList() []*Remote {
+	names := make([]string, 0, len(x.Remotes))
+	for n := range x.Remotes {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	ret := make([]*Remote, 0, len(names))
+	for _, n := range names {
+		ret = append(ret, x.Remotes[n])
+	}
+	return ret
+}
+
+// Connects to the remote and loads its index, making sure it really is the
+// remote's repository. If a local remote isn't at its URL any more, its other
+// known paths and the current mount points are searched for it, and URL is
+// updated to where it was found. Remotes without a UUID yet take the UUID of
+// whatever is at their URL, once it has one saved (see Index.UnsavedUUID).
+// Encrypted remotes are decrypted with the key config says to use.
+// Returns whether the remote moved. The caller closes the Transport.
+func (x *Index) LocateRemote(r *Remote, config *RemoteConfig, log *Log) (Transport, *Index, bool, error) {
+	// where it's supposed to be
+	t, index, err := loadRemote(r.URL, config, log)
+	if err == nil {
+		if r.UUID == "" && !index.UnsavedUUID() {
+			r.UUID = index.UUID
+		}
+		if index.UUID == x.UUID {
+			t.Close()
+			return nil, nil, false, fmt.Errorf("veb remote %s is this repository", r.Name)
+		}
+		if index.UUID == r.UUID || r.UUID == "" {
+			return t, index, false, nil
+		}
+		t.Close()
+		err = fmt.Errorf("the repository at %s is not remote %s (found %s, expected %s)",
+			r.URL, r.Name, index.UUID, r.UUID)
+	} else {
+		err = fmt.Errorf("veb could not load remote %s at %s: %v", r.Name, r.URL, err)
+	}
+	if !IsLocalURL(r.URL) {
+		// servers don't wander between mount points
+		return nil, nil, false, err
+	}
+	log.Warn().Println(err)
+
+	// anywhere else it could be
+	tried := map[string]bool{r.URL: true}
+	candidates := append([]string{}, r.Paths...)
+	candidates = append(candidates, MountCandidates(r.URL)...)
+	for _, p := range r.Paths {
+		candidates = append(candidates, MountCandidates(p)...)
+	}
+	for _, c := range candidates {
+		if tried[c] {
+			continue
+		}
+		tried[c] = true
+
+		if fi, serr := os.Stat(path.Join(c, META_FOLDER)); serr != nil || !fi.IsDir() {
+			continue
+		}
+		t, index, lerr := loadRemote(c, config, log)
+		if lerr != nil {
+			continue
+		}
+		if index.UUID != r.UUID {
+			t.Close()
+			continue
+		}
+
+		// found it; remember where it was
+		log.Info().Println("found remote", r.Name, "at", c, "instead of", r.URL)
+		r.Paths = addPath(r.Paths, r.URL)
+		r.URL = c
+		return t, index, true, nil
+	}
+
+	return nil, nil, false, err
+}
+
+// Connects to a remote and loads its index
+func loadRemote(url string, config *RemoteConfig, log *Log) (Transport, *Index, error) {
+	t, err := NewTransport(url, log)
+	if err != nil {
+		return nil, nil, err
+	}
+	ct, err := WrapCrypt(t, config, log)
+	if err != nil {
+		t.Close()
+		return nil, nil, err
+	}
+	t = ct
+	index, err := t.LoadIndex()
+	if err == nil {
+		t, err = WrapCompress(t, index, config, log)
+	}
+	if err == nil {
+		t, err = WrapObjects(t, index, log)
+	}
+	if err != nil {
+		ct.Close()
+		return nil, nil, err
+	}
+	return t, index, nil
+}
+
+// Opens remote r just to compare trees with, if it can hash its own tree (see
+// TreeHasher), so its index doesn't have to be loaded. Returns nils if it
+// can't, or if r isn't known well enough to tell it's the right repository
+// without loading its index (see LocateRemote).
+func (x *Index) OpenTreeHasher(r *Remote, config *RemoteConfig, log *Log) (Transport, TreeHasher, error) {
+	if r.UUID == "" {
+		return nil, nil, nil
+	}
+	t, err := NewTransport(r.URL, log)
+	if err != nil {
+		return nil, nil, err
+	}
+	ct, err := WrapCrypt(t, config, log)
+	if err != nil {
+		t.Close()
+		return nil, nil, err
+	}
+	th, ok := ct.(TreeHasher)
+	if !ok {
+		ct.Close()
+		return nil, nil, nil
+	}
+
+	uuid, _, err := th.Subtrees(nil)
+	if err == nil && uuid == x.UUID {
+		err = fmt.Errorf("veb remote %s is this repository", r.Name)
+	} else if err == nil && uuid != r.UUID {
+		err = fmt.Errorf("the repository at %s is not remote %s (found %s, expected %s)",
+			r.URL, r.Name, uuid, r.UUID)
+	}
+	if err != nil {
+		ct.Close()
+		return nil, nil, err
+	}
+	return ct, th, nil
+}
+
+// Adds p to paths if it isn't there already
+func addPath(paths []string, p string) []string {
+	for _, have := range paths {
+		if have == p {
+			return paths
+		}
+	}
+	return append(paths, p)
+}
@@ -0,0 +1,565 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// S3Transport is a Transport for remote repositories kept as objects in an
+// S3-compatible bucket:
+//   s3://host[:port]/bucket[/prefix]       (https)
+//   s3+http://host[:port]/bucket[/prefix]  (plain http, for local stand-ins)
+// Buckets are addressed by path (host/bucket/key), which AWS and S3-compatible
+// servers all understand. ?region= sets the region (default: $AWS_REGION, or
+// us-east-1). Credentials come from $AWS_ACCESS_KEY_ID, $AWS_SECRET_ACCESS_KEY
+// and $AWS_SESSION_TOKEN.
+//
+// Each file is an object at prefix/path, and the index is one too, at
+// prefix/.veb/index. Uploads carry both Content-MD5 and a signed SHA-256 of
+// their body so the server rejects anything damaged on the way, and their veb
+// checksum is checked before the upload is finished. Objects keep their veb
+// checksum in their metadata (x-amz-meta-veb-xsum).
+//
+// Files bigger than S3_PART_SIZE are sent as multipart uploads. Buckets have
+// no working copy, no free space limit, and no rename, so Check finds nothing,
+// FreeSpace errors, and Rename copies then deletes.
+
+package veb
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	S3_SCHEME      = "s3"      // s3://host/bucket/prefix URLs, over https
+	S3_HTTP_SCHEME = "s3+http" // the same, over plain http
+	S3_REGION      = "us-east-1"
+
+	S3_PART_SIZE = 16 * 1024 * 1024       // bytes per multipart upload part
+	S3_COPY_SIZE = 1024 * 1024 * 1024     // bytes per part when copying big objects
+	S3_COPY_MAX  = 5 * 1024 * 1024 * 1024 // biggest object one copy can do
+
+	S3_META_XSUM = "X-Amz-Meta-Veb-Xsum" // object's veb checksum, hex
+	S3_META_MODE = "X-Amz-Meta-Veb-Mode" // file's mode bits, octal
+)
+
+type S3Transport struct {
+	url      string
+	endpoint string // scheme://host[:port]
+	bucket   string
+	prefix   string // key prefix of the repository, without a trailing '/'
+	signer   sigV4
+	client   *http.Client
+	log      *Log // error/warn/info logging
+}
+
+// Returns an S3Transport for an s3:// or s3+http:// URL.
+func NewS3Transport(u *url.URL, log *Log) (*S3Transport, error) {
+	parts := strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)
+	if parts[0] == "" {
+		return nil, fmt.Errorf("veb remote %s needs a bucket (%s://host/bucket/prefix)", u, u.Scheme)
+	}
+	prefix := ""
+	if len(parts) > 1 {
+		prefix = strings.Trim(parts[1], "/")
+	}
+
+	scheme := "https"
+	if u.Scheme == S3_HTTP_SCHEME {
+		scheme = "http"
+	}
+
+	region := u.Query().Get("region")
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		region = S3_REGION
+	}
+	signer := sigV4{
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:     os.Getenv("AWS_SESSION_TOKEN"),
+		region:    region,
+		service:   "s3",
+	}
+	if signer.accessKey == "" || signer.secretKey == "" {
+		return nil, fmt.Errorf("veb needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY set for %s", u)
+	}
+
+	return &S3Transport{u.String(), scheme + "://" + u.Host, parts[0], prefix,
+		signer, &http.Client{}, log}, nil
+}
+
+func (t *S3Transport) URL() string {
+	return t.url
+}
+
+func (t *S3Transport) LoadIndex() (*Index, error) {
+	body, err := t.get(path.Join(META_FOLDER, INDEX_FILE))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return decodeIndex(body, t.url, t.log)
+}
+
+// Saves the index & xsums, keeping the old ones as index~ and xsums~ like
+// Index.Save() does.
+func (t *S3Transport) SaveIndex(x *Index) error {
+	indexKey := path.Join(META_FOLDER, INDEX_FILE)
+	err := t.copy(indexKey, indexKey+"~")
+	if err != nil && !os.IsNotExist(err) {
+		t.log.Warn().Println("could not backup old index:", err)
+	}
+
+	index, xsums, err := encodeIndex(x)
+	if err != nil {
+		return err
+	}
+	err = t.put(indexKey, index, nil)
+	if err != nil {
+		return err
+	}
+	return t.put(path.Join(META_FOLDER, XSUMS_FILE), xsums, nil)
+}
+
+// Buckets have no working copy, so nothing is ever uncommitted there.
+func (t *S3Transport) Check(x *Index, changed chan IndexEntry) error {
+	close(changed)
+	return nil
+}
+
+func (t *S3Transport) Stat(p string) (os.FileInfo, error) {
+	resp, err := t.do("HEAD", t.key(p), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	mode := os.FileMode(0644)
+	if m, err := strconv.ParseUint(resp.Header.Get(S3_META_MODE), 8, 32); err == nil {
+		mode = os.FileMode(m)
+	}
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return netStat{path.Base(p), resp.ContentLength, mode, modTime}, nil
+}
+
+func (t *S3Transport) Open(p string) (io.ReadCloser, error) {
+	return t.get(p)
+}
+
+// Gets just n bytes of the object, from off
+func (t *S3Transport) OpenRange(p string, off, n int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+n-1))
+	resp, err := t.do("GET", t.key(p), nil, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	return rangeBody(resp, off, n)
+}
+
+// Uploads r to entry.Path. Nothing is finished unless r matches entry.Xsum.
+func (t *S3Transport) Write(entry IndexEntry, r io.Reader) error {
+	key := t.key(entry.Path)
+	header := http.Header{}
+	header.Set(S3_META_MODE, strconv.FormatUint(uint64(entry.Mode.Perm()), 8))
+	if entry.Xsum != nil {
+		header.Set(S3_META_XSUM, hex.EncodeToString(entry.Xsum))
+	}
+
+	hasher := NewHasher()
+	r = io.TeeReader(r, hasher)
+	checkXsum := func() error {
+		if entry.Xsum != nil && !bytes.Equal(hasher.Sum(nil), entry.Xsum) {
+			return fmt.Errorf("%s doesn't match its checksum", entry.Path)
+		}
+		return nil
+	}
+
+	// small enough for one PUT?
+	buf := make([]byte, S3_PART_SIZE)
+	n, rerr := io.ReadFull(r, buf)
+	if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+		err := checkXsum()
+		if err != nil {
+			return err
+		}
+		return t.put(entry.Path, buf[:n], header)
+	}
+	if rerr != nil {
+		return rerr
+	}
+
+	// multipart, then
+	upload, err := t.startMultipart(key, header)
+	if err != nil {
+		return err
+	}
+	parts := make([]s3Part, 0)
+	for {
+		if n > 0 {
+			etag, err := t.putPart(key, upload, len(parts)+1, buf[:n])
+			if err != nil {
+				t.abortMultipart(key, upload)
+				return err
+			}
+			parts = append(parts, s3Part{len(parts) + 1, etag})
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			t.abortMultipart(key, upload)
+			return rerr
+		}
+		n, rerr = io.ReadFull(r, buf)
+	}
+
+	err = checkXsum()
+	if err == nil {
+		err = t.finishMultipart(key, upload, parts)
+	}
+	if err != nil {
+		t.abortMultipart(key, upload)
+	}
+	return err
+}
+
+// Copies, then deletes the original.
+func (t *S3Transport) Rename(from, to string) error {
+	err := t.copy(from, to)
+	if err != nil {
+		return err
+	}
+	return t.delete(t.key(from))
+}
+
+// Deletes the object p, or every object under p/.
+func (t *S3Transport) Remove(p string) error {
+	keys, err := t.list(t.key(p) + "/")
+	if err != nil {
+		return err
+	}
+	if _, err = t.Stat(p); err == nil {
+		keys = append(keys, t.key(p))
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if len(keys) == 0 {
+		return &os.PathError{Op: "remove", Path: p, Err: os.ErrNotExist}
+	}
+
+	for _, k := range keys {
+		err = t.delete(k)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Buckets grow as needed; use a Quota to cap them.
+func (t *S3Transport) FreeSpace() (int64, error) {
+	return 0, fmt.Errorf("%s has no free space limit", t.url)
+}
+
+func (t *S3Transport) Close() error {
+	return nil
+}
+
+// Object key of repository path p
+func (t *S3Transport) key(p string) string {
+	if t.prefix == "" {
+		return cleanPath(p)
+	}
+	return t.prefix + "/" + cleanPath(p)
+}
+
+// GETs the object at repository path p
+func (t *S3Transport) get(p string) (io.ReadCloser, error) {
+	resp, err := t.do("GET", t.key(p), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// PUTs data as the object at repository path p
+func (t *S3Transport) put(p string, data []byte, header http.Header) error {
+	resp, err := t.do("PUT", t.key(p), nil, header, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (t *S3Transport) delete(key string) error {
+	resp, err := t.do("DELETE", key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Copies the object at repository path from to to, in parts if it's too big
+// for one copy.
+func (t *S3Transport) copy(from, to string) error {
+	info, err := t.Stat(from)
+	if err != nil {
+		return err
+	}
+	source := "/" + t.bucket + "/" + uriEncode(t.key(from), false)
+
+	if info.Size() <= S3_COPY_MAX {
+		header := http.Header{}
+		header.Set("X-Amz-Copy-Source", source)
+		resp, err := t.do("PUT", t.key(to), nil, header, nil)
+		if err != nil {
+			return err
+		}
+		// copies can fail after the 200 OK
+		return s3BodyError(resp)
+	}
+
+	// the metadata doesn't come along by itself
+	head, err := t.do("HEAD", t.key(from), nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	head.Body.Close()
+	header := http.Header{}
+	for _, k := range []string{S3_META_MODE, S3_META_XSUM} {
+		if v := head.Header.Get(k); v != "" {
+			header.Set(k, v)
+		}
+	}
+
+	key := t.key(to)
+	upload, err := t.startMultipart(key, header)
+	if err != nil {
+		return err
+	}
+	parts := make([]s3Part, 0)
+	for start := int64(0); start < info.Size(); start += S3_COPY_SIZE {
+		end := start + S3_COPY_SIZE - 1
+		if end >= info.Size() {
+			end = info.Size() - 1
+		}
+		header := http.Header{}
+		header.Set("X-Amz-Copy-Source", source)
+		header.Set("X-Amz-Copy-Source-Range", fmt.Sprintf("bytes=%d-%d", start, end))
+		query := url.Values{"partNumber": {strconv.Itoa(len(parts) + 1)}, "uploadId": {upload}}
+		resp, err := t.do("PUT", key, query, header, nil)
+		if err != nil {
+			t.abortMultipart(key, upload)
+			return err
+		}
+		var result struct {
+			ETag string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			t.abortMultipart(key, upload)
+			return err
+		}
+		parts = append(parts, s3Part{len(parts) + 1, result.ETag})
+	}
+
+	err = t.finishMultipart(key, upload, parts)
+	if err != nil {
+		t.abortMultipart(key, upload)
+	}
+	return err
+}
+
+// Returns the keys of all objects starting with prefix
+func (t *S3Transport) list(prefix string) ([]string, error) {
+	keys := make([]string, 0)
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := t.do("GET", "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range result.Contents {
+			keys = append(keys, c.Key)
+		}
+		if !result.IsTruncated {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// A finished part of a multipart upload
+type s3Part struct {
+	PartNumber int
+	ETag       string
+}
+
+// Starts a multipart upload of key. Returns its upload ID.
+func (t *S3Transport) startMultipart(key string, header http.Header) (string, error) {
+	resp, err := t.do("POST", key, url.Values{"uploads": {""}}, header, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		UploadId string
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return "", err
+	}
+	return result.UploadId, nil
+}
+
+// Uploads one part. Returns its ETag.
+func (t *S3Transport) putPart(key, upload string, number int, data []byte) (string, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {upload}}
+	resp, err := t.do("PUT", key, query, nil, data)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+// Puts the parts together into the object
+func (t *S3Transport) finishMultipart(key, upload string, parts []s3Part) error {
+	done := struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: parts}
+	body, err := xml.Marshal(done)
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.do("POST", key, url.Values{"uploadId": {upload}}, nil, body)
+	if err != nil {
+		return err
+	}
+	// finishing can fail after the 200 OK
+	return s3BodyError(resp)
+}
+
+// Throws away the parts uploaded so far
+func (t *S3Transport) abortMultipart(key, upload string) {
+	resp, err := t.do("DELETE", key, url.Values{"uploadId": {upload}}, nil, nil)
+	if err != nil {
+		t.log.Warn().Println("couldn't abort upload of", key, ":", err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// Sends a signed request for key (or the bucket, if key is "").
+// Bodies are sent with Content-MD5 and their SHA-256 signed, so the server can
+// tell if they were damaged on the way. Missing objects give os.IsNotExist()
+// errors, and other failures give the server's error. The caller closes the
+// response body.
+func (t *S3Transport) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	p := "/" + t.bucket
+	if key != "" {
+		p += "/" + key
+	}
+	u, err := url.Parse(t.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = p
+	u.RawPath = uriEncode(p, false)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if len(body) > 0 {
+		sum := md5.Sum(body)
+		req.Header.Set("Content-Md5", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	req.ContentLength = int64(len(body))
+	t.signer.sign(req, hashHex(body), time.Now())
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, &os.PathError{Op: strings.ToLower(method), Path: key, Err: os.ErrNotExist}
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		err = s3Error(resp.Body)
+		if err == nil {
+			err = fmt.Errorf("%s", resp.Status)
+		}
+		return nil, fmt.Errorf("s3 %s %s: %v", method, key, err)
+	}
+	return resp, nil
+}
+
+// Reads & closes a body that may hold an error despite a 200 OK
+func s3BodyError(resp *http.Response) error {
+	defer resp.Body.Close()
+	return s3Error(resp.Body)
+}
+
+// The error in an S3 response body, if there is one
+func s3Error(body io.Reader) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	var e struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}
+	if xml.Unmarshal(data, &e) != nil || e.XMLName.Local != "Error" {
+		return nil
+	}
+	return fmt.Errorf("%s: %s", e.Code, e.Message)
+}
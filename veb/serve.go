@@ -0,0 +1,434 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Server exposes the veb repositories under a folder to NetTransports, so a
+// NAS running 'veb serve' can be pushed to & pulled from without mounting it.
+//
+// The protocol is gob over TLS. A connection starts with a hello naming the
+// repository (relative to the served folder), then carries requests, one at a
+// time, each answered by a response. File contents follow the request (writes)
+// or response (reads) as a stream of chunks, ended by an empty chunk.
+//
+// Files the server is sent are checked against their committed checksum on
+// the server before they replace anything, just like local remotes.
+//
+// Over TLS, the TLS handshake must let the client in (see ServeTLS) before its
+// hello is read. Over ssh, ssh already has.
+
+package veb
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	VEB_SCHEME    = "veb"     // veb://host:port/path URLs
+	SERVE_PORT    = "7419"    // default port of 'veb serve'
+	SERVE_VERSION = 3         // protocol version; both ends must match
+	CHUNK_SIZE    = 64 * 1024 // bytes of file data per chunk
+)
+
+// request operations
+const (
+	OP_LOAD_INDEX = "load-index"
+	OP_SAVE_INDEX = "save-index"
+	OP_CHECK      = "check"
+	OP_STAT       = "stat"
+	OP_OPEN       = "open"
+	OP_WRITE      = "write"
+	OP_RENAME     = "rename"
+	OP_REMOVE     = "remove"
+	OP_FREE       = "free"
+	OP_XSUM       = "xsum"
+	OP_READ       = "read"
+	OP_TREE       = "tree"
+)
+
+// First message on a connection
+type hello struct {
+	Version int    // SERVE_VERSION
+	Path    string // repository, relative to the served folder
+}
+
+// A Transport call
+type request struct {
+	Op    string
+	Path  string
+	To    string     // OP_RENAME's destination
+	Entry IndexEntry // OP_WRITE's file
+	Index *Index     // OP_SAVE_INDEX's index
+	Off   int64      // where OP_READ starts
+	N     int64      // how much OP_READ reads
+	Dirs  []string   // folders OP_TREE wants the subtrees of
+}
+
+// The answer to a hello or request
+type response struct {
+	Err        string // empty on success
+	NotExist   bool   // Err is an os.IsNotExist() error
+	Index      *Index
+	Generation uint64 // index's Generation after OP_SAVE_INDEX
+	Entries    []IndexEntry
+	Stat       netStat
+	Free       int64
+	Xsum       []byte
+	UUID       string    // repository's, for OP_TREE
+	Subtrees   []Subtree // OP_TREE's
+}
+
+// Part of a file's contents
+type chunk struct {
+	Data []byte // empty = end of file
+	Err  string // reading the file failed; no more chunks follow
+}
+
+// os.FileInfo that can go over gob
+type netStat struct {
+	FName    string
+	FSize    int64
+	FMode    os.FileMode
+	FModTime time.Time
+}
+
+func (s netStat) Name() string       { return s.FName }
+func (s netStat) Size() int64        { return s.FSize }
+func (s netStat) Mode() os.FileMode  { return s.FMode }
+func (s netStat) ModTime() time.Time { return s.FModTime }
+func (s netStat) IsDir() bool        { return s.FMode.IsDir() }
+func (s netStat) Sys() interface{}   { return nil }
+
+// Serves the veb repositories in a folder
+type Server struct {
+	root string      // served folder
+	tls  *tls.Config // nil = no TLS (already secured, e.g. over ssh)
+	log  *Log        // error/warn/info logging
+}
+
+func NewServer(root string, config *tls.Config, log *Log) *Server {
+	return &Server{root, config, log}
+}
+
+// Accepts TLS connections on addr until it fails. Only clients the TLS config
+// lets in get as far as their hello.
+func (s *Server) ListenAndServe(addr string) error {
+	ln, err := tls.Listen("tcp", addr, s.tls)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			var nerr net.Error
+			if errors.As(err, &nerr) && nerr.Timeout() {
+				s.log.Warn().Println(err)
+				continue
+			}
+			return err
+		}
+		go s.serveTLS(conn.(*tls.Conn))
+	}
+}
+
+// Serves a TLS connection once its handshake has let the client in
+func (s *Server) serveTLS(conn *tls.Conn) {
+	err := conn.Handshake()
+	if err != nil {
+		s.log.Warn().Println("refused", conn.RemoteAddr(), ":", err)
+		conn.Close()
+		return
+	}
+	s.ServeConn(conn)
+}
+
+// Answers requests on one connection until the client hangs up.
+func (s *Server) ServeConn(conn io.ReadWriteCloser) {
+	defer conn.Close()
+	enc := gob.NewEncoder(conn)
+	dec := gob.NewDecoder(conn)
+
+	// which repository?
+	var h hello
+	err := dec.Decode(&h)
+	if err != nil {
+		s.log.Err().Println("bad hello:", err)
+		return
+	}
+	root, err := s.repo(h)
+	if err != nil {
+		s.log.Warn().Println(err)
+		enc.Encode(response{Err: err.Error()})
+		return
+	}
+	err = enc.Encode(response{})
+	if err != nil {
+		s.log.Err().Println(err)
+		return
+	}
+	s.log.Info().Println("serving", root)
+	t := NewLocalTransport(root, s.log)
+	var tree servedTree
+
+	for {
+		var req request
+		err = dec.Decode(&req)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			s.log.Err().Println("bad request:", err)
+			return
+		}
+		err = s.handle(t, &tree, enc, dec, req)
+		if err != nil {
+			s.log.Err().Println(err)
+			return
+		}
+	}
+}
+
+// Finds the repository a hello asks for
+func (s *Server) repo(h hello) (string, error) {
+	if h.Version != SERVE_VERSION {
+		return "", fmt.Errorf("veb serve speaks version %d, not %d", SERVE_VERSION, h.Version)
+	}
+	root := filepath.Join(s.root, filepath.FromSlash(cleanPath(h.Path)))
+	fi, err := os.Stat(filepath.Join(root, META_FOLDER))
+	if err != nil || !fi.IsDir() {
+		return "", fmt.Errorf("no veb repository at %s", h.Path)
+	}
+	return root, nil
+}
+
+// Does one request. Only returns an error if the connection is no good now.
+func (s *Server) handle(t *LocalTransport, tree *servedTree, enc *gob.Encoder, dec *gob.Decoder, req request) error {
+	p := cleanPath(req.Path)
+	var resp response
+	var err error
+
+	// changes to files must name one, & not the repository's own
+	switch req.Op {
+	case OP_WRITE:
+		err = checkWritable(cleanPath(req.Entry.Path))
+	case OP_RENAME:
+		err = checkWritable(p)
+		if err == nil {
+			err = checkWritable(cleanPath(req.To))
+		}
+	case OP_REMOVE:
+		err = checkWritable(p)
+	}
+	if err != nil {
+		if req.Op == OP_WRITE {
+			// the file's contents are on the wire anyway
+			in := &chunkReader{dec: dec}
+			_, derr := io.Copy(io.Discard, in)
+			if derr != nil && !in.done {
+				return derr
+			}
+		}
+		req.Op = ""
+	}
+
+	switch req.Op {
+	case "":
+		// refused above
+	case OP_LOAD_INDEX:
+		resp.Index, err = t.LoadIndex()
+
+	case OP_SAVE_INDEX:
+		x := req.Index
+		if x == nil {
+			err = fmt.Errorf("no index to save")
+			break
+		}
+		x.Root = t.root
+		x.log = s.log
+		err = t.SaveIndex(x)
+		resp.Generation = x.Generation
+
+	case OP_CHECK:
+		var x *Index
+		x, err = t.LoadIndex()
+		if err != nil {
+			break
+		}
+		changed := make(chan IndexEntry)
+		go t.Check(x, changed)
+		for e := range changed {
+			resp.Entries = append(resp.Entries, e)
+		}
+
+	case OP_STAT:
+		var info os.FileInfo
+		info, err = t.Stat(p)
+		if err == nil {
+			resp.Stat = netStat{info.Name(), info.Size(), info.Mode(), info.ModTime()}
+		}
+
+	case OP_OPEN, OP_READ:
+		var file io.ReadCloser
+		if req.Op == OP_OPEN {
+			file, err = t.Open(p)
+		} else {
+			file, err = t.OpenRange(p, req.Off, req.N)
+		}
+		if err != nil {
+			break
+		}
+		defer file.Close()
+		err = enc.Encode(resp)
+		if err != nil {
+			return err
+		}
+		return sendChunks(enc, file)
+
+	case OP_WRITE:
+		entry := req.Entry
+		entry.Path = cleanPath(entry.Path)
+		in := &chunkReader{dec: dec}
+		err = t.Write(entry, in)
+		// whatever Write didn't read is still on the wire
+		_, derr := io.Copy(io.Discard, in)
+		if derr != nil && !in.done {
+			return derr
+		}
+
+	case OP_RENAME:
+		err = t.Rename(p, cleanPath(req.To))
+
+	case OP_REMOVE:
+		err = t.Remove(p)
+
+	case OP_FREE:
+		resp.Free, err = t.FreeSpace()
+
+	case OP_XSUM:
+		entry := IndexEntry{Path: path.Join(t.root, p)}
+		err = VerifyXsum(context.Background(), &entry, nil, s.log)
+		resp.Xsum = entry.Xsum
+
+	case OP_TREE:
+		// a comparison starts with no Dirs, then goes down a level per request
+		if tree.Tree == nil || len(req.Dirs) == 0 {
+			var x *Index
+			x, err = t.LoadIndex()
+			if err != nil {
+				break
+			}
+			tree.uuid, tree.Tree = x.UUID, NewTree(x.Files)
+		}
+		resp.UUID = tree.uuid
+		resp.Subtrees = tree.Subtrees(req.Dirs)
+
+	default:
+		err = fmt.Errorf("veb serve doesn't know how to %q", req.Op)
+	}
+
+	if err != nil {
+		resp.Err = err.Error()
+		resp.NotExist = os.IsNotExist(err)
+	}
+	return enc.Encode(resp)
+}
+
+// A connection's repository's Tree, as the OP_TREE starting the last
+// comparison found it, so going down the tree doesn't mean loading the index
+// again at each level
+type servedTree struct {
+	uuid string
+	*Tree
+}
+
+// Makes p relative, without any ".." that would get out of the repository
+func cleanPath(p string) string {
+	return path.Clean("/" + p)[1:]
+}
+
+// What in META_FOLDER clients keep there themselves, through the transport.
+// The rest (the index, config...) is the server's own.
+var clientMeta = map[string]bool{
+	TRASH_FOLDER:      true,
+	VERSIONS_FOLDER:   true,
+	QUARANTINE_FOLDER: true,
+	OBJECTS_FOLDER:    true,
+	PATHS_FILE:        true,
+	CRYPT_FILE:        true,
+	CRYPT_INDEX:       true,
+}
+
+// Whether a client may write, rename or remove cleaned path p: not the whole
+// repository, & nothing in META_FOLDER but what's in clientMeta
+func checkWritable(p string) error {
+	meta := strings.TrimPrefix(p, META_FOLDER+"/")
+	if p == "" || p == META_FOLDER || (meta != p && !clientMeta[strings.SplitN(meta, "/", 2)[0]]) {
+		return fmt.Errorf("veb serve won't change %q", "/"+p)
+	}
+	return nil
+}
+
+// Sends r's contents as chunks, ending with an empty one.
+func sendChunks(enc *gob.Encoder, r io.Reader) error {
+	buf := make([]byte, CHUNK_SIZE)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			eerr := enc.Encode(chunk{Data: buf[:n]})
+			if eerr != nil {
+				return eerr
+			}
+		}
+		if err == io.EOF {
+			return enc.Encode(chunk{})
+		}
+		if err != nil {
+			enc.Encode(chunk{Err: err.Error()})
+			return err
+		}
+	}
+}
+
+// Reads the chunks sendChunks() sent
+type chunkReader struct {
+	dec  *gob.Decoder
+	buf  []byte
+	done bool  // read the last chunk
+	err  error // io.EOF, or why the sender stopped
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, r.err
+		}
+		var c chunk
+		err := r.dec.Decode(&c)
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case c.Err != "":
+			r.done, r.err = true, errors.New(c.Err)
+		case len(c.Data) == 0:
+			r.done, r.err = true, io.EOF
+		}
+		r.buf = c.Data
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
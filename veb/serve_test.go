@@ -0,0 +1,244 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package veb
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// Serves a new repository over loopback TCP, without TLS. Returns its root, a
+// NetTransport for it, and how many connections the transport has made.
+func newTestServe(t *testing.T) (string, *NetTransport, *int32) {
+	root := newTestRepo(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s := NewServer(root, nil, testLog())
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.ServeConn(conn)
+		}
+	}()
+
+	dials := new(int32)
+	dial := func() (io.ReadWriteCloser, error) {
+		atomic.AddInt32(dials, 1)
+		return net.Dial("tcp", ln.Addr().String())
+	}
+	tr := newNetTransport("veb://test/", "/", dial, testLog())
+	t.Cleanup(func() { tr.Close() })
+	return root, tr, dials
+}
+
+// A refused write's contents are read off the wire, so the connection still
+// works for the next call
+func TestServeRefusedWrite(t *testing.T) {
+	root, tr, dials := newTestServe(t)
+	index, err := os.ReadFile(filepath.Join(root, META_FOLDER, INDEX_FILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry, data := testFile(META_FOLDER+"/"+INDEX_FILE, 3*CHUNK_SIZE+10)
+	err = tr.Write(entry, bytes.NewReader(data))
+	if err == nil {
+		t.Errorf("Write over the index worked")
+	}
+	if _, err := tr.FreeSpace(); err != nil {
+		t.Errorf("FreeSpace after a refused write: %v", err)
+	}
+	if *dials != 1 {
+		t.Errorf("%d connections made, want 1", *dials)
+	}
+	got, _ := os.ReadFile(filepath.Join(root, META_FOLDER, INDEX_FILE))
+	if !bytes.Equal(got, index) {
+		t.Errorf("refused write changed the index")
+	}
+}
+
+func TestServeOps(t *testing.T) {
+	root, tr, dials := newTestServe(t)
+	x, err := tr.LoadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x.UUID == "" || len(x.Files) != 0 {
+		t.Errorf("LoadIndex got UUID %q & %d files, want a UUID & none", x.UUID, len(x.Files))
+	}
+
+	entry, data := testFile("a/song.mp3", 2*CHUNK_SIZE+10)
+	err = tr.Write(entry, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := tr.Open(entry.Path)
+	if got := readAll(t, r, err); !bytes.Equal(got, data) {
+		t.Errorf("Open got %d bytes, not what was written", len(got))
+	}
+	r, err = tr.OpenRange(entry.Path, CHUNK_SIZE-5, 20)
+	if got := readAll(t, r, err); !bytes.Equal(got, data[CHUNK_SIZE-5:CHUNK_SIZE+15]) {
+		t.Errorf("OpenRange got %v, want %v", got, data[CHUNK_SIZE-5:CHUNK_SIZE+15])
+	}
+	info, err := tr.Stat(entry.Path)
+	if err != nil || info.Size() != entry.Size || info.Name() != "song.mp3" {
+		t.Errorf("Stat = %v, %v", info, err)
+	}
+	if _, err := tr.Stat("missing"); !os.IsNotExist(err) {
+		t.Errorf("Stat of a missing file: %v, want a not-exist error", err)
+	}
+	xsum, err := tr.Xsum(entry.Path)
+	if err != nil || !bytes.Equal(xsum, entry.Xsum) {
+		t.Errorf("Xsum = %x, %v, want %x", xsum, err, entry.Xsum)
+	}
+	if free, err := tr.FreeSpace(); err != nil || free <= 0 {
+		t.Errorf("FreeSpace = %d, %v", free, err)
+	}
+
+	// the server sees the file it hasn't committed yet
+	changed := make(chan IndexEntry)
+	go tr.Check(x, changed)
+	found := 0
+	for e := range changed {
+		if e.Path == entry.Path {
+			found++
+		}
+	}
+	if found != 1 {
+		t.Errorf("Check found %s %d times, want once", entry.Path, found)
+	}
+
+	// commit it there
+	gen := x.Generation
+	x.Files[entry.Path] = entry
+	err = tr.SaveIndex(x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x.Generation != gen+1 {
+		t.Errorf("SaveIndex left the generation at %d, want %d", x.Generation, gen+1)
+	}
+	saved, err := tr.LoadIndex()
+	if err != nil || saved.UUID != x.UUID || len(saved.Files) != 1 {
+		t.Fatalf("LoadIndex after SaveIndex: %v, %v", saved, err)
+	}
+	uuid, subtrees, err := tr.Subtrees(nil)
+	want := NewTree(saved.Files).Subtrees([]string{""})
+	if err != nil || uuid != x.UUID || len(subtrees) != 0 {
+		t.Errorf("Subtrees(nil) = %s, %v, %v", uuid, subtrees, err)
+	}
+	_, subtrees, err = tr.Subtrees([]string{""})
+	if err != nil || len(subtrees) != 1 || !bytes.Equal(subtrees[0].Hash, want[0].Hash) {
+		t.Errorf("Subtrees of the root = %v, %v, want %v", subtrees, err, want)
+	}
+
+	err = tr.Rename(entry.Path, "b/song.mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "b/song.mp3")); err != nil {
+		t.Errorf("Rename didn't move it: %v", err)
+	}
+	err = tr.Remove("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "b")); !os.IsNotExist(err) {
+		t.Errorf("Remove of folder b left it: %v", err)
+	}
+	if *dials != 1 {
+		t.Errorf("%d connections made, want 1", *dials)
+	}
+}
+
+// Closing a file partway reads the rest off the wire, and the connection is
+// used again
+func TestServeReaderClosed(t *testing.T) {
+	_, tr, dials := newTestServe(t)
+	entry, data := testFile("song.mp3", 4*CHUNK_SIZE)
+	err := tr.Write(entry, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := tr.Open(entry.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 10)
+	_, err = io.ReadFull(r, buf)
+	if err != nil || !bytes.Equal(buf, data[:10]) {
+		t.Errorf("read %v, %v, want %v", buf, err, data[:10])
+	}
+	r.Close()
+
+	if _, err := tr.Stat(entry.Path); err != nil {
+		t.Errorf("Stat after closing a file partway: %v", err)
+	}
+	if *dials != 1 {
+		t.Errorf("%d connections made, want 1", *dials)
+	}
+}
+
+// ".." in a path can't get out of the repository
+func TestServeDotDot(t *testing.T) {
+	root, tr, _ := newTestServe(t)
+	outside := filepath.Dir(root)
+
+	entry, data := testFile("../../escaped", 100)
+	err := tr.Write(entry, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "escaped")); err != nil {
+		t.Errorf("../../escaped isn't at the repository's top: %v", err)
+	}
+	r, err := tr.Open("a/../../../escaped")
+	if got := readAll(t, r, err); !bytes.Equal(got, data) {
+		t.Errorf("Open of a/../../../escaped got %d bytes, not escaped", len(got))
+	}
+
+	err = tr.Rename("escaped", "../renamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "renamed")); err != nil {
+		t.Errorf("../renamed isn't at the repository's top: %v", err)
+	}
+	for _, p := range []string{"escaped", "renamed"} {
+		if _, err := os.Stat(filepath.Join(outside, p)); !os.IsNotExist(err) {
+			t.Errorf("%s got out of the repository: %v", p, err)
+		}
+	}
+	if _, err := tr.Stat("../" + filepath.Base(root)); err == nil {
+		t.Errorf("Stat of ../ found the repository's own folder")
+	}
+	if err := tr.Remove("a/../.."); err == nil {
+		t.Errorf("Remove(a/../..) worked")
+	}
+
+	// the hello's path too
+	up := newNetTransport("veb://test/", "/../../", tr.dial, testLog())
+	defer up.Close()
+	x, err := up.LoadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mine, _ := tr.LoadIndex()
+	if x.UUID != mine.UUID {
+		t.Errorf("/../../ served another repository")
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// ssh://[user@]host[:port]/path remotes, the way git does them: each
+// connection runs 'veb serve --stdio' on the host over ssh and speaks the
+// 'veb serve' protocol over the pipe. ssh does the encrypting, so there's no
+// TLS, and the server end checksums files right next to the disk.
+//
+// The ssh command can be changed with the VEB_SSH environment variable (e.g.
+// "ssh -i ~/.ssh/nas_key"), and the veb to run on the host with ?veb= in the
+// URL (e.g. ?veb=/usr/local/bin/veb). The host's shell runs that, so it's
+// refused if it has anything the shell would act on.
+
+package veb
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const (
+	SSH_SCHEME = "ssh"      // ssh://host/path URLs
+	SSH_ENV    = "VEB_SSH"  // environment variable with the ssh command to use
+	SSH_SAFE   = "/._-+,:@" // what else ?veb= can have, not being special to a shell
+)
+
+// Whether r could mean something to a shell
+func notShellSafe(r rune) bool {
+	return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune(SSH_SAFE, r))
+}
+
+// Returns a NetTransport that reaches the repository at an ssh:// URL through
+// 'veb serve --stdio'. Nothing is connected until the first call.
+func NewSSHTransport(u *url.URL, log *Log) (*NetTransport, error) {
+	args := strings.Fields(os.Getenv(SSH_ENV))
+	if len(args) == 0 {
+		args = []string{"ssh"}
+	}
+	if u.Port() != "" {
+		args = append(args, "-p", u.Port())
+	}
+	// a host like -oProxyCommand=... would be an ssh option
+	host := u.Hostname()
+	if host == "" || strings.HasPrefix(host, "-") {
+		return nil, fmt.Errorf("veb remote %s has a bad host %q", u.Redacted(), host)
+	}
+	if u.User != nil {
+		if strings.HasPrefix(u.User.Username(), "-") {
+			return nil, fmt.Errorf("veb remote %s has a bad user %q", u.Redacted(), u.User.Username())
+		}
+		host = u.User.Username() + "@" + host
+	}
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("veb remote %s has a bad query: %v", u.Redacted(), err)
+	}
+	remoteVeb := query.Get("veb")
+	if remoteVeb == "" {
+		remoteVeb = "veb"
+	}
+	// ssh hands the command to the host's shell, so nothing it would act on
+	if strings.IndexFunc(remoteVeb, notShellSafe) >= 0 {
+		return nil, fmt.Errorf("veb remote %s has a bad veb %q (only letters, numbers and %s)",
+			u.Redacted(), remoteVeb, SSH_SAFE)
+	}
+	// serve the whole filesystem; the hello says which repository
+	args = append(args, "--", host, remoteVeb, "serve", "--stdio", "/")
+
+	dial := func() (io.ReadWriteCloser, error) {
+		return startPipe(args)
+	}
+	return newNetTransport(u.String(), u.Path, dial, log), nil
+}
+
+// A subprocess's stdin & stdout
+type pipeConn struct {
+	io.ReadCloser // stdout
+	in            io.WriteCloser
+	cmd           *exec.Cmd
+}
+
+// Starts args as a subprocess to talk to. Its stderr is passed through, so
+// ssh's complaints reach the user.
+func startPipe(args []string) (*pipeConn, error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	return &pipeConn{out, in, cmd}, nil
+}
+
+func (c *pipeConn) Write(p []byte) (int, error) {
+	return c.in.Write(p)
+}
+
+// Hangs up, then waits for the subprocess to finish
+func (c *pipeConn) Close() error {
+	c.in.Close()
+	return c.cmd.Wait()
+}
@@ -0,0 +1,210 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package veb
+
+import (
+	"bytes"
+	"crypto"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	testSSHEnv = "VEB_TEST_FAKE_SSH" // set in the fake ssh's environment
+)
+
+// Not a test: the fake ssh VEB_SSH runs. Checks it was run the way ssh would
+// be for user@host, then is 'veb serve --stdio /' on stdin & stdout.
+func TestFakeSSH(t *testing.T) {
+	if os.Getenv(testSSHEnv) == "" {
+		return
+	}
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	want := []string{"--", "me@nas", "veb", "serve", "--stdio", "/"}
+	if fmt.Sprint(args) != fmt.Sprint(want) {
+		fmt.Fprintf(os.Stderr, "fake ssh: run with %q, want %q\n", os.Args, want)
+		os.Exit(2)
+	}
+	NewServer(args[len(args)-1], nil, testLog()).ServeConn(testStdio{})
+	os.Exit(0)
+}
+
+// stdin & stdout, as one connection
+type testStdio struct{}
+
+func (testStdio) Read(p []byte) (int, error)  { return os.Stdin.Read(p) }
+func (testStdio) Write(p []byte) (int, error) { return os.Stdout.Write(p) }
+func (testStdio) Close() error                { return os.Stdout.Close() }
+
+// An empty veb repository in a temp folder
+func newTestRepo(t *testing.T) string {
+	root := t.TempDir()
+	err := os.Mkdir(filepath.Join(root, META_FOLDER), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, err := New(crypto.SHA1, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x.log = testLog()
+	err = x.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func testLog() *Log {
+	return NewLog(log.New(io.Discard, "", 0))
+}
+
+// A file's contents & its entry
+func testFile(p string, size int) (IndexEntry, []byte) {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i*7 + i/251)
+	}
+	hasher := NewHasher()
+	hasher.Write(data)
+	return IndexEntry{Path: p, Size: int64(size), Mode: 0640, Xsum: hasher.Sum(nil)}, data
+}
+
+func readAll(t *testing.T, r io.ReadCloser, err error) []byte {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestSSHTransport(t *testing.T) {
+	root := newTestRepo(t)
+	t.Setenv(testSSHEnv, "1")
+	t.Setenv(SSH_ENV, os.Args[0]+" -test.run=^TestFakeSSH$")
+	u, err := url.Parse("ssh://me@nas" + filepath.ToSlash(root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := NewSSHTransport(u, testLog())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	x, err := tr.LoadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x.UUID == "" {
+		t.Errorf("remote index has no UUID")
+	}
+
+	entry, data := testFile("a/song.mp3", 3*CHUNK_SIZE+10)
+	err = tr.Write(entry, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(root, "a/song.mp3"))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("remote has %d bytes (%v), not what was written", len(got), err)
+	}
+
+	r, err := tr.Open(entry.Path)
+	if got := readAll(t, r, err); !bytes.Equal(got, data) {
+		t.Errorf("Open got %d bytes, not what was written", len(got))
+	}
+	r, err = tr.OpenRange(entry.Path, CHUNK_SIZE-5, 20)
+	if got := readAll(t, r, err); !bytes.Equal(got, data[CHUNK_SIZE-5:CHUNK_SIZE+15]) {
+		t.Errorf("OpenRange got %v, want %v", got, data[CHUNK_SIZE-5:CHUNK_SIZE+15])
+	}
+	xsum, err := tr.Xsum(entry.Path)
+	if err != nil || !bytes.Equal(xsum, entry.Xsum) {
+		t.Errorf("Xsum = %x, %v, want %x", xsum, err, entry.Xsum)
+	}
+	if _, err := tr.Stat("missing"); !os.IsNotExist(err) {
+		t.Errorf("Stat of a missing file: %v, want a not-exist error", err)
+	}
+
+	// damaged on the way: the server won't have it
+	bad := append([]byte(nil), data...)
+	bad[5]++
+	entry.Path = "a/bad.mp3"
+	err = tr.Write(entry, bytes.NewReader(bad))
+	if err == nil {
+		t.Errorf("Write of a file that doesn't match its checksum worked")
+	}
+	if _, err := os.Stat(filepath.Join(root, "a/bad.mp3")); !os.IsNotExist(err) {
+		t.Errorf("Write of a file that doesn't match its checksum left it on the remote: %v", err)
+	}
+
+	// the server keeps the repository itself
+	for _, p := range []string{"", "/", ".", "a/..", META_FOLDER, META_FOLDER + "/" + INDEX_FILE} {
+		if err := tr.Remove(p); err == nil {
+			t.Errorf("Remove(%q) worked", p)
+		}
+	}
+	if err := tr.Rename("a/song.mp3", META_FOLDER+"/"+INDEX_FILE); err == nil {
+		t.Errorf("Rename over the index worked")
+	}
+	if _, err := os.Stat(filepath.Join(root, META_FOLDER, INDEX_FILE)); err != nil {
+		t.Errorf("index is gone: %v", err)
+	}
+
+	err = tr.Remove("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "a")); !os.IsNotExist(err) {
+		t.Errorf("Remove of folder a left it: %v", err)
+	}
+}
+
+func TestSSHBadURL(t *testing.T) {
+	for _, u := range []string{
+		"ssh://-oProxyCommand=evil/path",
+		"ssh://-oProxyCommand=evil@nas/path",
+		"ssh:///path",
+		"ssh://nas/path?veb=veb;rm%20-rf%20~",
+		"ssh://nas/path?veb=$(evil)",
+		"ssh://nas/path?veb=%60evil%60",
+		"ssh://nas/path?veb=veb%7Cevil",
+		"ssh://nas/path?veb=veb%0Aevil",
+		"ssh://nas/path?veb=my%20veb",
+	} {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = NewSSHTransport(parsed, testLog())
+		if err == nil || !strings.Contains(err.Error(), "bad") {
+			t.Errorf("NewSSHTransport(%s): %v, want an error", u, err)
+		}
+	}
+}
+
+func TestSSHRemoteVeb(t *testing.T) {
+	u, err := url.Parse("ssh://nas/path?veb=/usr/local/bin/veb-1.2_x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewSSHTransport(u, testLog()); err != nil {
+		t.Errorf("NewSSHTransport(%s): %v", u, err)
+	}
+}
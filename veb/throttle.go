@@ -0,0 +1,245 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// A Limiter is a token bucket that all of a command's goroutines share, to
+// keep the bytes they move together under a rate: so a nightly push doesn't
+// hog the house's network, or a daytime verify the workstation's disk.
+//
+// Limits are written as a rate per second, optionally by time of day:
+//   "2MB"                              - 2MB/s, all the time
+//   "08:00-23:00 1MB, 23:00-08:00 off" - 1MB/s by day, unlimited at night
+// Times that no window covers are unlimited. A nil *Limiter is unlimited.
+
+package veb
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LIMIT_CHUNK = 32 * 1024 // most bytes a limited Read moves at once
+	LIMIT_OFF   = "off"     // no limit
+)
+
+type Limiter struct {
+	windows []limitWindow
+	lock    sync.Mutex
+	tokens  float64 // bytes that can move now; negative = owed
+	last    time.Time
+}
+
+// A rate for part of the day
+type limitWindow struct {
+	from, to time.Duration // since midnight; to <= from wraps past midnight
+	rate     float64       // bytes per second; 0 = unlimited
+	allDay   bool
+}
+
+// Parses a limit (see above). Returns nil, i.e. no limit, for "" and "off".
+func ParseLimit(spec string) (*Limiter, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" || spec == LIMIT_OFF {
+		return nil, nil
+	}
+
+	l := &Limiter{}
+	for _, part := range strings.Split(spec, ",") {
+		fields := strings.Fields(part)
+		var w limitWindow
+		var rate string
+		switch len(fields) {
+		case 1:
+			w.allDay = true
+			rate = fields[0]
+		case 2:
+			var err error
+			w.from, w.to, err = parseWindow(fields[0])
+			if err != nil {
+				return nil, err
+			}
+			rate = fields[1]
+		default:
+			return nil, fmt.Errorf("invalid limit %q (e.g. \"2MB\" or \"08:00-23:00 1MB, 23:00-08:00 off\")", part)
+		}
+
+		if rate != LIMIT_OFF {
+			n, err := ParseSize(rate)
+			if err != nil {
+				return nil, err
+			}
+			w.rate = float64(n)
+		}
+		l.windows = append(l.windows, w)
+	}
+	return l, nil
+}
+
+// Parses "HH:MM-HH:MM"
+func parseWindow(s string) (time.Duration, time.Duration, error) {
+	ends := strings.Split(s, "-")
+	if len(ends) != 2 {
+		return 0, 0, fmt.Errorf("invalid time window %q (e.g. \"08:00-23:00\")", s)
+	}
+	var times [2]time.Duration
+	for i, end := range ends {
+		t, err := time.Parse("15:04", end)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid time window %q (e.g. \"08:00-23:00\")", s)
+		}
+		times[i] = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	return times[0], times[1], nil
+}
+
+// Bytes per second allowed at now; 0 = unlimited
+func (l *Limiter) rate(now time.Time) float64 {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	t := now.Sub(midnight)
+	for _, w := range l.windows {
+		switch {
+		case w.allDay,
+			w.from < w.to && w.from <= t && t < w.to,
+			w.from >= w.to && (t >= w.from || t < w.to):
+			return w.rate
+		}
+	}
+	return 0
+}
+
+// Blocks until n more bytes are allowed to move.
+func (l *Limiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+
+	l.lock.Lock()
+	now := time.Now()
+	rate := l.rate(now)
+	if rate <= 0 {
+		l.tokens, l.last = 0, now
+		l.lock.Unlock()
+		return
+	}
+
+	// refill for the time since last, up to a quarter second's worth
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * rate
+	}
+	burst := rate / 4
+	if burst < LIMIT_CHUNK {
+		burst = LIMIT_CHUNK
+	}
+	if l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+
+	// take them, waiting out whatever's owed
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / rate * float64(time.Second))
+	}
+	l.lock.Unlock()
+	time.Sleep(wait)
+}
+
+// Returns r, reading no faster than l allows
+func (l *Limiter) Reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{r, l}
+}
+
+type limitedReader struct {
+	r io.Reader
+	l *Limiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > LIMIT_CHUNK {
+		p = p[:LIMIT_CHUNK]
+	}
+	n, err := r.r.Read(p)
+	r.l.Wait(n)
+	return n, err
+}
+
+// LimitTransport throttles everything read from & written to a remote.
+type LimitTransport struct {
+	Transport
+	limiters []*Limiter
+}
+
+// Wraps t in a LimitTransport, unless none of limiters limit anything.
+func WrapLimit(t Transport, limiters ...*Limiter) Transport {
+	var have []*Limiter
+	for _, l := range limiters {
+		if l != nil {
+			have = append(have, l)
+		}
+	}
+	if len(have) == 0 {
+		return t
+	}
+	return &LimitTransport{t, have}
+}
+
+func (t *LimitTransport) Open(p string) (io.ReadCloser, error) {
+	file, err := t.Transport.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{t.reader(file), file}, nil
+}
+
+func (t *LimitTransport) OpenRange(p string, off, n int64) (io.ReadCloser, error) {
+	rr, ok := t.Transport.(RangeReader)
+	if !ok {
+		return nil, ErrNoRange
+	}
+	part, err := rr.OpenRange(p, off, n)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{t.reader(part), part}, nil
+}
+
+func (t *LimitTransport) Write(entry IndexEntry, r io.Reader) error {
+	return t.Transport.Write(entry, t.reader(r))
+}
+
+// Checksums p on the remote, if the remote's own transport can. Nothing's
+// sent, so there's nothing to limit.
+func (t *LimitTransport) Xsum(p string) ([]byte, error) {
+	cs, ok := t.Transport.(Checksummer)
+	if !ok {
+		return nil, ErrNoXsum
+	}
+	return cs.Xsum(p)
+}
+
+// Repairs through the remote's own transport (see Repair), limited
+func (t *LimitTransport) Repair(bin string, entry IndexEntry, r io.Reader) (string, error) {
+	return Repair(t.Transport, bin, entry, t.reader(r))
+}
+
+// r, limited by every limiter
+func (t *LimitTransport) reader(r io.Reader) io.Reader {
+	for _, l := range t.limiters {
+		r = l.Reader(r)
+	}
+	return r
+}
@@ -0,0 +1,107 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package veb
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestParseWindow(t *testing.T) {
+	from, to, err := parseWindow("08:30-23:00")
+	if err != nil || from != 8*time.Hour+30*time.Minute || to != 23*time.Hour {
+		t.Errorf("parseWindow(08:30-23:00) = %v, %v, %v", from, to, err)
+	}
+	for _, s := range []string{"08:00", "08:00-", "8-23", "08:00-24:00", "08:00-23:00-01:00", "25:00-01:00"} {
+		if _, _, err := parseWindow(s); err == nil {
+			t.Errorf("parseWindow(%q) worked", s)
+		}
+	}
+}
+
+func TestParseLimit(t *testing.T) {
+	for _, spec := range []string{"", " ", LIMIT_OFF} {
+		l, err := ParseLimit(spec)
+		if l != nil || err != nil {
+			t.Errorf("ParseLimit(%q) = %v, %v; want no limit", spec, l, err)
+		}
+	}
+	for _, spec := range []string{"fast", "08:00-23:00", "08:00-23:00 1MB extra", "8-23 1MB", "1MB, 08:00-23:00 lots"} {
+		if _, err := ParseLimit(spec); err == nil {
+			t.Errorf("ParseLimit(%q) worked", spec)
+		}
+	}
+}
+
+func TestLimiterRate(t *testing.T) {
+	mb, err := ParseSize("1MB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := func(h, m int) time.Time {
+		return time.Date(2012, 3, 4, h, m, 0, 0, time.Local)
+	}
+	tests := []struct {
+		spec string
+		at   time.Time
+		rate float64
+	}{
+		{"2MB", day(3, 0), float64(2 * mb)},
+		{"08:00-23:00 1MB, 23:00-08:00 off", day(8, 0), float64(mb)},
+		{"08:00-23:00 1MB, 23:00-08:00 off", day(22, 59), float64(mb)},
+		{"08:00-23:00 1MB, 23:00-08:00 off", day(23, 0), 0},
+		{"08:00-23:00 1MB, 23:00-08:00 off", day(3, 0), 0},
+		// wraps past midnight
+		{"22:00-06:00 1MB", day(23, 30), float64(mb)},
+		{"22:00-06:00 1MB", day(0, 0), float64(mb)},
+		{"22:00-06:00 1MB", day(5, 59), float64(mb)},
+		{"22:00-06:00 1MB", day(6, 0), 0}, // no window covers it
+		{"22:00-06:00 1MB", day(12, 0), 0},
+		// the first window that covers it wins
+		{"09:00-17:00 1MB, 2MB", day(10, 0), float64(mb)},
+		{"09:00-17:00 1MB, 2MB", day(18, 0), float64(2 * mb)},
+	}
+	for _, test := range tests {
+		l, err := ParseLimit(test.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rate := l.rate(test.at); rate != test.rate {
+			t.Errorf("%q at %s: %v bytes/s, want %v", test.spec, test.at.Format("15:04"), rate, test.rate)
+		}
+	}
+}
+
+func TestLimiterReader(t *testing.T) {
+	data := make([]byte, 3*LIMIT_CHUNK)
+
+	// nil & unlimited don't wait
+	for _, spec := range []string{LIMIT_OFF, "00:00-00:00 off"} {
+		l, err := ParseLimit(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(l.Reader(bytes.NewReader(data)))
+		if err != nil || len(got) != len(data) {
+			t.Errorf("reading through %q got %d bytes, %v", spec, len(got), err)
+		}
+	}
+
+	// a burst, then the rest at the rate
+	l, err := ParseLimit("320KB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	got, err := io.ReadAll(l.Reader(bytes.NewReader(data)))
+	if err != nil || len(got) != len(data) {
+		t.Errorf("reading through 320KB/s got %d bytes, %v", len(got), err)
+	}
+	if took := time.Since(start); took < 100*time.Millisecond {
+		t.Errorf("reading %d bytes at 320KB/s took %v, want about 0.2s", len(data), took)
+	}
+}
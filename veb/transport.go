@@ -0,0 +1,216 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Transport is how veb gets at a remote repository. Commands only talk to
+// remotes through a Transport, so adding a new kind of remote means adding a
+// Transport, not changing the commands.
+//
+// Paths given to a Transport are relative to the remote repository's root and
+// always use '/', like index paths. Missing files give errors that
+// os.IsNotExist() recognizes (e.g. an *os.PathError wrapping os.ErrNotExist).
+
+package veb
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// A remote repository's metadata & files
+type Transport interface {
+	// Where the remote repository is, for messages
+	URL() string
+
+	// Reads the remote's index
+	LoadIndex() (*Index, error)
+	// Saves the remote's index (and xsums)
+	SaveIndex(x *Index) error
+	// Finds new/changed files in the remote repository that haven't been
+	// committed there, like Index.Check(). Closes changed when done.
+	// Remotes without a working copy of their own just close changed.
+	Check(x *Index, changed chan IndexEntry) error
+
+	// Gets a file's stats
+	Stat(p string) (os.FileInfo, error)
+	// Opens a file for reading
+	Open(p string) (io.ReadCloser, error)
+	// Writes r to entry.Path, making folders as needed. The file is either
+	// completely written or left as it was. If entry.Xsum is set and r's
+	// content doesn't match it, nothing is written and an error is returned.
+	Write(entry IndexEntry, r io.Reader) error
+	// Moves a file, making folders as needed
+	Rename(from, to string) error
+	// Deletes a file, or a folder and everything in it
+	Remove(p string) error
+
+	// Bytes available for new files
+	FreeSpace() (int64, error)
+	// Done with the remote
+	Close() error
+}
+
+// Transports that can checksum a file where it is, without sending it
+type Checksummer interface {
+	Xsum(p string) ([]byte, error)
+}
+
+// Checksummer.Xsum's error from transports that wrap one that can't
+var ErrNoXsum = errors.New("remote can't checksum files itself")
+
+// Recomputes the checksum of file p on remote t: on the remote, if t is a
+// Checksummer, or by reading the file through t otherwise. Encrypted &
+// compressed remotes' files are always read, as they aren't stored the way
+// they're checksummed (reading an encrypted file checks that it's authentic,
+// too). streamed says which it was. Reading stops partway through if ctx is
+// cancelled.
+func RemoteXsum(ctx context.Context, t Transport, p string) (xsum []byte, streamed bool, err error) {
+	if cs, ok := t.(Checksummer); ok {
+		xsum, err := cs.Xsum(p)
+		if err != ErrNoXsum {
+			return xsum, false, err
+		}
+	}
+
+	file, err := t.Open(p)
+	if err != nil {
+		return nil, true, err
+	}
+	defer file.Close()
+	hasher := NewHasher()
+	_, err = io.Copy(hasher, ContextReader(ctx, file))
+	if err != nil {
+		return nil, true, err
+	}
+	return hasher.Sum(nil), true, nil
+}
+
+// Returns a Transport for the remote repository at rawurl.
+// Plain paths and file:// URLs are local (or mounted) folders; veb:// URLs are
+// served by 'veb serve'; ssh:// URLs run 'veb serve --stdio' over ssh; s3://
+// URLs are buckets; webdav:// & davs:// URLs are WebDAV shares.
+func NewTransport(rawurl string, log *Log) (Transport, error) {
+	if !strings.Contains(rawurl, "://") {
+		return NewLocalTransport(rawurl, log), nil
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("veb could not understand remote %s: %v", rawurl, err)
+	}
+	switch u.Scheme {
+	case "file":
+		return NewLocalTransport(u.Path, log), nil
+	case VEB_SCHEME:
+		return NewNetTransport(u, log)
+	case SSH_SCHEME:
+		return NewSSHTransport(u, log)
+	case S3_SCHEME, S3_HTTP_SCHEME:
+		return NewS3Transport(u, log)
+	case DAV_SCHEME, DAVS_SCHEME:
+		return NewDAVTransport(u, log)
+	}
+	return nil, fmt.Errorf("veb doesn't know how to reach %s:// remotes", u.Scheme)
+}
+
+// Whether rawurl is a local (or mounted) folder
+func IsLocalURL(rawurl string) bool {
+	return !strings.Contains(rawurl, "://") || strings.HasPrefix(rawurl, "file://")
+}
+
+// Copies the remote file p into the local file dest, then checks the copy
+// against entry's checksum before it replaces dest.
+func Fetch(t Transport, p string, entry IndexEntry, dest string) error {
+	in, err := t.Open(p)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	return writeLocal(dest, entry, in)
+}
+
+// Sets entry's stats from the remote file at entry.Path
+func StatEntry(t Transport, entry *IndexEntry) error {
+	info, err := t.Stat(entry.Path)
+	if err != nil {
+		return err
+	}
+
+	entry.Name = info.Name()
+	entry.Size = info.Size()
+	entry.Mode = info.Mode()
+	entry.ModTime = info.ModTime()
+	return nil
+}
+
+// Reads & gob decodes the remote file p into v.
+// Returns os.IsNotExist() errors as-is, so callers can start from empty.
+func loadGob(t Transport, p string, v interface{}) error {
+	file, err := t.Open(p)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return gob.NewDecoder(file).Decode(v)
+}
+
+// Gob encodes v into the remote file p
+func saveGob(t Transport, p string, v interface{}) error {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		return err
+	}
+
+	return t.Write(IndexEntry{Path: p, Mode: 0644, Size: int64(buf.Len())}, &buf)
+}
+
+// Decodes the index of the remote repository at root, read from r
+func decodeIndex(r io.Reader, root string, log *Log) (*Index, error) {
+	var x Index
+	err := gob.NewDecoder(r).Decode(&x)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load index: %v", err)
+	}
+	return remoteIndex(&x, root, log), nil
+}
+
+// Fills in what a remote's index doesn't carry: where it's from, a logger,
+// and empty maps for what it has none of
+func remoteIndex(x *Index, root string, log *Log) *Index {
+	x.Root = root
+	x.log = log
+	if x.Files == nil {
+		x.Files = make(map[string]IndexEntry)
+	}
+	if x.Remotes == nil {
+		x.Remotes = make(map[string]*Remote)
+	}
+	return x
+}
+
+// Encodes x for saving on a remote, bumping its Generation as Index.Save()
+// does. Returns the index file's contents, and the xsums file's.
+func encodeIndex(x *Index) ([]byte, []byte, error) {
+	x.Generation++
+	var index bytes.Buffer
+	err := gob.NewEncoder(&index).Encode(x)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var xsums bytes.Buffer
+	for _, e := range x.Files {
+		xsums.WriteString(XsumString(&e))
+	}
+	return index.Bytes(), xsums.Bytes(), nil
+}
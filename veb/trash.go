@@ -0,0 +1,175 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Trash holds files that were deleted from a repository by veb instead of
+// unlinking them. Each batch of deleted files goes into its own bin, named
+// after the time it was created:
+//   .veb/trash/<timestamp>/<path>
+//
+// The trash keeps its own index of bins & their files' index entries, so it
+// can be listed and restored from without walking the trash folders.
+
+package veb
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+const (
+	TRASH_FOLDER = "trash"           // inside of META_FOLDER only
+	TRASH_INDEX  = "index"           // inside of TRASH_FOLDER only
+	TRASH_TIME   = "20060102-150405" // bin name format
+)
+
+// All the trash bins of a veb repository, oldest first.
+type Trash struct {
+	Bins []*TrashBin
+	repo Transport // the veb repository this trash belongs to
+	log  *Log      // error/warn/info logging
+}
+
+// One batch of deleted files
+type TrashBin struct {
+	Name  string                // folder name inside of TRASH_FOLDER
+	When  time.Time             // when the files were trashed
+	Files map[string]IndexEntry // index entries of the trashed files
+}
+
+// Reads the trash index of the repository.
+// A repository without any trash gets an empty Trash.
+func LoadTrash(repo Transport, log *Log) (*Trash, error) {
+	ret := &Trash{make([]*TrashBin, 0), repo, log}
+
+	err := loadGob(repo, path.Join(META_FOLDER, TRASH_FOLDER, TRASH_INDEX), &ret.Bins)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ret, nil
+		}
+		log.Err().Println("couldn't load trash index:", err)
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// Saves the trash index, encoded with gob
+func (t *Trash) Save() error {
+	err := saveGob(t.repo, path.Join(META_FOLDER, TRASH_FOLDER, TRASH_INDEX), t.Bins)
+	if err != nil {
+		t.log.Err().Println("couldn't save trash index:", err)
+	}
+	return err
+}
+
+// Creates a new, empty bin for files trashed at time when.
+func (t *Trash) NewBin(when time.Time) *TrashBin {
+	name := when.Format(TRASH_TIME)
+	for i := 1; t.Bin(name) != nil; i++ {
+		name = fmt.Sprintf("%s.%d", when.Format(TRASH_TIME), i)
+	}
+
+	bin := &TrashBin{name, when, make(map[string]IndexEntry)}
+	t.Bins = append(t.Bins, bin)
+	return bin
+}
+
+// Returns the bin with the given name, or nil if there isn't one.
+func (t *Trash) Bin(name string) *TrashBin {
+	for _, b := range t.Bins {
+		if b.Name == name {
+			return b
+		}
+	}
+	return nil
+}
+
+// Moves the entry's file out of the repository and into the bin.
+func (t *Trash) Put(bin *TrashBin, entry IndexEntry) error {
+	err := t.repo.Rename(entry.Path, t.Path(bin, entry.Path))
+	if err != nil {
+		t.log.Err().Println(err)
+		return err
+	}
+
+	bin.Files[entry.Path] = entry
+	return nil
+}
+
+// Returns the location of a trashed file in the repository
+func (t *Trash) Path(bin *TrashBin, file string) string {
+	return path.Join(META_FOLDER, TRASH_FOLDER, bin.Name, file)
+}
+
+// Deletes the bin and all files in it for good.
+func (t *Trash) Empty(bin *TrashBin) error {
+	err := t.repo.Remove(path.Join(META_FOLDER, TRASH_FOLDER, bin.Name))
+	if err != nil && !os.IsNotExist(err) {
+		t.log.Err().Println(err)
+		return err
+	}
+
+	for i, b := range t.Bins {
+		if b == bin {
+			t.Bins = append(t.Bins[:i], t.Bins[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// Empties bins older than maxAge, then the oldest bins until the trash is no
+// bigger than maxSize. Zero for either means no limit.
+// Returns the emptied bins.
+func (t *Trash) Prune(maxAge time.Duration, maxSize int64) ([]*TrashBin, error) {
+	sort.Sort(binsByTime(t.Bins))
+	pruned := make([]*TrashBin, 0)
+
+	total := t.Size()
+	for len(t.Bins) > 0 {
+		oldest := t.Bins[0]
+		tooOld := maxAge > 0 && time.Since(oldest.When) > maxAge
+		tooBig := maxSize > 0 && total > maxSize
+		if !tooOld && !tooBig {
+			break
+		}
+
+		err := t.Empty(oldest)
+		if err != nil {
+			return pruned, err
+		}
+		total -= oldest.Size()
+		pruned = append(pruned, oldest)
+	}
+
+	return pruned, nil
+}
+
+// Total size of the files in all bins
+func (t *Trash) Size() int64 {
+	size := int64(0)
+	for _, b := range t.Bins {
+		size += b.Size()
+	}
+	return size
+}
+
+// Total size of the files in the bin
+func (b *TrashBin) Size() int64 {
+	size := int64(0)
+	for _, e := range b.Files {
+		size += e.Size
+	}
+	return size
+}
+
+// sort.Interface for ordering bins oldest first
+type binsByTime []*TrashBin
+
+func (b binsByTime) Len() int           { return len(b) }
+func (b binsByTime) Less(i, j int) bool { return b[i].When.Before(b[j].When) }
+func (b binsByTime) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
@@ -0,0 +1,122 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package veb
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Puts a new file of size bytes at p in the repository, then in bin
+func trashFile(t *testing.T, trash *Trash, bin *TrashBin, p string, size int) {
+	t.Helper()
+	entry, data := testFile(p, size)
+	err := trash.repo.Write(entry, bytes.NewReader(data))
+	if err == nil {
+		err = trash.Put(bin, entry)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func binNames(bins []*TrashBin) []string {
+	names := make([]string, len(bins))
+	for i, b := range bins {
+		names[i] = b.Name
+	}
+	return names
+}
+
+func TestTrashPut(t *testing.T) {
+	root := newTestRepo(t)
+	trash, err := LoadTrash(NewLocalTransport(root, testLog()), testLog())
+	if err != nil {
+		t.Fatal(err)
+	}
+	when := time.Date(2012, 3, 4, 5, 6, 7, 0, time.Local)
+	bin := trash.NewBin(when)
+	trashFile(t, trash, bin, "a/song.mp3", 100)
+	if _, err := os.Stat(filepath.Join(root, "a/song.mp3")); !os.IsNotExist(err) {
+		t.Errorf("trashed file is still in the repository: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, trash.Path(bin, "a/song.mp3"))); err != nil {
+		t.Errorf("trashed file isn't in its bin: %v", err)
+	}
+
+	// bins made at the same time get their own names
+	again := trash.NewBin(when)
+	if again.Name == bin.Name || trash.Bin(again.Name) != again {
+		t.Errorf("second bin for %v is named %s, like the first", when, again.Name)
+	}
+
+	err = trash.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadTrash(trash.repo, testLog())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := loaded.Bin(bin.Name)
+	if len(loaded.Bins) != 2 || b == nil || b.Files["a/song.mp3"].Size != 100 {
+		t.Errorf("loaded trash has bins %v, want %s with a/song.mp3 & %s", binNames(loaded.Bins), bin.Name, again.Name)
+	}
+}
+
+func TestTrashPrune(t *testing.T) {
+	root := newTestRepo(t)
+	trash, err := LoadTrash(NewLocalTransport(root, testLog()), testLog())
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := 24 * time.Hour
+	now := time.Now()
+	// made out of order; pruning goes by age
+	mid := trash.NewBin(now.Add(-3 * day))
+	trashFile(t, trash, mid, "mid", 300)
+	old := trash.NewBin(now.Add(-10 * day))
+	trashFile(t, trash, old, "old/a", 100)
+	trashFile(t, trash, old, "old/b", 100)
+	recent := trash.NewBin(now.Add(-time.Hour))
+	trashFile(t, trash, recent, "recent", 400)
+	if trash.Size() != 900 {
+		t.Errorf("trash size %d, want 900", trash.Size())
+	}
+
+	// nothing's too old or too big
+	pruned, err := trash.Prune(30*day, 1000)
+	if err != nil || len(pruned) != 0 {
+		t.Errorf("Prune(30 days, 1000) emptied %v, %v; want none", binNames(pruned), err)
+	}
+
+	pruned, err = trash.Prune(5*day, 0)
+	if err != nil || len(pruned) != 1 || pruned[0] != old {
+		t.Errorf("Prune(5 days) emptied %v, %v; want %s", binNames(pruned), err, old.Name)
+	}
+	if _, err := os.Stat(filepath.Join(root, META_FOLDER, TRASH_FOLDER, old.Name)); !os.IsNotExist(err) {
+		t.Errorf("emptied bin's folder is still there: %v", err)
+	}
+
+	// oldest first until it fits
+	pruned, err = trash.Prune(0, 500)
+	if err != nil || len(pruned) != 1 || pruned[0] != mid {
+		t.Errorf("Prune(500 bytes) emptied %v, %v; want %s", binNames(pruned), err, mid.Name)
+	}
+	if len(trash.Bins) != 1 || trash.Bins[0] != recent || trash.Size() != 400 {
+		t.Errorf("trash has %v (%d bytes) left, want %s (400)", binNames(trash.Bins), trash.Size(), recent.Name)
+	}
+	if _, err := os.Stat(filepath.Join(root, trash.Path(recent, "recent"))); err != nil {
+		t.Errorf("bin that wasn't pruned lost its file: %v", err)
+	}
+
+	pruned, err = trash.Prune(0, 1)
+	if err != nil || len(pruned) != 1 || len(trash.Bins) != 0 {
+		t.Errorf("Prune(1 byte) emptied %v, %v, & left %v; want all of it", binNames(pruned), err, binNames(trash.Bins))
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux && (amd64 || arm64 || loong64 || mips64 || mips64le || ppc64 || ppc64le || riscv64)
+
+// reading files from the disk rather than the page cache
+
+package veb
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+const (
+	FADV_DONTNEED = 4               // posix_fadvise() advice to drop cached pages
+	UNCACHED_DROP = 8 * 1024 * 1024 // bytes read between drops
+)
+
+// Opens name for reading from the disk rather than the page cache: any pages
+// of it that are cached are dropped first (after writing them out, as dirty
+// pages can't be), and pages are dropped again as they're read, so reading a
+// big file doesn't push everything else out of the cache.
+func OpenUncached(name string) (io.ReadCloser, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	file.Sync() // best effort; fadvise() just leaves what it can't drop
+	fadvise(file, 0, 0)
+	return &uncachedFile{file: file}, nil
+}
+
+type uncachedFile struct {
+	file    *os.File
+	read    int64 // bytes read so far
+	dropped int64 // bytes of those dropped from the cache
+}
+
+func (f *uncachedFile) Read(p []byte) (int, error) {
+	n, err := f.file.Read(p)
+	f.read += int64(n)
+	if f.read-f.dropped >= UNCACHED_DROP {
+		fadvise(f.file, f.dropped, f.read-f.dropped)
+		f.dropped = f.read
+	}
+	return n, err
+}
+
+func (f *uncachedFile) Close() error {
+	fadvise(f.file, 0, 0)
+	return f.file.Close()
+}
+
+// Asks the kernel to drop n bytes (0 = to the end) of file at off from the
+// page cache. It's only advice, so errors are ignored.
+func fadvise(file *os.File, off, n int64) {
+	syscall.Syscall6(syscall.SYS_FADVISE64, file.Fd(), uintptr(off), uintptr(n), FADV_DONTNEED, 0, 0)
+}
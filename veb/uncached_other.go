@@ -0,0 +1,20 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux || !(amd64 || arm64 || loong64 || mips64 || mips64le || ppc64 || ppc64le || riscv64)
+
+// reading files from the disk rather than the page cache
+
+package veb
+
+import (
+	"io"
+	"os"
+)
+
+// Opens name for reading from the disk rather than the page cache.
+// Not supported here, so it's read like any other file.
+func OpenUncached(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
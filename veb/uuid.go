@@ -0,0 +1,26 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// random (version 4) UUIDs for telling repositories apart
+
+package veb
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// Returns a new random UUID, e.g. "1b4e28ba-2fa1-41d2-883f-0016d3cca427"
+func NewUUID() (string, error) {
+	u := make([]byte, 16)
+	_, err := rand.Read(u)
+	if err != nil {
+		return "", err
+	}
+
+	u[6] = (u[6] & 0x0f) | 0x40 // version 4
+	u[8] = (u[8] & 0x3f) | 0x80 // RFC 4122 variant
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:]), nil
+}
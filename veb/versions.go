@@ -0,0 +1,278 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Versions keeps the previous copies of files that push overwrote, so that
+// pushing a damaged file doesn't destroy the only good copy. Copies are kept
+// by their old checksum:
+//   .veb/versions/<hex xsum>
+//
+// Identical copies share one file. The versions index records which paths
+// each copy used to be, and when it was replaced.
+
+package veb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	VERSIONS_FOLDER = "versions" // inside of META_FOLDER only
+	VERSIONS_INDEX  = "index"    // inside of VERSIONS_FOLDER only
+)
+
+// All kept versions of a veb repository's files
+type Versions struct {
+	Files map[string][]Version // path -> versions, oldest first
+	repo  Transport            // the veb repository these belong to
+	log   *Log                 // error/warn/info logging
+	lock  sync.Mutex           // Keep() is called from many push handlers
+}
+
+// A previous copy of a file
+type Version struct {
+	Entry IndexEntry // index entry of the file when it was replaced
+	Saved time.Time  // when it was replaced
+}
+
+// Reads the versions index of the repository.
+// A repository without any versions gets an empty Versions.
+func LoadVersions(repo Transport, log *Log) (*Versions, error) {
+	ret := &Versions{Files: make(map[string][]Version), repo: repo, log: log}
+
+	err := loadGob(repo, path.Join(META_FOLDER, VERSIONS_FOLDER, VERSIONS_INDEX), &ret.Files)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ret, nil
+		}
+		log.Err().Println("couldn't load versions index:", err)
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// Saves the versions index, encoded with gob
+func (v *Versions) Save() error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	err := saveGob(v.repo, path.Join(META_FOLDER, VERSIONS_FOLDER, VERSIONS_INDEX), v.Files)
+	if err != nil {
+		v.log.Err().Println("couldn't save versions index:", err)
+	}
+	return err
+}
+
+// Moves the entry's file out of the repository and into the versions folder,
+// ahead of it being overwritten.
+func (v *Versions) Keep(entry IndexEntry) error {
+	if len(entry.Xsum) == 0 {
+		return fmt.Errorf("can't keep a version of %s: it has no checksum", entry.Path)
+	}
+
+	err := v.repo.Rename(entry.Path, v.Path(entry.Xsum))
+	if err != nil {
+		v.log.Err().Println(err)
+		return err
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.Files[entry.Path] = append(v.Files[entry.Path], Version{entry, time.Now()})
+	return nil
+}
+
+// Undoes Keep(entry), putting the kept copy back where it was, for when
+// overwriting the file failed. A copy other versions share stays kept too.
+func (v *Versions) Unkeep(entry IndexEntry) error {
+	v.lock.Lock()
+	kept := v.Files[entry.Path]
+	for i := len(kept) - 1; i >= 0; i-- {
+		if bytes.Equal(kept[i].Entry.Xsum, entry.Xsum) {
+			kept = append(kept[:i:i], kept[i+1:]...)
+			break
+		}
+	}
+	if len(kept) == 0 {
+		delete(v.Files, entry.Path)
+	} else {
+		v.Files[entry.Path] = kept
+	}
+	shared := false
+	for _, versions := range v.Files {
+		for _, ver := range versions {
+			shared = shared || bytes.Equal(ver.Entry.Xsum, entry.Xsum)
+		}
+	}
+	v.lock.Unlock()
+
+	if !shared {
+		return v.repo.Rename(v.Path(entry.Xsum), entry.Path)
+	}
+	file, err := v.repo.Open(v.Path(entry.Xsum))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return v.repo.Write(entry, file)
+}
+
+// Returns the location of a kept copy in the repository
+func (v *Versions) Path(xsum []byte) string {
+	return path.Join(META_FOLDER, VERSIONS_FOLDER, fmt.Sprintf("%x", xsum))
+}
+
+// Finds a version of file by checksum (hex, or any unique prefix of it) or by
+// time. A time finds the copy the remote had at that time: the oldest version
+// replaced after it. Times are "2006-01-02", "2006-01-02 15:04" or RFC3339;
+// a date alone means the end of that day.
+func (v *Versions) Find(file, which string) (Version, error) {
+	versions := v.Files[file]
+	if len(versions) == 0 {
+		return Version{}, fmt.Errorf("no versions of %s", file)
+	}
+
+	// by checksum
+	which = strings.ToLower(which)
+	found := make([]Version, 0)
+	for _, ver := range versions {
+		if strings.HasPrefix(fmt.Sprintf("%x", ver.Entry.Xsum), which) {
+			found = append(found, ver)
+		}
+	}
+	if len(found) > 0 {
+		// same checksum kept twice is still the same copy
+		for _, ver := range found[1:] {
+			if string(ver.Entry.Xsum) != string(found[0].Entry.Xsum) {
+				return Version{}, fmt.Errorf("%q matches more than one version of %s", which, file)
+			}
+		}
+		return found[len(found)-1], nil
+	}
+
+	// by time
+	when, err := parseWhen(which)
+	if err != nil {
+		return Version{}, fmt.Errorf("%q is not a version checksum or time of %s", which, file)
+	}
+	for _, ver := range versions {
+		if ver.Saved.After(when) {
+			return ver, nil
+		}
+	}
+	return Version{}, fmt.Errorf("no versions of %s were replaced after %v", file, when)
+}
+
+// Deletes versions older than maxAge, all but the newest maxCount versions of
+// each file, and then the oldest versions until all versions take up no more
+// than maxSize. Zero for any of them means no limit.
+// Returns the number of versions deleted.
+func (v *Versions) Prune(maxAge time.Duration, maxCount int, maxSize int64) (int, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	// flatten, oldest first
+	all := make([]Version, 0)
+	for _, versions := range v.Files {
+		all = append(all, versions...)
+	}
+	sort.Sort(versionsByTime(all))
+
+	total := int64(0)
+	for _, ver := range all {
+		total += ver.Entry.Size
+	}
+
+	// count from newest to find which ones are past maxCount
+	remove := make(map[int]bool)
+	count := make(map[string]int)
+	for i := len(all) - 1; i >= 0; i-- {
+		count[all[i].Entry.Path]++
+		tooMany := maxCount > 0 && count[all[i].Entry.Path] > maxCount
+		tooOld := maxAge > 0 && time.Since(all[i].Saved) > maxAge
+		if tooMany || tooOld {
+			remove[i] = true
+			total -= all[i].Entry.Size
+		}
+	}
+	for i := range all {
+		if maxSize <= 0 || total <= maxSize {
+			break
+		}
+		if !remove[i] {
+			remove[i] = true
+			total -= all[i].Entry.Size
+		}
+	}
+
+	// rebuild the index without the removed versions
+	v.Files = make(map[string][]Version)
+	used := make(map[string]bool)
+	for i, ver := range all {
+		if !remove[i] {
+			v.Files[ver.Entry.Path] = append(v.Files[ver.Entry.Path], ver)
+			used[string(ver.Entry.Xsum)] = true
+		}
+	}
+
+	// delete copies nothing uses any more
+	var retVal error = nil
+	for i, ver := range all {
+		if remove[i] && !used[string(ver.Entry.Xsum)] {
+			err := v.repo.Remove(v.Path(ver.Entry.Xsum))
+			if err != nil && !os.IsNotExist(err) {
+				v.log.Err().Println(err)
+				retVal = err
+			}
+			used[string(ver.Entry.Xsum)] = true // don't try twice
+		}
+	}
+
+	return len(remove), retVal
+}
+
+// Total size of the kept copies. Copies shared by versions are counted once.
+func (v *Versions) Size() int64 {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	size := int64(0)
+	counted := make(map[string]bool)
+	for _, versions := range v.Files {
+		for _, ver := range versions {
+			if !counted[string(ver.Entry.Xsum)] {
+				size += ver.Entry.Size
+				counted[string(ver.Entry.Xsum)] = true
+			}
+		}
+	}
+	return size
+}
+
+// Parses the times Find() understands
+func parseWhen(s string) (time.Time, error) {
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err == nil {
+		return t.Add(24*time.Hour - time.Nanosecond), nil
+	}
+	t, err = time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+	if err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// sort.Interface for ordering versions oldest first
+type versionsByTime []Version
+
+func (v versionsByTime) Len() int           { return len(v) }
+func (v versionsByTime) Less(i, j int) bool { return v[i].Saved.Before(v[j].Saved) }
+func (v versionsByTime) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
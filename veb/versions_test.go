@@ -0,0 +1,164 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package veb
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Versions of a new repository
+func newTestVersions(t *testing.T) (string, *Versions) {
+	root := newTestRepo(t)
+	v, err := LoadVersions(NewLocalTransport(root, testLog()), testLog())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root, v
+}
+
+// Puts a file of size bytes at p in the repository, then keeps it
+func keepFile(t *testing.T, v *Versions, p string, size int) IndexEntry {
+	t.Helper()
+	entry, data := testFile(p, size)
+	err := v.repo.Write(entry, bytes.NewReader(data))
+	if err == nil {
+		err = v.Keep(entry)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entry
+}
+
+// Whether xsum's kept copy is on disk under root
+func haveVersion(root string, v *Versions, xsum []byte) bool {
+	_, err := os.Stat(filepath.Join(root, v.Path(xsum)))
+	return err == nil
+}
+
+func TestVersionsKeep(t *testing.T) {
+	root, v := newTestVersions(t)
+	entry := keepFile(t, v, "a.mp3", 100)
+	if _, err := os.Stat(filepath.Join(root, "a.mp3")); !os.IsNotExist(err) {
+		t.Errorf("kept file is still in the repository: %v", err)
+	}
+	if !haveVersion(root, v, entry.Xsum) || len(v.Files["a.mp3"]) != 1 {
+		t.Fatalf("kept copy of a.mp3 isn't there")
+	}
+
+	err := v.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadVersions(v.repo, testLog())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Files["a.mp3"]) != 1 || !bytes.Equal(loaded.Files["a.mp3"][0].Entry.Xsum, entry.Xsum) {
+		t.Errorf("loaded versions of a.mp3: %v, want the one kept", loaded.Files["a.mp3"])
+	}
+
+	err = v.Unkeep(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v.Files) != 0 || haveVersion(root, v, entry.Xsum) {
+		t.Errorf("Unkeep left versions %v behind", v.Files)
+	}
+	r, err := v.repo.Open("a.mp3")
+	if got := readAll(t, r, err); int64(len(got)) != entry.Size {
+		t.Errorf("a.mp3 has %d bytes after Unkeep, want %d", len(got), entry.Size)
+	}
+}
+
+// Identical files share one kept copy, which stays until nothing uses it
+func TestVersionsShared(t *testing.T) {
+	root, v := newTestVersions(t)
+	a := keepFile(t, v, "a.mp3", 100)
+	b := keepFile(t, v, "b.mp3", 100)
+	if v.Size() != 100 {
+		t.Errorf("versions take up %d bytes, want 100 for one shared copy", v.Size())
+	}
+
+	err := v.Unkeep(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !haveVersion(root, v, a.Xsum) || len(v.Files["a.mp3"]) != 1 {
+		t.Fatalf("Unkeep of b.mp3 took the copy a.mp3's version shares")
+	}
+	if _, ok := v.Files["b.mp3"]; ok {
+		t.Errorf("b.mp3 still has versions %v after Unkeep", v.Files["b.mp3"])
+	}
+	r, err := v.repo.Open("b.mp3")
+	if got := readAll(t, r, err); int64(len(got)) != b.Size {
+		t.Errorf("b.mp3 has %d bytes after Unkeep, want %d", len(got), b.Size)
+	}
+
+	err = v.Unkeep(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if haveVersion(root, v, a.Xsum) || len(v.Files) != 0 {
+		t.Errorf("last Unkeep left the copy or versions %v behind", v.Files)
+	}
+}
+
+func TestVersionsPrune(t *testing.T) {
+	root, v := newTestVersions(t)
+	day := 24 * time.Hour
+	now := time.Now()
+	// Saved is set by hand so there's an order to prune in
+	keep := func(p string, size int, age time.Duration) IndexEntry {
+		entry := keepFile(t, v, p, size)
+		kept := v.Files[p]
+		kept[len(kept)-1].Saved = now.Add(-age)
+		return entry
+	}
+	old := keep("a.mp3", 100, 10*day)
+	shared := keep("b.mp3", 200, 9*day)
+	keep("a.mp3", 300, 3*day)
+	keep("a.mp3", 400, 2*day)
+	keep("c.mp3", 200, day) // shares b.mp3's copy
+
+	// nothing's too old, too many or too big
+	n, err := v.Prune(30*day, 10, 10000)
+	if err != nil || n != 0 {
+		t.Errorf("Prune(30 days, 10, 10000) deleted %d, %v; want none", n, err)
+	}
+
+	n, err = v.Prune(5*day, 0, 0)
+	if err != nil || n != 2 {
+		t.Errorf("Prune(5 days) deleted %d, %v; want 2", n, err)
+	}
+	if haveVersion(root, v, old.Xsum) {
+		t.Errorf("copy of a pruned version is still there")
+	}
+	if !haveVersion(root, v, shared.Xsum) || len(v.Files["c.mp3"]) != 1 {
+		t.Errorf("copy c.mp3's version shares with a pruned one is gone")
+	}
+	if _, ok := v.Files["b.mp3"]; ok {
+		t.Errorf("b.mp3 still has versions %v", v.Files["b.mp3"])
+	}
+
+	// only the newest of a.mp3's two
+	n, err = v.Prune(0, 1, 0)
+	if err != nil || n != 1 || len(v.Files["a.mp3"]) != 1 || v.Files["a.mp3"][0].Entry.Size != 400 {
+		t.Errorf("Prune(1 each) deleted %d, %v, & left a.mp3 with %v; want 1 & the 400 byte one", n, err, v.Files["a.mp3"])
+	}
+
+	// oldest first until it fits
+	n, err = v.Prune(0, 0, 300)
+	if err != nil || n != 1 || len(v.Files) != 1 || len(v.Files["c.mp3"]) != 1 {
+		t.Errorf("Prune(300 bytes) deleted %d, %v, & left %v; want 1 & c.mp3's", n, err, v.Files)
+	}
+	if v.Size() != 200 {
+		t.Errorf("versions take up %d bytes, want 200", v.Size())
+	}
+}
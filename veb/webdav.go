@@ -0,0 +1,403 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// DAVTransport is a Transport for remote repositories on WebDAV shares:
+//   webdav://[user@]host[:port]/path  (http)
+//   davs://[user@]host[:port]/path    (https)
+// The password can be in the URL, but is better off in $VEB_DAV_PASSWORD.
+//
+// Files are PUT to a temp name next to where they go, checksummed as they
+// stream out, and only MOVEd into place if they match. Folders are made with
+// MKCOL, and stats come from PROPFIND.
+
+package veb
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	DAV_SCHEME   = "webdav"           // webdav://host/path URLs, over http
+	DAVS_SCHEME  = "davs"             // the same, over https
+	DAV_PASSWORD = "VEB_DAV_PASSWORD" // environment variable with the password
+)
+
+type DAVTransport struct {
+	url      string
+	base     url.URL // repository's root collection
+	user     string
+	password string
+	client   *http.Client
+	madeDirs sync.Map // collections known to exist
+	log      *Log     // error/warn/info logging
+}
+
+// Returns a DAVTransport for a webdav:// or davs:// URL.
+func NewDAVTransport(u *url.URL, log *Log) (*DAVTransport, error) {
+	base := *u
+	base.Scheme = "http"
+	if u.Scheme == DAVS_SCHEME {
+		base.Scheme = "https"
+	}
+	base.User = nil
+	base.RawQuery = ""
+	base.Path = strings.TrimSuffix(u.Path, "/")
+	base.RawPath = ""
+
+	t := &DAVTransport{url: u.Redacted(), base: base, client: &http.Client{}, log: log}
+	if u.User != nil {
+		t.user = u.User.Username()
+		t.password, _ = u.User.Password()
+	}
+	if pw := os.Getenv(DAV_PASSWORD); pw != "" {
+		t.password = pw
+	}
+	return t, nil
+}
+
+func (t *DAVTransport) URL() string {
+	return t.url
+}
+
+func (t *DAVTransport) LoadIndex() (*Index, error) {
+	body, err := t.Open(path.Join(META_FOLDER, INDEX_FILE))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return decodeIndex(body, t.url, t.log)
+}
+
+// Saves the index & xsums, keeping the old ones as index~ and xsums~ like
+// Index.Save() does.
+func (t *DAVTransport) SaveIndex(x *Index) error {
+	indexFile := path.Join(META_FOLDER, INDEX_FILE)
+	xsumsFile := path.Join(META_FOLDER, XSUMS_FILE)
+	// copied, not moved, so a failed save leaves the old ones in place
+	for _, p := range []string{indexFile, xsumsFile} {
+		err := t.copy(p, p+"~")
+		if err != nil && !os.IsNotExist(err) {
+			t.log.Warn().Println("could not backup old", p, ":", err)
+		}
+	}
+
+	index, xsums, err := encodeIndex(x)
+	if err != nil {
+		return err
+	}
+	err = t.Write(IndexEntry{Path: indexFile, Size: int64(len(index))}, bytes.NewReader(index))
+	if err != nil {
+		return err
+	}
+	return t.Write(IndexEntry{Path: xsumsFile, Size: int64(len(xsums))}, bytes.NewReader(xsums))
+}
+
+// Shares have no working copy for veb to check, so nothing is ever
+// uncommitted there.
+func (t *DAVTransport) Check(x *Index, changed chan IndexEntry) error {
+	close(changed)
+	return nil
+}
+
+func (t *DAVTransport) Stat(p string) (os.FileInfo, error) {
+	props, err := t.propfind(p, "<d:getcontentlength/><d:getlastmodified/><d:resourcetype/>")
+	if err != nil {
+		return nil, err
+	}
+
+	size, _ := strconv.ParseInt(props.ContentLength, 10, 64)
+	modTime, _ := http.ParseTime(props.LastModified)
+	mode := os.FileMode(0644)
+	if props.ResourceType.Collection != nil {
+		mode = os.ModeDir | 0755
+	}
+	return netStat{path.Base(p), size, mode, modTime}, nil
+}
+
+func (t *DAVTransport) Open(p string) (io.ReadCloser, error) {
+	resp, err := t.do("GET", p, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Gets just n bytes of the file, from off
+func (t *DAVTransport) OpenRange(p string, off, n int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+n-1))
+	resp, err := t.do("GET", p, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	return rangeBody(resp, off, n)
+}
+
+// Streams r to a temp name, checksumming it on the way, then moves it over
+// entry.Path if it matches entry.Xsum and the share got all of it.
+func (t *DAVTransport) Write(entry IndexEntry, r io.Reader) error {
+	p := cleanPath(entry.Path)
+	err := t.mkdirs(path.Dir(p))
+	if err != nil {
+		return err
+	}
+
+	tmp := p + TEMP_SUFFIX
+	hasher := NewHasher()
+	counter := &countingReader{r: io.TeeReader(r, hasher)}
+	header := http.Header{}
+	if entry.Size > 0 {
+		// not every share takes chunked uploads
+		header.Set("Content-Length", strconv.FormatInt(entry.Size, 10))
+	}
+	resp, err := t.do("PUT", tmp, header, counter)
+	if err != nil {
+		t.Remove(tmp)
+		return err
+	}
+	resp.Body.Close()
+
+	if entry.Xsum != nil && !bytes.Equal(hasher.Sum(nil), entry.Xsum) {
+		err = fmt.Errorf("%s doesn't match its checksum", entry.Path)
+	}
+	if err == nil {
+		var info os.FileInfo
+		info, err = t.Stat(tmp)
+		if err == nil && info.Size() != counter.n {
+			err = fmt.Errorf("%s: share has %d bytes, sent %d", entry.Path, info.Size(), counter.n)
+		}
+	}
+	if err == nil {
+		err = t.move(tmp, p)
+	}
+	if err != nil {
+		t.Remove(tmp)
+	}
+	return err
+}
+
+// Moves a file, making folders as needed
+func (t *DAVTransport) Rename(from, to string) error {
+	err := t.mkdirs(path.Dir(cleanPath(to)))
+	if err != nil {
+		return err
+	}
+	return t.move(from, to)
+}
+
+func (t *DAVTransport) Remove(p string) error {
+	resp, err := t.do("DELETE", p, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	// it may have been a collection mkdirs() remembers
+	p = cleanPath(p)
+	t.madeDirs.Range(func(dir, _ interface{}) bool {
+		if dir == p || strings.HasPrefix(dir.(string), p+"/") {
+			t.madeDirs.Delete(dir)
+		}
+		return true
+	})
+	return nil
+}
+
+// From the share's quota, if it reports one (RFC 4331)
+func (t *DAVTransport) FreeSpace() (int64, error) {
+	props, err := t.propfind("", "<d:quota-available-bytes/>")
+	if err != nil {
+		return 0, err
+	}
+	if props.QuotaAvailable == "" {
+		return 0, fmt.Errorf("%s doesn't say how much space it has", t.url)
+	}
+	return strconv.ParseInt(props.QuotaAvailable, 10, 64)
+}
+
+func (t *DAVTransport) Close() error {
+	return nil
+}
+
+// URL of repository path p
+func (t *DAVTransport) href(p string) string {
+	u := t.base
+	p = cleanPath(p)
+	if p != "" {
+		u.Path += "/" + p
+	}
+	u.RawPath = uriEncode(u.Path, false)
+	return u.String()
+}
+
+// Moves from over to
+func (t *DAVTransport) move(from, to string) error {
+	header := http.Header{}
+	header.Set("Destination", t.href(to))
+	header.Set("Overwrite", "T")
+	resp, err := t.do("MOVE", from, header, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Copies file from over to
+func (t *DAVTransport) copy(from, to string) error {
+	header := http.Header{}
+	header.Set("Destination", t.href(to))
+	header.Set("Overwrite", "T")
+	header.Set("Depth", "0")
+	resp, err := t.do("COPY", from, header, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Makes collection dir and any of its parents that are missing, up to and
+// including the repository's root collection.
+func (t *DAVTransport) mkdirs(dir string) error {
+	dir = cleanPath(dir)
+	if _, ok := t.madeDirs.Load(dir); ok {
+		return nil
+	}
+	if dir != "" {
+		err := t.mkdirs(path.Dir(dir))
+		if err != nil {
+			return err
+		}
+	}
+
+	resp, err := t.do("MKCOL", dir, nil, nil)
+	if err == nil {
+		resp.Body.Close()
+	} else if derr, ok := err.(*davError); ok && derr.status == http.StatusMethodNotAllowed {
+		// already there
+		err = nil
+	}
+	if err == nil {
+		t.madeDirs.Store(dir, true)
+	}
+	return err
+}
+
+// Properties of one resource
+type davProps struct {
+	ContentLength string `xml:"getcontentlength"`
+	LastModified  string `xml:"getlastmodified"`
+	ResourceType  struct {
+		Collection *struct{} `xml:"collection"`
+	} `xml:"resourcetype"`
+	QuotaAvailable string `xml:"quota-available-bytes"`
+}
+
+// Gets some properties of p with a Depth 0 PROPFIND
+func (t *DAVTransport) propfind(p, props string) (davProps, error) {
+	body := `<?xml version="1.0" encoding="utf-8"?><d:propfind xmlns:d="DAV:"><d:prop>` +
+		props + `</d:prop></d:propfind>`
+	header := http.Header{}
+	header.Set("Depth", "0")
+	header.Set("Content-Type", "application/xml; charset=utf-8")
+	resp, err := t.do("PROPFIND", p, header, strings.NewReader(body))
+	if err != nil {
+		return davProps{}, err
+	}
+	defer resp.Body.Close()
+
+	var ms struct {
+		Responses []struct {
+			Propstats []struct {
+				Prop   davProps `xml:"prop"`
+				Status string   `xml:"status"`
+			} `xml:"propstat"`
+		} `xml:"response"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&ms)
+	if err != nil {
+		return davProps{}, fmt.Errorf("bad PROPFIND answer for %s: %v", p, err)
+	}
+	if len(ms.Responses) == 0 {
+		return davProps{}, fmt.Errorf("empty PROPFIND answer for %s", p)
+	}
+
+	// properties the share doesn't have come back in a 404 propstat
+	var found davProps
+	for _, ps := range ms.Responses[0].Propstats {
+		if strings.Contains(ps.Status, " 200") {
+			found = ps.Prop
+		}
+	}
+	return found, nil
+}
+
+// Sends a request for repository path p. Missing files give os.IsNotExist()
+// errors, and other failures give the status. The caller closes the response
+// body.
+func (t *DAVTransport) do(method, p string, header http.Header, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, t.href(p), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if n := header.Get("Content-Length"); n != "" {
+		req.ContentLength, _ = strconv.ParseInt(n, 10, 64)
+		req.Header.Del("Content-Length")
+	}
+	if t.user != "" || t.password != "" {
+		req.SetBasicAuth(t.user, t.password)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, &os.PathError{Op: strings.ToLower(method), Path: p, Err: os.ErrNotExist}
+	}
+	if resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, &davError{method, p, resp.StatusCode, resp.Status}
+	}
+	return resp, nil
+}
+
+// A request the share said no to
+type davError struct {
+	method string
+	path   string
+	status int
+	text   string // e.g. "409 Conflict"
+}
+
+func (e *davError) Error() string {
+	return fmt.Sprintf("webdav %s %s: %s", e.method, e.path, e.text)
+}
+
+// Counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
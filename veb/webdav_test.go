@@ -0,0 +1,381 @@
+// Copyright 2012 The veb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package veb
+
+import (
+	"bytes"
+	"crypto"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	testDAVUser     = "veb"
+	testDAVPassword = "secret"
+	testDAVQuota    = 123456789
+)
+
+// A WebDAV share in a folder: just what DAVTransport uses, answering the way
+// RFC 4918 says to (e.g. 409 for a PUT into a missing collection)
+type fakeDAV struct {
+	root string
+	lock sync.Mutex
+	log  []string // "METHOD path" of each request
+	full bool     // PUTs fail, as over quota
+}
+
+func (s *fakeDAV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, password, _ := r.BasicAuth()
+	if user != testDAVUser || password != testDAVPassword {
+		http.Error(w, "who are you?", http.StatusUnauthorized)
+		return
+	}
+	s.lock.Lock()
+	s.log = append(s.log, r.Method+" "+r.URL.Path)
+	s.lock.Unlock()
+
+	name := filepath.Join(s.root, filepath.FromSlash(r.URL.Path))
+	info, err := os.Stat(name)
+	exists := err == nil
+	parent, perr := os.Stat(filepath.Dir(name))
+	parentOK := perr == nil && parent.IsDir()
+
+	switch r.Method {
+	case "GET", "HEAD":
+		if !exists || info.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+		file, err := os.Open(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer file.Close()
+		// does Range
+		http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+
+	case "PUT":
+		if !parentOK {
+			http.Error(w, "no such collection", http.StatusConflict)
+			return
+		}
+		if s.full {
+			http.Error(w, "over quota", http.StatusInsufficientStorage)
+			return
+		}
+		file, err := os.Create(name)
+		if err == nil {
+			_, err = io.Copy(file, r.Body)
+			file.Close()
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+
+	case "MKCOL":
+		switch {
+		case exists:
+			http.Error(w, "already there", http.StatusMethodNotAllowed)
+		case !parentOK:
+			http.Error(w, "no such collection", http.StatusConflict)
+		default:
+			os.Mkdir(name, 0755)
+			w.WriteHeader(http.StatusCreated)
+		}
+
+	case "MOVE", "COPY":
+		dest, err := url.Parse(r.Header.Get("Destination"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		to := filepath.Join(s.root, filepath.FromSlash(dest.Path))
+		if _, err := os.Stat(filepath.Dir(to)); err != nil {
+			http.Error(w, "no such collection", http.StatusConflict)
+			return
+		}
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Overwrite") != "T" {
+			if _, err := os.Stat(to); err == nil {
+				http.Error(w, "already there", http.StatusPreconditionFailed)
+				return
+			}
+		}
+		os.RemoveAll(to)
+		if r.Method == "COPY" {
+			data, _ := os.ReadFile(name)
+			os.WriteFile(to, data, 0644)
+		} else {
+			os.Rename(name, to)
+		}
+		w.WriteHeader(http.StatusCreated)
+
+	case "DELETE":
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		os.RemoveAll(name)
+		w.WriteHeader(http.StatusNoContent)
+
+	case "PROPFIND":
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Depth") != "0" {
+			http.Error(w, "only Depth 0", http.StatusForbidden)
+			return
+		}
+		kind, length := "", fmt.Sprint(info.Size())
+		if info.IsDir() {
+			kind, length = "<d:collection/>", ""
+		}
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.WriteHeader(http.StatusMultiStatus)
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>
+<d:multistatus xmlns:d="DAV:"><d:response><d:href>%s</d:href>
+<d:propstat><d:prop><d:getcontentlength>%s</d:getcontentlength><d:getlastmodified>%s</d:getlastmodified>
+<d:resourcetype>%s</d:resourcetype><d:quota-available-bytes>%d</d:quota-available-bytes></d:prop>
+<d:status>HTTP/1.1 200 OK</d:status></d:propstat>
+<d:propstat><d:prop><d:getetag/></d:prop><d:status>HTTP/1.1 404 Not Found</d:status></d:propstat>
+</d:response></d:multistatus>`, r.URL.EscapedPath(), length, info.ModTime().UTC().Format(http.TimeFormat), kind, testDAVQuota)
+
+	default:
+		http.Error(w, r.Method, http.StatusMethodNotAllowed)
+	}
+}
+
+// Requests since the last call
+func (s *fakeDAV) requests() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	log := s.log
+	s.log = nil
+	return log
+}
+
+// A DAVTransport for the repository at /my music on a fake share
+func newTestDAV(t *testing.T, password string) (*DAVTransport, *fakeDAV, func()) {
+	s := &fakeDAV{root: t.TempDir()}
+	server := httptest.NewServer(s)
+	t.Setenv(DAV_PASSWORD, password)
+	u, err := url.Parse(strings.Replace(server.URL, "http://", DAV_SCHEME+"://"+testDAVUser+"@", 1) + "/my%20music")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := NewDAVTransport(u, testLog())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr, s, server.Close
+}
+
+func TestDAVWrite(t *testing.T) {
+	tr, s, done := newTestDAV(t, testDAVPassword)
+	defer done()
+
+	entry, data := testFile("a/b c/song.mp3", 5000)
+	err := tr.Write(entry, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"MKCOL /my music",
+		"MKCOL /my music/a",
+		"MKCOL /my music/a/b c",
+		"PUT /my music/a/b c/song.mp3" + TEMP_SUFFIX,
+		"PROPFIND /my music/a/b c/song.mp3" + TEMP_SUFFIX,
+		"MOVE /my music/a/b c/song.mp3" + TEMP_SUFFIX,
+	}
+	if got := s.requests(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Write sent\n  %s\nwant\n  %s", strings.Join(got, "\n  "), strings.Join(want, "\n  "))
+	}
+	got, err := os.ReadFile(filepath.Join(s.root, "my music/a/b c/song.mp3"))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("share has %d bytes (%v), not what was written", len(got), err)
+	}
+
+	// folders it made are remembered
+	entry, data = testFile("a/b c/other.mp3", 10)
+	err = tr.Write(entry, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, req := range s.requests() {
+		if strings.HasPrefix(req, "MKCOL") {
+			t.Errorf("second Write into a/b c sent %s", req)
+		}
+	}
+
+	// damaged on the way: nothing replaced, temp file gone
+	bad := append([]byte(nil), data...)
+	bad[0]++
+	err = tr.Write(entry, bytes.NewReader(bad))
+	if err == nil {
+		t.Errorf("Write of a file that doesn't match its checksum worked")
+	}
+	got, _ = os.ReadFile(filepath.Join(s.root, "my music/a/b c/other.mp3"))
+	if !bytes.Equal(got, data) {
+		t.Errorf("Write of a file that doesn't match its checksum replaced the old one")
+	}
+	if _, err := os.Stat(filepath.Join(s.root, "my music/a/b c/other.mp3"+TEMP_SUFFIX)); !os.IsNotExist(err) {
+		t.Errorf("Write of a file that doesn't match its checksum left its temp file: %v", err)
+	}
+}
+
+func TestDAVReadStat(t *testing.T) {
+	tr, _, done := newTestDAV(t, testDAVPassword)
+	defer done()
+
+	entry, data := testFile("a/song.mp3", 5000)
+	err := tr.Write(entry, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := tr.Open(entry.Path)
+	if got := readAll(t, r, err); !bytes.Equal(got, data) {
+		t.Errorf("Open got %d bytes, not what was written", len(got))
+	}
+	r, err = tr.OpenRange(entry.Path, 4000, 1000)
+	if got := readAll(t, r, err); !bytes.Equal(got, data[4000:]) {
+		t.Errorf("OpenRange(4000, 1000) got %d bytes, not the end of the file", len(got))
+	}
+
+	info, err := tr.Stat(entry.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != entry.Size || info.IsDir() || info.Name() != "song.mp3" || info.ModTime().IsZero() {
+		t.Errorf("Stat = %s %d %v %v", info.Name(), info.Size(), info.Mode(), info.ModTime())
+	}
+	info, err = tr.Stat("a")
+	if err != nil || !info.IsDir() {
+		t.Errorf("Stat of folder a: %v, %v", info, err)
+	}
+
+	for _, p := range []string{"a/missing.mp3", "missing/song.mp3"} {
+		if _, err := tr.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("Stat of %s: %v, want a not-exist error", p, err)
+		}
+		if _, err := tr.Open(p); !os.IsNotExist(err) {
+			t.Errorf("Open of %s: %v, want a not-exist error", p, err)
+		}
+		if err := tr.Remove(p); !os.IsNotExist(err) {
+			t.Errorf("Remove of %s: %v, want a not-exist error", p, err)
+		}
+	}
+
+	free, err := tr.FreeSpace()
+	if err != nil || free != testDAVQuota {
+		t.Errorf("FreeSpace = %d, %v, want %d", free, err, testDAVQuota)
+	}
+}
+
+func TestDAVRenameRemove(t *testing.T) {
+	tr, s, done := newTestDAV(t, testDAVPassword)
+	defer done()
+
+	entry, data := testFile("a/song.mp3", 100)
+	err := tr.Write(entry, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = tr.Rename("a/song.mp3", ".veb/trash/1/a/song.mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(s.root, "my music/.veb/trash/1/a/song.mp3"))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Rename into a new folder: %d bytes, %v", len(got), err)
+	}
+	if _, err := tr.Stat("a/song.mp3"); !os.IsNotExist(err) {
+		t.Errorf("a/song.mp3 is still there after renaming it: %v", err)
+	}
+
+	err = tr.Remove(".veb/trash/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(s.root, "my music/.veb/trash/1")); !os.IsNotExist(err) {
+		t.Errorf("Remove of a folder left it: %v", err)
+	}
+
+	// a folder that was removed is made again when it's needed
+	err = tr.Rename("a", ".veb/trash/1/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(s.root, "my music/.veb/trash/1/a")); err != nil {
+		t.Errorf("Rename into a folder that was removed: %v", err)
+	}
+}
+
+func TestDAVBadPassword(t *testing.T) {
+	tr, _, done := newTestDAV(t, "not the password")
+	defer done()
+
+	_, err := tr.Stat("a")
+	derr, ok := err.(*davError)
+	if !ok || derr.status != http.StatusUnauthorized {
+		t.Errorf("Stat with the wrong password: %v, want 401", err)
+	}
+}
+
+// A save that fails leaves the old index where LoadIndex looks for it
+func TestDAVSaveIndex(t *testing.T) {
+	tr, s, done := newTestDAV(t, testDAVPassword)
+	defer done()
+
+	x, err := New(crypto.SHA1, tr.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, _ := testFile("a/song.mp3", 10)
+	x.Files[entry.Path] = entry
+	err = tr.SaveIndex(x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.SaveIndex(x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{INDEX_FILE, INDEX_FILE + "~", XSUMS_FILE, XSUMS_FILE + "~"} {
+		if _, err := os.Stat(filepath.Join(s.root, "my music", META_FOLDER, p)); err != nil {
+			t.Errorf("no %s after saving twice: %v", p, err)
+		}
+	}
+
+	s.full = true
+	delete(x.Files, entry.Path)
+	err = tr.SaveIndex(x)
+	if err == nil {
+		t.Errorf("SaveIndex to a full share worked")
+	}
+	saved, err := tr.LoadIndex()
+	if err != nil {
+		t.Fatalf("LoadIndex after a failed save: %v", err)
+	}
+	if saved.UUID != x.UUID || len(saved.Files) != 1 {
+		t.Errorf("LoadIndex after a failed save got %d files, want the 1 saved before", len(saved.Files))
+	}
+}